@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+
+	"github.com/spf13/cobra"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+const (
+	FlagAdminUrl    = "admin-url"
+	FlagFromVersion = "from-version"
+	FlagToVersion   = "to-version"
+	FlagVersion     = "version"
+	FlagOutputPath  = "output-path"
+	FlagInputPath   = "input-path"
+)
+
+// GetSquashCmd returns squash document versions admin command.
+func GetSquashCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "squash",
+		Short: "Squash server document versions range into one",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Parse inputs
+			adminUrl, err := cmd.Flags().GetString(FlagAdminUrl)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagAdminUrl, err)
+			}
+			fromVersion, err := cmd.Flags().GetInt(FlagFromVersion)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagFromVersion, err)
+			}
+			toVersion, err := cmd.Flags().GetInt(FlagToVersion)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagToVersion, err)
+			}
+
+			// Work
+			rpcClient, err := rpc.Dial("tcp", adminUrl)
+			if err != nil {
+				log.Fatalf("rpc.Dial(%s): %v", adminUrl, err)
+			}
+			defer rpcClient.Close()
+
+			req := model.SquashVersionsRequest{
+				FromVersion: fromVersion,
+				ToVersion:   toVersion,
+			}
+			res := model.SquashVersionsResponse{}
+			if err := rpcClient.Call("AdminService.SquashVersions", req, &res); err != nil {
+				log.Fatalf("squash failed: %v", err)
+			}
+
+			log.Printf("Versions [v%d, v%d] squashed, latest version: v%d", fromVersion, toVersion, res.LatestVersion)
+		},
+	}
+	cmd.Flags().String(FlagAdminUrl, "127.0.0.1:2414", "(optional) server admin RPC url")
+	cmd.Flags().Int(FlagFromVersion, 0, "the first version to squash")
+	cmd.Flags().Int(FlagToVersion, 0, "the last version to squash")
+
+	return cmd
+}
+
+// GetListAtVersionCmd returns view / download a previous list version admin command.
+func GetListAtVersionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "get-list",
+		Short: "View / download server list snapshot of a previous version",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Parse inputs
+			adminUrl, err := cmd.Flags().GetString(FlagAdminUrl)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagAdminUrl, err)
+			}
+			version, err := cmd.Flags().GetInt(FlagVersion)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagVersion, err)
+			}
+			outputPath, err := cmd.Flags().GetString(FlagOutputPath)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagOutputPath, err)
+			}
+
+			// Work
+			rpcClient, err := rpc.Dial("tcp", adminUrl)
+			if err != nil {
+				log.Fatalf("rpc.Dial(%s): %v", adminUrl, err)
+			}
+			defer rpcClient.Close()
+
+			req := model.GetListAtVersionRequest{
+				Version: version,
+			}
+			res := model.GetListAtVersionResponse{}
+			if err := rpcClient.Call("AdminService.GetListAtVersion", req, &res); err != nil {
+				log.Fatalf("get list failed: %v", err)
+			}
+
+			if outputPath == "" {
+				fmt.Print(res.Data.String())
+				log.Printf("Version v%d: %d items (%s values)", res.Version, len(res.Data), res.ValueCodec)
+				return
+			}
+
+			data, err := json.Marshal(res)
+			if err != nil {
+				log.Fatalf("JSON marshal: %v", err)
+			}
+			if err := ioutil.WriteFile(outputPath, data, 0644); err != nil {
+				log.Fatalf("write to file (%s): %v", outputPath, err)
+			}
+
+			log.Printf("Version v%d: %d items (%s values) saved to %s", res.Version, len(res.Data), res.ValueCodec, outputPath)
+		},
+	}
+	cmd.Flags().String(FlagAdminUrl, "127.0.0.1:2414", "(optional) server admin RPC url")
+	cmd.Flags().Int(FlagVersion, 0, "list version")
+	cmd.Flags().String(FlagOutputPath, "", "(optional) path to save the list as JSON (empty - print)")
+
+	return cmd
+}
+
+// GetRemoveVersionCmd returns remove document version admin command.
+func GetRemoveVersionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove-version",
+		Short: "Remove server document version (the later versions are rebuilt)",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Parse inputs
+			adminUrl, err := cmd.Flags().GetString(FlagAdminUrl)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagAdminUrl, err)
+			}
+			version, err := cmd.Flags().GetInt(FlagVersion)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagVersion, err)
+			}
+
+			// Work
+			rpcClient, err := rpc.Dial("tcp", adminUrl)
+			if err != nil {
+				log.Fatalf("rpc.Dial(%s): %v", adminUrl, err)
+			}
+			defer rpcClient.Close()
+
+			req := model.RemoveVersionRequest{
+				Version: version,
+			}
+			res := model.RemoveVersionResponse{}
+			if err := rpcClient.Call("AdminService.RemoveVersion", req, &res); err != nil {
+				log.Fatalf("remove failed: %v", err)
+			}
+
+			log.Printf("Version v%d removed, latest version: v%d", version, res.LatestVersion)
+		},
+	}
+	cmd.Flags().String(FlagAdminUrl, "127.0.0.1:2414", "(optional) server admin RPC url")
+	cmd.Flags().Int(FlagVersion, 0, "version to remove")
+
+	return cmd
+}
+
+// GetReplaceVersionCmd returns replace document version operations admin command.
+func GetReplaceVersionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "replace-version",
+		Short: "Replace server document version operations (the version and the later ones are rebuilt)",
+		Run: func(cmd *cobra.Command, args []string) {
+			// Parse inputs
+			adminUrl, err := cmd.Flags().GetString(FlagAdminUrl)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagAdminUrl, err)
+			}
+			version, err := cmd.Flags().GetInt(FlagVersion)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagVersion, err)
+			}
+			inputPath, err := cmd.Flags().GetString(FlagInputPath)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagInputPath, err)
+			}
+
+			data, err := ioutil.ReadFile(inputPath)
+			if err != nil {
+				log.Fatalf("read file (%s): %v", inputPath, err)
+			}
+			ops := make([]model.OperationRequest, 0)
+			if err := json.Unmarshal(data, &ops); err != nil {
+				log.Fatalf("JSON unmarshal: %v", err)
+			}
+
+			// Work
+			rpcClient, err := rpc.Dial("tcp", adminUrl)
+			if err != nil {
+				log.Fatalf("rpc.Dial(%s): %v", adminUrl, err)
+			}
+			defer rpcClient.Close()
+
+			req := model.ReplaceVersionRequest{
+				Version:    version,
+				Operations: ops,
+			}
+			res := model.ReplaceVersionResponse{}
+			if err := rpcClient.Call("AdminService.ReplaceVersion", req, &res); err != nil {
+				log.Fatalf("replace failed: %v", err)
+			}
+
+			log.Printf("Version v%d replaced with %d operations, latest version: v%d", version, len(ops), res.LatestVersion)
+		},
+	}
+	cmd.Flags().String(FlagAdminUrl, "127.0.0.1:2414", "(optional) server admin RPC url")
+	cmd.Flags().Int(FlagVersion, 0, "version to replace")
+	cmd.Flags().String(FlagInputPath, "", "path to the new version operations JSON (model.OperationRequest list)")
+
+	return cmd
+}
+
+func init() {
+	rootCmd.AddCommand(GetSquashCmd())
+	rootCmd.AddCommand(GetRemoveVersionCmd())
+	rootCmd.AddCommand(GetReplaceVersionCmd())
+	rootCmd.AddCommand(GetListAtVersionCmd())
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"math/rand"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,6 +11,7 @@ import (
 
 	"github.com/itiky/collaborate-storage/model"
 	"github.com/itiky/collaborate-storage/service/client"
+	"github.com/itiky/collaborate-storage/service/generator"
 )
 
 const (
@@ -20,13 +20,16 @@ const (
 	FlagOpsSendPeriod = "updates-period"
 	FlagOpsSendMax    = "updates-max"
 	FlagPollPeriod    = "poll-period"
+	FlagPushUrl       = "push-url"
+	FlagLongPollWait  = "long-poll-wait"
+	FlagStateDir      = "state-dir"
 )
 
 // GetClientCmd returns RPC-client start command.
 func GetClientCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "client",
-		Short: "Start RPC client",
+		Short: "Start RPC client (random load generator)",
 		Run: func(cmd *cobra.Command, args []string) {
 			// Parse inputs
 			serverUrl, err := cmd.Flags().GetString(FlagServerUrl)
@@ -49,9 +52,17 @@ func GetClientCmd() *cobra.Command {
 			if err != nil {
 				log.Fatalf("%s flag: %v", FlagPollPeriod, err)
 			}
-
-			if clientId == 0 {
-				clientId = uint(rand.Uint32())
+			longPollDur, err := cmd.Flags().GetDuration(FlagLongPollWait)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagLongPollWait, err)
+			}
+			pushUrl, err := cmd.Flags().GetString(FlagPushUrl)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagPushUrl, err)
+			}
+			stateDir, err := cmd.Flags().GetString(FlagStateDir)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagStateDir, err)
 			}
 
 			// Init service
@@ -59,28 +70,39 @@ func GetClientCmd() *cobra.Command {
 				model.ClientId(clientId),
 				opsSendDur,
 				pollDur,
-				opsSendMax,
+				longPollDur,
 				serverUrl,
+				pushUrl,
+				stateDir,
 			)
 			if err != nil {
 				log.Fatalf("service init: %v", err)
 			}
+			gen, err := generator.NewGenerator(svc, opsSendDur, opsSendMax)
+			if err != nil {
+				log.Fatalf("generator init: %v", err)
+			}
 
 			svc.Start()
+			gen.Start()
 
 			// Wait for signal
 			signalCh := make(chan os.Signal, 1)
 			signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 			<-signalCh
 
+			gen.Stop()
 			svc.Stop()
 		},
 	}
-	cmd.Flags().Uint(FlagClientId, 1, "unique clientID")
+	cmd.Flags().Uint(FlagClientId, 0, "(optional) unique clientID (0 - random one, persisted within the state directory)")
 	cmd.Flags().Int(FlagOpsSendMax, 5, "max number of snapshot updates per period")
 	cmd.Flags().String(FlagServerUrl, "127.0.0.1:2412", "(optional) server url")
 	cmd.Flags().Duration(FlagOpsSendPeriod, 1*time.Second, "(optional) snapshot updates send period")
 	cmd.Flags().Duration(FlagPollPeriod, 2*time.Second, "(optional) snapshot updates poll period")
+	cmd.Flags().Duration(FlagLongPollWait, 0, "(optional) snapshot updates long polling wait timeout: back-to-back long polls are used instead of polling (0 - disabled)")
+	cmd.Flags().String(FlagStateDir, "", "(optional) path to directory for the local state (outbox, snapshot) to work offline and survive restarts (empty - not persisted)")
+	cmd.Flags().String(FlagPushUrl, "", "(optional) server push stream url to subscribe to snapshot updates instead of polling (e.g. 127.0.0.1:2413)")
 
 	return cmd
 }
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/spf13/cobra"
 
+	"github.com/itiky/collaborate-storage/model"
 	"github.com/itiky/collaborate-storage/storage"
 )
 
 const (
 	FlagFilePath    = "file-path"
 	FlagStorageSize = "storage-size"
+	FlagValueCodec  = "value-codec"
 )
 
 // GetGenerateCmd returns generate mock data command.
@@ -28,15 +31,24 @@ func GetGenerateCmd() *cobra.Command {
 			if err != nil {
 				log.Fatalf("%s flag: %v", FlagStorageSize, err)
 			}
+			valueCodecName, err := cmd.Flags().GetString(FlagValueCodec)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagValueCodec, err)
+			}
+			valueCodec, err := model.GetValueCodec(valueCodecName)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagValueCodec, err)
+			}
 
 			// Work
-			if err := storage.GenAndSaveInitialStorage(filePath, storageSize); err != nil {
+			if err := storage.GenAndSaveInitialStorage(filePath, storageSize, valueCodec); err != nil {
 				log.Fatalf("gen failed: %v", err)
 			}
 		},
 	}
 	cmd.Flags().String(FlagFilePath, "./doc_v0.json", "(optional) output file path")
 	cmd.Flags().Int(FlagStorageSize, 10e6, "(optional) storage size")
+	cmd.Flags().String(FlagValueCodec, model.DefaultValueCodecName, fmt.Sprintf("(optional) storage value codec %v", model.GetValueCodecNames()))
 
 	return cmd
 }
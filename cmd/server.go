@@ -13,12 +13,33 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/itiky/collaborate-storage/service/server"
+	"github.com/itiky/collaborate-storage/storage"
 )
 
 const (
-	FlagPort         = "port"
-	FlagBatchChSize  = "batch-ch-size"
-	FlagHandlePeriod = "handle-period"
+	FlagPort               = "port"
+	FlagAdminAddr          = "admin-addr"
+	FlagBatchChSize        = "batch-ch-size"
+	FlagHandlePeriod       = "handle-period"
+	FlagSquashKeepVersions = "squash-keep-versions"
+	FlagSquashMaxAge       = "squash-max-age"
+	FlagWALPath            = "wal-path"
+	FlagCheckpointDir      = "checkpoint-dir"
+	FlagCheckpointPeriod   = "checkpoint-period"
+	FlagRetentionVersions  = "retention-keep-versions"
+	FlagRetentionMaxAge    = "retention-max-age"
+	FlagRetentionMaxMemory = "retention-max-memory"
+	FlagPushPort           = "push-port"
+	FlagPushBufferSize     = "push-buffer-size"
+	FlagInsertUpsert       = "insert-upsert"
+	FlagUpdateUpsert       = "update-upsert"
+	FlagDeleteIgnore       = "delete-ignore-missing"
+	FlagConflictPolicy     = "conflict-policy"
+	FlagMaxRequestOps      = "max-request-ops"
+	FlagMaxQueueOps        = "max-queue-ops"
+	FlagClientRate         = "client-rate"
+	FlagClientBurst        = "client-burst"
+	FlagMaxClockDrift      = "max-clock-drift"
 )
 
 // GetServerCmd returns RPC-server start command.
@@ -32,6 +53,10 @@ func GetServerCmd() *cobra.Command {
 			if err != nil {
 				log.Fatalf("%s flag: %v", FlagPort, err)
 			}
+			adminAddr, err := cmd.Flags().GetString(FlagAdminAddr)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagAdminAddr, err)
+			}
 			chSize, err := cmd.Flags().GetInt(FlagBatchChSize)
 			if err != nil {
 				log.Fatalf("%s flag: %v", FlagBatchChSize, err)
@@ -44,9 +69,119 @@ func GetServerCmd() *cobra.Command {
 			if err != nil {
 				log.Fatalf("%s flag: %v", FlagFilePath, err)
 			}
+			squashKeepVersions, err := cmd.Flags().GetInt(FlagSquashKeepVersions)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagSquashKeepVersions, err)
+			}
+			squashMaxAge, err := cmd.Flags().GetDuration(FlagSquashMaxAge)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagSquashMaxAge, err)
+			}
+			walPath, err := cmd.Flags().GetString(FlagWALPath)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagWALPath, err)
+			}
+			checkpointDir, err := cmd.Flags().GetString(FlagCheckpointDir)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagCheckpointDir, err)
+			}
+			checkpointPeriod, err := cmd.Flags().GetDuration(FlagCheckpointPeriod)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagCheckpointPeriod, err)
+			}
+			retentionVersions, err := cmd.Flags().GetInt(FlagRetentionVersions)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagRetentionVersions, err)
+			}
+			retentionMaxAge, err := cmd.Flags().GetDuration(FlagRetentionMaxAge)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagRetentionMaxAge, err)
+			}
+			retentionMaxMemory, err := cmd.Flags().GetInt64(FlagRetentionMaxMemory)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagRetentionMaxMemory, err)
+			}
+			pushPort, err := cmd.Flags().GetInt(FlagPushPort)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagPushPort, err)
+			}
+			pushBufferSize, err := cmd.Flags().GetInt(FlagPushBufferSize)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagPushBufferSize, err)
+			}
+			insertUpsert, err := cmd.Flags().GetBool(FlagInsertUpsert)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagInsertUpsert, err)
+			}
+			updateUpsert, err := cmd.Flags().GetBool(FlagUpdateUpsert)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagUpdateUpsert, err)
+			}
+			deleteIgnore, err := cmd.Flags().GetBool(FlagDeleteIgnore)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagDeleteIgnore, err)
+			}
+			conflictPolicyStr, err := cmd.Flags().GetString(FlagConflictPolicy)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagConflictPolicy, err)
+			}
+			conflictPolicy, err := storage.ParseConflictPolicy(conflictPolicyStr)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagConflictPolicy, err)
+			}
+			maxRequestOps, err := cmd.Flags().GetInt(FlagMaxRequestOps)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagMaxRequestOps, err)
+			}
+			maxQueueOps, err := cmd.Flags().GetInt(FlagMaxQueueOps)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagMaxQueueOps, err)
+			}
+			clientRate, err := cmd.Flags().GetFloat64(FlagClientRate)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagClientRate, err)
+			}
+			clientBurst, err := cmd.Flags().GetInt(FlagClientBurst)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagClientBurst, err)
+			}
+			maxClockDrift, err := cmd.Flags().GetDuration(FlagMaxClockDrift)
+			if err != nil {
+				log.Fatalf("%s flag: %v", FlagMaxClockDrift, err)
+			}
 
 			// Init service
-			svc, err := server.NewSortedListService(chSize, handleDur, filePath)
+			svc, err := server.NewSortedListService(server.Config{
+				ChSize:           chSize,
+				BatchPeriod:      handleDur,
+				FilePath:         filePath,
+				WALPath:          walPath,
+				CheckpointDir:    checkpointDir,
+				CheckpointPeriod: checkpointPeriod,
+				SquashPolicy: storage.SquashPolicy{
+					KeepVersions: squashKeepVersions,
+					MaxAge:       squashMaxAge,
+				},
+				RetentionPolicy: storage.RetentionPolicy{
+					KeepVersions: retentionVersions,
+					MaxAge:       retentionMaxAge,
+					MaxMemory:    retentionMaxMemory,
+				},
+				OperationPolicy: storage.OperationPolicy{
+					InsertUpsert:        insertUpsert,
+					UpdateUpsert:        updateUpsert,
+					DeleteIgnoreMissing: deleteIgnore,
+					Conflict:            conflictPolicy,
+				},
+				AdmissionPolicy: server.AdmissionPolicy{
+					MaxRequestOps: maxRequestOps,
+					MaxQueueOps:   maxQueueOps,
+					ClientRate:    clientRate,
+					ClientBurst:   clientBurst,
+				},
+				MaxClockDrift:  maxClockDrift,
+				PushBufferSize: pushBufferSize,
+			})
 			if err != nil {
 				log.Fatalf("service init: %v", err)
 			}
@@ -67,6 +202,39 @@ func GetServerCmd() *cobra.Command {
 
 			log.Printf("RPC server started: :%d", port)
 
+			if adminAddr != "" {
+				adminSvc, err := server.NewAdminService(svc)
+				if err != nil {
+					log.Fatalf("admin service init: %v", err)
+				}
+				adminServer := rpc.NewServer()
+				if err := adminServer.Register(adminSvc); err != nil {
+					log.Fatalf("Admin RPC server: register: %v", err)
+				}
+
+				adminListener, err := net.Listen("tcp", adminAddr)
+				if err != nil {
+					log.Fatalf("Admin RPC server: listen: %v", err)
+				}
+				defer adminListener.Close()
+
+				go adminServer.Accept(adminListener)
+
+				log.Printf("Admin RPC server started: %s", adminAddr)
+			}
+
+			if pushPort > 0 {
+				pushListener, err := net.Listen("tcp", ":"+strconv.Itoa(pushPort))
+				if err != nil {
+					log.Fatalf("Push server: listen: %v", err)
+				}
+				defer pushListener.Close()
+
+				go svc.ServePush(pushListener)
+
+				log.Printf("Push server started: :%d", pushPort)
+			}
+
 			// Wait for signal
 			signalCh := make(chan os.Signal, 1)
 			signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
@@ -76,9 +244,29 @@ func GetServerCmd() *cobra.Command {
 		},
 	}
 	cmd.Flags().Int(FlagPort, 2412, "(optional) server port")
+	cmd.Flags().String(FlagAdminAddr, "127.0.0.1:2414", "(optional) admin RPC server address (squash, previous versions download), should not be exposed to clients (empty - disabled)")
 	cmd.Flags().Int(FlagBatchChSize, 50, "(optional) input operation channel limit")
 	cmd.Flags().Duration(FlagHandlePeriod, 500*time.Millisecond, "(optional) input operations handling period")
 	cmd.Flags().String(FlagFilePath, "./resources/doc_v0_10M.dat", "(optional) path to generated storage file")
+	cmd.Flags().Int(FlagSquashKeepVersions, 0, "(optional) squash versions older than the latest N ones (0 - disabled)")
+	cmd.Flags().Duration(FlagSquashMaxAge, 0, "(optional) squash versions older than the duration (0 - disabled)")
+	cmd.Flags().String(FlagWALPath, "", "(optional) path to write-ahead log file to restore versions after restart (empty - disabled)")
+	cmd.Flags().String(FlagCheckpointDir, "", "(optional) path to directory for the latest state checkpoints (empty - disabled)")
+	cmd.Flags().Duration(FlagCheckpointPeriod, 10*time.Minute, "(optional) checkpoints writing period")
+	cmd.Flags().Int(FlagRetentionVersions, 0, "(optional) drop versions older than the latest N ones (0 - disabled)")
+	cmd.Flags().Duration(FlagRetentionMaxAge, 0, "(optional) drop versions older than the duration (0 - disabled)")
+	cmd.Flags().Int(FlagPushPort, 0, "(optional) list updates push stream port, e.g. 2413 (0 - disabled)")
+	cmd.Flags().Int(FlagPushBufferSize, 64, "(optional) max number of list update events buffered per subscriber")
+	cmd.Flags().Int64(FlagRetentionMaxMemory, 0, "(optional) drop the oldest versions while the history estimated memory usage exceeds the limit [bytes] (0 - disabled)")
+	cmd.Flags().Bool(FlagInsertUpsert, false, "(optional) insert of an existing item updates it instead of being rejected")
+	cmd.Flags().Bool(FlagUpdateUpsert, false, "(optional) update of an unknown item creates it instead of being rejected")
+	cmd.Flags().Bool(FlagDeleteIgnore, false, "(optional) delete of an unknown / deleted item is ignored instead of being rejected")
+	cmd.Flags().Int(FlagMaxRequestOps, 1000, "(optional) max number of operations per update request (0 - unlimited)")
+	cmd.Flags().Int(FlagMaxQueueOps, 100000, "(optional) max number of queued operations, update requests get the busy error above it (0 - unlimited)")
+	cmd.Flags().Float64(FlagClientRate, 0, "(optional) per-client operations rate limit [ops/s] (0 - disabled)")
+	cmd.Flags().Int(FlagClientBurst, 1000, "(optional) per-client operations burst (used with the rate limit)")
+	cmd.Flags().Duration(FlagMaxClockDrift, time.Minute, "(optional) max client clock lead over the server one, operations stamped further in the future get the server timestamp (0 - unlimited)")
+	cmd.Flags().String(FlagConflictPolicy, storage.DeleteWinsConflictPolicy.String(), "(optional) update / delete conflict policy [delete-wins, update-resurrects, timestamp]")
 
 	return cmd
 }
@@ -0,0 +1,50 @@
+package fileutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes and syncs the file using a temporary file (within the same directory) and the atomic rename.
+func WriteFileAtomic(filePath string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+"*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("sync: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), filePath); err != nil {
+		return fmt.Errorf("rename (%s): %w", filePath, err)
+	}
+
+	// Sync the directory to persist the rename
+	return SyncDir(filepath.Dir(filePath))
+}
+
+// SyncDir syncs the directory to persist files creation / renames.
+func SyncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+
+	return nil
+}
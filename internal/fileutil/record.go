@@ -0,0 +1,97 @@
+// Package fileutil implements on-disk primitives shared by the server storage and the client state:
+// CRC32 checked GOB records and atomic file writes.
+package fileutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	// Record frame header: payload length + payload CRC32
+	frameHeaderLen = 8
+	// Max record payload length (sanity check for corrupted frames)
+	maxPayloadLen = 1 << 30
+)
+
+// EncodeRecord encodes the record frame: [payload length: uint32][payload CRC32: uint32][GOB payload].
+func EncodeRecord(v interface{}) ([]byte, error) {
+	payload := new(bytes.Buffer)
+	if err := gob.NewEncoder(payload).Encode(v); err != nil {
+		return nil, fmt.Errorf("GOB marshal: %w", err)
+	}
+
+	frame := make([]byte, frameHeaderLen, frameHeaderLen+payload.Len())
+	binary.BigEndian.PutUint32(frame[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+
+	return append(frame, payload.Bytes()...), nil
+}
+
+// ReadRecord reads and validates a single record frame decoding the payload into v (must be a zero value).
+// Returns the frame length, io.EOF if there are no more records.
+// A torn or corrupted frame (crash during append) is returned as an error.
+func ReadRecord(reader io.Reader, v interface{}) (int64, error) {
+	frameHeader := make([]byte, frameHeaderLen)
+	if n, err := io.ReadFull(reader, frameHeader); err != nil {
+		if err == io.EOF && n == 0 {
+			return 0, io.EOF
+		}
+		return 0, fmt.Errorf("frame header: %w", err)
+	}
+
+	payloadLen := binary.BigEndian.Uint32(frameHeader[0:4])
+	if payloadLen > maxPayloadLen {
+		return 0, fmt.Errorf("payload length %d: too big", payloadLen)
+	}
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, fmt.Errorf("payload: %w", err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(frameHeader[4:8]) {
+		return 0, errors.New("payload: checksum mismatch")
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(v); err != nil {
+		return 0, fmt.Errorf("GOB unmarshal: %w", err)
+	}
+
+	return int64(frameHeaderLen + payloadLen), nil
+}
+
+// WriteRecordFile writes the file with a single record using WriteFileAtomic.
+func WriteRecordFile(filePath string, v interface{}) error {
+	frame, err := EncodeRecord(v)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(filePath, frame)
+}
+
+// ReadRecordFile reads the file with a single record (refer to WriteRecordFile).
+// Returns an error wrapping os.ErrNotExist if the file doesn't exist.
+func ReadRecordFile(filePath string, v interface{}) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("open file (%s): %w", filePath, err)
+	}
+	defer file.Close()
+
+	if _, err := ReadRecord(bufio.NewReader(file), v); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("file (%s): empty", filePath)
+		}
+		return fmt.Errorf("file (%s): %w", filePath, err)
+	}
+
+	return nil
+}
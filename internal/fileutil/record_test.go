@@ -0,0 +1,88 @@
+package fileutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testRecord struct {
+	Id   int
+	Name string
+}
+
+// Test reads framed records stopping at a torn or corrupted one.
+func Test_Record_Read(t *testing.T) {
+	data := make([]byte, 0)
+	for i := 0; i < 3; i++ {
+		frame, err := EncodeRecord(testRecord{Id: i + 1, Name: "record"})
+		require.NoError(t, err)
+		data = append(data, frame...)
+	}
+	frameLen := len(data) / 3
+
+	readAll := func(data []byte) ([]testRecord, error) {
+		reader := bytes.NewReader(data)
+		recs := make([]testRecord, 0)
+		for {
+			rec := testRecord{}
+			n, err := ReadRecord(reader, &rec)
+			if err == io.EOF {
+				return recs, nil
+			}
+			if err != nil {
+				return recs, err
+			}
+			require.Equal(t, int64(frameLen), n)
+			recs = append(recs, rec)
+		}
+	}
+
+	recs, err := readAll(data)
+	require.NoError(t, err)
+	require.Equal(t, []testRecord{{1, "record"}, {2, "record"}, {3, "record"}}, recs)
+
+	// Torn header / payload
+	for _, tornLen := range []int{3, frameLen - 1} {
+		recs, err = readAll(data[:2*frameLen+tornLen])
+		require.Error(t, err)
+		require.Len(t, recs, 2)
+	}
+
+	// Corrupted payload
+	corrupted := append([]byte(nil), data...)
+	corrupted[frameLen+frameHeaderLen+1] ^= 0xFF
+	recs, err = readAll(corrupted)
+	require.Error(t, err)
+	require.Len(t, recs, 1)
+}
+
+// Test writes and reads a single record file.
+func Test_RecordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileutil")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "state.dat")
+	require.True(t, errors.Is(ReadRecordFile(filePath, &testRecord{}), os.ErrNotExist))
+
+	require.NoError(t, WriteRecordFile(filePath, testRecord{Id: 1, Name: "first"}))
+	require.NoError(t, WriteRecordFile(filePath, testRecord{Id: 2, Name: "second"}))
+	rec := testRecord{}
+	require.NoError(t, ReadRecordFile(filePath, &rec))
+	require.Equal(t, testRecord{Id: 2, Name: "second"}, rec)
+
+	// No temporary files left
+	fileInfos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, fileInfos, 1)
+
+	require.NoError(t, ioutil.WriteFile(filePath, nil, 0644))
+	require.Error(t, ReadRecordFile(filePath, &testRecord{}))
+}
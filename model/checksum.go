@@ -0,0 +1,81 @@
+package model
+
+import (
+	"hash/fnv"
+	"math/bits"
+)
+
+const (
+	// ListHash modulus (Mersenne prime 2^61-1)
+	listHashMod = 1<<61 - 1
+	// ListHash polynomial base
+	listHashBase = 0x5bd1e9955bd1e99
+)
+
+// EmptyListHash is the empty list hash.
+var EmptyListHash = ListHash{Sum: 0, Pow: 1}
+
+// ListHash is an order-sensitive StorageList polynomial hash modulo 2^61-1:
+// Sum = h(item[0])*B^(n-1) + h(item[1])*B^(n-2) + ... + h(item[n-1]).
+// Hash of two concatenated lists is calculated from their hashes, so it is maintained incrementally
+// within order-statistic trees (every node keeps its subtree hash).
+type ListHash struct {
+	// Hash value (used as the list checksum)
+	Sum uint64
+	// B^n
+	Pow uint64
+}
+
+// Concat returns the hash of the list followed by the next one.
+func (h ListHash) Concat(next ListHash) ListHash {
+	return ListHash{
+		Sum: addMod61(mulMod61(h.Sum, next.Pow), next.Sum),
+		Pow: mulMod61(h.Pow, next.Pow),
+	}
+}
+
+// Checksum returns the list order-sensitive checksum (ListHash sum) calculated from scratch.
+func (l StorageList) Checksum() uint64 {
+	h := EmptyListHash
+	for _, item := range l {
+		h = h.Concat(NewListItemHash(item.Id, item.Value))
+	}
+
+	return h.Sum
+}
+
+// NewListItemHash returns a single item list hash.
+func NewListItemHash(id string, value StorageValue) ListHash {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(id))
+	hasher.Write([]byte{0})
+	hasher.Write(value)
+
+	return ListHash{
+		Sum: hasher.Sum64() % listHashMod,
+		Pow: listHashBase,
+	}
+}
+
+// mulMod61 returns a*b mod 2^61-1 (a, b < 2^61-1).
+func mulMod61(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	// 2^64 = 2^3 * 2^61 = 2^3 (mod 2^61-1)
+	r := (lo & listHashMod) + (lo >> 61) + (hi << 3)
+	r = (r & listHashMod) + (r >> 61)
+	if r >= listHashMod {
+		r -= listHashMod
+	}
+
+	return r
+}
+
+// addMod61 returns a+b mod 2^61-1 (a, b < 2^61-1).
+func addMod61(a, b uint64) uint64 {
+	r := a + b
+	if r >= listHashMod {
+		r -= listHashMod
+	}
+
+	return r
+}
@@ -0,0 +1,190 @@
+package model
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// hlcBinaryMarker is the first byte of the HLC binary format (time.Time binary format starts with a version byte 1 or 2).
+const hlcBinaryMarker = 'H'
+
+type (
+	// HLC is a hybrid logical clock timestamp.
+	// Timestamps are ordered by the physical (wall) time first and by the logical counter next,
+	// an event caused by another one always gets a greater timestamp even if node wall clocks are skewed.
+	HLC struct {
+		// Physical time [unix ns]
+		Wall int64
+		// Logical counter (distinguishes events with the same physical time)
+		Logical uint32
+	}
+
+	// HLClock is a hybrid logical clock (HLC timestamps source).
+	HLClock struct {
+		sync.Mutex
+		// Max allowed remote clock lead (0 - not checked)
+		maxDrift time.Duration
+		// Physical time source
+		nowFn func() time.Time
+		// The latest timestamp issued / observed
+		last HLC
+	}
+)
+
+// HLCFromTime creates a HLC timestamp from the physical time.
+func HLCFromTime(t time.Time) HLC {
+	if t.IsZero() {
+		return HLC{}
+	}
+
+	return HLC{Wall: t.UnixNano()}
+}
+
+// IsZero checks if the timestamp is not set.
+func (t HLC) IsZero() bool {
+	return t.Wall == 0 && t.Logical == 0
+}
+
+// Compare returns -1 if t is before u, +1 if t is after u and 0 if they are equal.
+func (t HLC) Compare(u HLC) int {
+	switch {
+	case t.Wall < u.Wall:
+		return -1
+	case t.Wall > u.Wall:
+		return 1
+	case t.Logical < u.Logical:
+		return -1
+	case t.Logical > u.Logical:
+		return 1
+	}
+
+	return 0
+}
+
+// Before checks if t is before u.
+func (t HLC) Before(u HLC) bool {
+	return t.Compare(u) < 0
+}
+
+// After checks if t is after u.
+func (t HLC) After(u HLC) bool {
+	return t.Compare(u) > 0
+}
+
+// Time returns the timestamp physical time.
+func (t HLC) Time() time.Time {
+	if t.Wall == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, t.Wall).UTC()
+}
+
+// String implements stringer interface.
+func (t HLC) String() string {
+	return fmt.Sprintf("%s#%d", t.Time().Format(time.RFC3339Nano), t.Logical)
+}
+
+// GobEncode implements gob.GobEncoder interface.
+func (t HLC) GobEncode() ([]byte, error) {
+	buf := make([]byte, 13)
+	buf[0] = hlcBinaryMarker
+	binary.BigEndian.PutUint64(buf[1:9], uint64(t.Wall))
+	binary.BigEndian.PutUint32(buf[9:13], t.Logical)
+
+	return buf, nil
+}
+
+// GobDecode implements gob.GobDecoder interface.
+// time.Time encoded data is also accepted (storage files generated before timestamps became HLC).
+func (t *HLC) GobDecode(data []byte) error {
+	if len(data) > 0 && data[0] == hlcBinaryMarker {
+		if len(data) != 13 {
+			return fmt.Errorf("HLC: invalid length: %d", len(data))
+		}
+		t.Wall = int64(binary.BigEndian.Uint64(data[1:9]))
+		t.Logical = binary.BigEndian.Uint32(data[9:13])
+
+		return nil
+	}
+
+	var tm time.Time
+	if err := tm.GobDecode(data); err != nil {
+		return fmt.Errorf("HLC: time.Time: %w", err)
+	}
+	*t = HLCFromTime(tm)
+
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler interface.
+func (t HLC) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Now returns a new timestamp (greater than any issued / observed before).
+func (c *HLClock) Now() HLC {
+	c.Lock()
+	defer c.Unlock()
+
+	wall := c.nowFn().UnixNano()
+	if wall > c.last.Wall {
+		c.last = HLC{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+
+	return c.last
+}
+
+// Update merges the remote timestamp into the clock and returns a new timestamp (greater than the remote one).
+// Remote timestamp ahead of the local physical time more than the max drift is rejected.
+func (c *HLClock) Update(remote HLC) (HLC, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	wall := c.nowFn().UnixNano()
+	if c.maxDrift > 0 {
+		if drift := time.Duration(remote.Wall - wall); drift > c.maxDrift {
+			return HLC{}, fmt.Errorf("remote clock is ahead by %v (max drift: %v)", drift, c.maxDrift)
+		}
+	}
+
+	switch {
+	case wall > c.last.Wall && wall > remote.Wall:
+		c.last = HLC{Wall: wall}
+	case c.last.Wall == remote.Wall:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	case remote.Wall > c.last.Wall:
+		c.last = HLC{Wall: remote.Wall, Logical: remote.Logical + 1}
+	default:
+		c.last.Logical++
+	}
+
+	return c.last, nil
+}
+
+// Last returns the latest timestamp issued / observed.
+func (c *HLClock) Last() HLC {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.last
+}
+
+// NewHLClock creates a new HLClock object.
+func NewHLClock(maxDrift time.Duration) (*HLClock, error) {
+	if maxDrift < 0 {
+		return nil, fmt.Errorf("%s: must be GTE 0", "maxDrift")
+	}
+
+	return &HLClock{
+		maxDrift: maxDrift,
+		nowFn:    time.Now,
+	}, nil
+}
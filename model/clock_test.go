@@ -0,0 +1,161 @@
+package model
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHLClock creates a new HLClock object with the manual physical time source.
+func newTestHLClock(t *testing.T, maxDrift time.Duration, wall *int64) *HLClock {
+	c, err := NewHLClock(maxDrift)
+	require.NoError(t, err)
+	c.nowFn = func() time.Time {
+		return time.Unix(0, *wall)
+	}
+
+	return c
+}
+
+// Test issues timestamps with the physical time moving forward, stalling and going backwards.
+func Test_HLClock_Now(t *testing.T) {
+	wall := int64(1000)
+	c := newTestHLClock(t, 0, &wall)
+
+	// Physical time moves forward: logical counter is reset
+	require.Equal(t, HLC{Wall: 1000}, c.Now())
+
+	// Physical time stalls / goes backwards: logical counter grows
+	require.Equal(t, HLC{Wall: 1000, Logical: 1}, c.Now())
+	wall = 900
+	require.Equal(t, HLC{Wall: 1000, Logical: 2}, c.Now())
+
+	wall = 1100
+	require.Equal(t, HLC{Wall: 1100}, c.Now())
+	require.Equal(t, HLC{Wall: 1100}, c.Last())
+
+	// Timestamps are always increasing
+	prev := c.Now()
+	for i := 0; i < 10; i++ {
+		wall += int64(i%3) - 1
+		ts := c.Now()
+		require.True(t, ts.After(prev), "%s -> %s", prev, ts)
+		prev = ts
+	}
+}
+
+// Test merges remote timestamps (all merge cases) and rejects ones beyond the max drift.
+func Test_HLClock_Update(t *testing.T) {
+	t.Run("physical time is ahead of both", func(t *testing.T) {
+		wall := int64(1000)
+		c := newTestHLClock(t, 0, &wall)
+		c.last = HLC{Wall: 500, Logical: 3}
+
+		ts, err := c.Update(HLC{Wall: 800, Logical: 7})
+		require.NoError(t, err)
+		require.Equal(t, HLC{Wall: 1000}, ts)
+	})
+
+	t.Run("remote wall equals the last one", func(t *testing.T) {
+		wall := int64(100)
+		c := newTestHLClock(t, 0, &wall)
+
+		// Remote logical counter is greater
+		c.last = HLC{Wall: 500, Logical: 3}
+		ts, err := c.Update(HLC{Wall: 500, Logical: 7})
+		require.NoError(t, err)
+		require.Equal(t, HLC{Wall: 500, Logical: 8}, ts)
+
+		// Local logical counter is greater
+		ts, err = c.Update(HLC{Wall: 500, Logical: 2})
+		require.NoError(t, err)
+		require.Equal(t, HLC{Wall: 500, Logical: 9}, ts)
+	})
+
+	t.Run("remote wall is ahead", func(t *testing.T) {
+		wall := int64(100)
+		c := newTestHLClock(t, 0, &wall)
+		c.last = HLC{Wall: 500, Logical: 3}
+
+		ts, err := c.Update(HLC{Wall: 700, Logical: 1})
+		require.NoError(t, err)
+		require.Equal(t, HLC{Wall: 700, Logical: 2}, ts)
+		require.Equal(t, ts, c.Last())
+	})
+
+	t.Run("last wall is ahead", func(t *testing.T) {
+		wall := int64(100)
+		c := newTestHLClock(t, 0, &wall)
+		c.last = HLC{Wall: 500, Logical: 3}
+
+		ts, err := c.Update(HLC{Wall: 300, Logical: 9})
+		require.NoError(t, err)
+		require.Equal(t, HLC{Wall: 500, Logical: 4}, ts)
+	})
+
+	t.Run("max drift", func(t *testing.T) {
+		wall := int64(time.Second)
+		c := newTestHLClock(t, time.Second, &wall)
+		c.last = HLC{Wall: wall}
+
+		// Within the drift
+		ts, err := c.Update(HLC{Wall: wall + int64(time.Second)})
+		require.NoError(t, err)
+		require.Equal(t, HLC{Wall: wall + int64(time.Second), Logical: 1}, ts)
+
+		// Beyond the drift: clock is not changed
+		_, err = c.Update(HLC{Wall: wall + int64(time.Second) + 1})
+		require.Error(t, err)
+		require.Equal(t, ts, c.Last())
+
+		// Drift is not checked
+		c.maxDrift = 0
+		ts, err = c.Update(HLC{Wall: wall + int64(time.Hour)})
+		require.NoError(t, err)
+		require.Equal(t, HLC{Wall: wall + int64(time.Hour), Logical: 1}, ts)
+	})
+}
+
+// Test decodes GOB encoded HLC and legacy time.Time timestamps.
+func Test_HLC_Gob(t *testing.T) {
+	type hlcItem struct {
+		Timestamp HLC
+	}
+	type legacyItem struct {
+		Timestamp time.Time
+	}
+
+	decode := func(v interface{}) (hlcItem, error) {
+		buf := new(bytes.Buffer)
+		require.NoError(t, gob.NewEncoder(buf).Encode(v))
+
+		item := hlcItem{}
+		err := gob.NewDecoder(buf).Decode(&item)
+
+		return item, err
+	}
+
+	t.Run("HLC", func(t *testing.T) {
+		ts := HLC{Wall: time.Now().UnixNano(), Logical: 42}
+		item, err := decode(hlcItem{Timestamp: ts})
+		require.NoError(t, err)
+		require.Equal(t, ts, item.Timestamp)
+	})
+
+	t.Run("legacy time.Time", func(t *testing.T) {
+		tm := time.Date(2020, 5, 1, 12, 30, 0, 123, time.UTC)
+		item, err := decode(legacyItem{Timestamp: tm})
+		require.NoError(t, err)
+		require.Equal(t, HLC{Wall: tm.UnixNano()}, item.Timestamp)
+		require.True(t, item.Timestamp.Time().Equal(tm))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		ts := HLC{}
+		require.Error(t, ts.GobDecode([]byte{hlcBinaryMarker, 1, 2}))
+		require.Error(t, ts.GobDecode([]byte{0xff}))
+	})
+}
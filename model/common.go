@@ -3,7 +3,8 @@ package model
 type (
 	ClientId uint32
 
-	StorageValue int32
+	// StorageValue is an opaque storage element payload (ValueCodec defines its format and sort order).
+	StorageValue []byte
 )
 
 type OperationType string
@@ -12,4 +13,34 @@ const (
 	InsertOperationType OperationType = "insert"
 	UpdateOperationType OperationType = "update"
 	DeleteOperationType OperationType = "delete"
+	// Update request only: creates or updates an item
+	UpsertOperationType OperationType = "upsert"
+)
+
+// OperationStatus defines the update operation handling result.
+type OperationStatus string
+
+const (
+	// Operation changed the list
+	AppliedOperationStatus OperationStatus = "applied"
+	// Operation had no effect (delete of an unknown / deleted item)
+	IgnoredOperationStatus OperationStatus = "ignored"
+	// Operation was rejected (OperationErrorCode defines the reason)
+	RejectedOperationStatus OperationStatus = "rejected"
+)
+
+// OperationErrorCode defines the update operation rejection reason.
+type OperationErrorCode string
+
+const (
+	// Insert of an existing item
+	ItemExistsErrorCode OperationErrorCode = "item_exists"
+	// Update / delete of an unknown item
+	ItemNotFoundErrorCode OperationErrorCode = "item_not_found"
+	// Insert / update / delete of a deleted item
+	ItemDeletedErrorCode OperationErrorCode = "item_deleted"
+	// Delete of an item updated later (timestamp conflict policy)
+	ConflictErrorCode OperationErrorCode = "conflict"
+	// Other reasons
+	InternalErrorCode OperationErrorCode = "internal"
 )
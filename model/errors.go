@@ -0,0 +1,124 @@
+package model
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Typed errors message prefixes (RPC errors are transferred as strings).
+const (
+	busyErrorPrefix            = "server busy: retry after "
+	requestTooLargeErrorPrefix = "request too large: max operations "
+	invalidRequestErrorPrefix  = "invalid request: "
+)
+
+// BusyError is returned when the server can't accept a request right now (queue is full, client rate limit is exceeded).
+// Request should be retried after the RetryAfter duration.
+type BusyError struct {
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e BusyError) Error() string {
+	return busyErrorPrefix + e.RetryAfter.String()
+}
+
+// ParseBusyError checks if err is a BusyError (including one received as an RPC error string).
+func ParseBusyError(err error) (BusyError, bool) {
+	if err == nil {
+		return BusyError{}, false
+	}
+
+	busyErr := BusyError{}
+	if errors.As(err, &busyErr) {
+		return busyErr, true
+	}
+
+	remainder, ok := parseErrorRemainder(err, busyErrorPrefix)
+	if !ok {
+		return BusyError{}, false
+	}
+	retryAfter, err := time.ParseDuration(remainder)
+	if err != nil {
+		return BusyError{}, false
+	}
+
+	return BusyError{RetryAfter: retryAfter}, true
+}
+
+// RequestTooLargeError is returned when a request has more operations than the server accepts.
+// Request should be split into ones with up to MaxOps operations.
+type RequestTooLargeError struct {
+	MaxOps int
+}
+
+// Error implements the error interface.
+func (e RequestTooLargeError) Error() string {
+	return requestTooLargeErrorPrefix + strconv.Itoa(e.MaxOps)
+}
+
+// ParseRequestTooLargeError checks if err is a RequestTooLargeError (including one received as an RPC error string).
+func ParseRequestTooLargeError(err error) (RequestTooLargeError, bool) {
+	if err == nil {
+		return RequestTooLargeError{}, false
+	}
+
+	tooLargeErr := RequestTooLargeError{}
+	if errors.As(err, &tooLargeErr) {
+		return tooLargeErr, true
+	}
+
+	remainder, ok := parseErrorRemainder(err, requestTooLargeErrorPrefix)
+	if !ok {
+		return RequestTooLargeError{}, false
+	}
+	maxOps, err := strconv.Atoi(remainder)
+	if err != nil || maxOps <= 0 {
+		return RequestTooLargeError{}, false
+	}
+
+	return RequestTooLargeError{MaxOps: maxOps}, true
+}
+
+// InvalidRequestError is returned when a request can't be accepted at all (invalid operation, value).
+// Request should not be retried.
+type InvalidRequestError struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (e InvalidRequestError) Error() string {
+	return invalidRequestErrorPrefix + e.Reason
+}
+
+// ParseInvalidRequestError checks if err is an InvalidRequestError (including one received as an RPC error string).
+func ParseInvalidRequestError(err error) (InvalidRequestError, bool) {
+	if err == nil {
+		return InvalidRequestError{}, false
+	}
+
+	invalidErr := InvalidRequestError{}
+	if errors.As(err, &invalidErr) {
+		return invalidErr, true
+	}
+
+	reason, ok := parseErrorRemainder(err, invalidRequestErrorPrefix)
+	if !ok {
+		return InvalidRequestError{}, false
+	}
+
+	return InvalidRequestError{Reason: reason}, true
+}
+
+// parseErrorRemainder returns the error message remainder after the typed error prefix (wrapped errors add their context before it).
+func parseErrorRemainder(err error, prefix string) (string, bool) {
+	msg := err.Error()
+	idx := strings.Index(msg, prefix)
+	if idx < 0 {
+		return "", false
+	}
+
+	return msg[idx+len(prefix):], true
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test parses typed errors wrapped and received as RPC error strings.
+func Test_Errors_Parse(t *testing.T) {
+	busyErr, ok := ParseBusyError(rpc.ServerError(BusyError{RetryAfter: time.Second}.Error()))
+	require.True(t, ok)
+	require.Equal(t, time.Second, busyErr.RetryAfter)
+
+	tooLargeErr, ok := ParseRequestTooLargeError(fmt.Errorf("rpc: %w", rpc.ServerError(RequestTooLargeError{MaxOps: 100}.Error())))
+	require.True(t, ok)
+	require.Equal(t, 100, tooLargeErr.MaxOps)
+
+	tooLargeErr, ok = ParseRequestTooLargeError(fmt.Errorf("admit: %w", RequestTooLargeError{MaxOps: 5}))
+	require.True(t, ok)
+	require.Equal(t, 5, tooLargeErr.MaxOps)
+
+	invalidErr, ok := ParseInvalidRequestError(rpc.ServerError(InvalidRequestError{Reason: "updateOperation[0]: value: invalid"}.Error()))
+	require.True(t, ok)
+	require.Equal(t, "updateOperation[0]: value: invalid", invalidErr.Reason)
+
+	// Other errors
+	for _, err := range []error{nil, errors.New("commit: WAL write"), rpc.ServerError(requestTooLargeErrorPrefix + "abc")} {
+		_, ok := ParseBusyError(err)
+		require.False(t, ok, "%v", err)
+		_, ok = ParseRequestTooLargeError(err)
+		require.False(t, ok, "%v", err)
+		_, ok = ParseInvalidRequestError(err)
+		require.False(t, ok, "%v", err)
+	}
+}
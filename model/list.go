@@ -2,6 +2,7 @@ package model
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -28,14 +29,45 @@ type (
 func (l StorageList) String() string {
 	str := strings.Builder{}
 	for i, item := range l {
-		str.WriteString(fmt.Sprintf("- [%d] %d (%s)\n", i, item.Value, item.Id))
+		str.WriteString(fmt.Sprintf("- [%d] %x (%s)\n", i, item.Value, item.Id))
 	}
 
 	return str.String()
 }
 
+// Search returns the index of the item (or the index it should be inserted at) using the total sort order.
+func (l StorageList) Search(codec ValueCodec, item ListItem) int {
+	return sort.Search(len(l), func(i int) bool {
+		return CompareListItems(codec, l[i], item) >= 0
+	})
+}
+
+// IsOrdered checks if item at the specified index respects the total sort order with its neighbours.
+func (l StorageList) IsOrdered(codec ValueCodec, idx int) bool {
+	if idx > 0 && CompareListItems(codec, l[idx-1], l[idx]) >= 0 {
+		return false
+	}
+	if idx < len(l)-1 && CompareListItems(codec, l[idx], l[idx+1]) >= 0 {
+		return false
+	}
+
+	return true
+}
+
+// CompareListItems defines the list total sort order: by value (using the codec), then by ID.
+// Returns -1 if a goes before b, 1 if b goes before a and 0 for the same item.
+func CompareListItems(codec ValueCodec, a, b ListItem) int {
+	if res := codec.Compare(a.Value, b.Value); res != 0 {
+		return res
+	}
+
+	return strings.Compare(a.Id, b.Id)
+}
+
 // ApplyListOperations upgrades the input StorageList to a new version using ListOperation objects.
-func ApplyListOperations(l StorageList, ops ...ListOperation) (StorageList, error) {
+// Operation indexes are positions within the list total sort order (CompareListItems), so a list that diverged
+// from the server state is detected by an out of order insert.
+func ApplyListOperations(codec ValueCodec, l StorageList, ops ...ListOperation) (StorageList, error) {
 	for i, op := range ops {
 		switch op.Type {
 
@@ -54,6 +86,9 @@ func ApplyListOperations(l StorageList, ops ...ListOperation) (StorageList, erro
 				Id:    op.Id,
 				Value: op.Value,
 			}
+			if !l.IsOrdered(codec, op.Index) {
+				return nil, fmt.Errorf("op[%d] (%s): index: breaks the sort order", i, op.Type)
+			}
 
 		case UpdateOperationType:
 			if op.Index < 0 {
@@ -79,6 +114,9 @@ func ApplyListOperations(l StorageList, ops ...ListOperation) (StorageList, erro
 				Id:    id,
 				Value: op.Value,
 			}
+			if !l.IsOrdered(codec, op.NewIndex) {
+				return nil, fmt.Errorf("op[%d] (%s): newIndex: breaks the sort order", i, op.Type)
+			}
 
 		case DeleteOperationType:
 			if op.Index < 0 {
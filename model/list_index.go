@@ -0,0 +1,411 @@
+package model
+
+import "fmt"
+
+type (
+	// IndexedList is a StorageList representation for large client snapshots.
+	// Items are kept within an order-statistic AVL tree (every node keeps its subtree size) alongside the ID index,
+	// so list operations, position and ID lookups are O(log n) instead of O(n) slice copies / scans.
+	// Every node also keeps its subtree ListHash, so the list checksum is updated incrementally.
+	IndexedList struct {
+		codec ValueCodec
+		root  *indexedListNode
+		ids   map[string]*indexedListNode
+	}
+
+	indexedListNode struct {
+		item     ListItem
+		itemHash ListHash // item hash
+		hash     ListHash // subtree hash
+		left     *indexedListNode
+		right    *indexedListNode
+		size     int32
+		height   int8
+	}
+)
+
+// Len returns the list length (nil list is empty).
+func (l *IndexedList) Len() int {
+	if l == nil {
+		return 0
+	}
+
+	return int(l.root.getSize())
+}
+
+// Checksum returns the list order-sensitive checksum (equal to StorageList.Checksum).
+func (l *IndexedList) Checksum() uint64 {
+	if l == nil {
+		return EmptyListHash.Sum
+	}
+
+	return l.root.getHash().Sum
+}
+
+// At returns an item by its position within the list.
+func (l *IndexedList) At(idx int) (ListItem, bool) {
+	if idx < 0 || idx >= l.Len() {
+		return ListItem{}, false
+	}
+
+	n := l.root
+	for n != nil {
+		leftSize := int(n.left.getSize())
+		switch {
+		case idx < leftSize:
+			n = n.left
+		case idx > leftSize:
+			idx -= leftSize + 1
+			n = n.right
+		default:
+			return n.item, true
+		}
+	}
+
+	return ListItem{}, false
+}
+
+// Get returns an item and its position within the list by ID.
+func (l *IndexedList) Get(id string) (ListItem, int, bool) {
+	if l == nil {
+		return ListItem{}, -1, false
+	}
+
+	n, found := l.ids[id]
+	if !found {
+		return ListItem{}, -1, false
+	}
+
+	return n.item, l.Search(n.item), true
+}
+
+// Search returns the index of the item (or the index it should be inserted at) using the total sort order.
+func (l *IndexedList) Search(item ListItem) int {
+	if l == nil {
+		return 0
+	}
+
+	idx := 0
+	n := l.root
+	for n != nil {
+		if CompareListItems(l.codec, n.item, item) < 0 {
+			idx += int(n.left.getSize()) + 1
+			n = n.right
+			continue
+		}
+		n = n.left
+	}
+
+	return idx
+}
+
+// Apply upgrades the list using ListOperation objects (ApplyListOperations alternative).
+// List is partially upgraded on error (it has diverged from the server state and should be dropped).
+func (l *IndexedList) Apply(ops ...ListOperation) error {
+	for i, op := range ops {
+		switch op.Type {
+
+		case InsertOperationType:
+			if op.Index < 0 {
+				return fmt.Errorf("op[%d] (%s): index: must be GTE 0", i, op.Type)
+			}
+			if op.Index > l.Len() {
+				return fmt.Errorf("op[%d] (%s): index: must be LTE than list length", i, op.Type)
+			}
+			if _, found := l.ids[op.Id]; found {
+				return fmt.Errorf("op[%d] (%s): id: already exists", i, op.Type)
+			}
+
+			// Insert
+			item := ListItem{Id: op.Id, Value: op.Value}
+			if l.Search(item) != op.Index {
+				return fmt.Errorf("op[%d] (%s): index: breaks the sort order", i, op.Type)
+			}
+			l.insert(item)
+
+		case UpdateOperationType:
+			if op.Index < 0 {
+				return fmt.Errorf("op[%d] (%s): index: must be GTE 0", i, op.Type)
+			}
+			if op.Index >= l.Len() {
+				return fmt.Errorf("op[%d] (%s): index: must be LT than list length", i, op.Type)
+			}
+
+			if op.NewIndex < 0 {
+				return fmt.Errorf("op[%d] (%s): newIndex: must be GTE 0", i, op.Type)
+			}
+			if op.NewIndex >= l.Len() {
+				return fmt.Errorf("op[%d] (%s): newIndex: must be LT than list length", i, op.Type)
+			}
+
+			// Cut and insert
+			oldItem, _ := l.At(op.Index)
+			l.delete(oldItem)
+			item := ListItem{Id: oldItem.Id, Value: op.Value}
+			if l.Search(item) != op.NewIndex {
+				return fmt.Errorf("op[%d] (%s): newIndex: breaks the sort order", i, op.Type)
+			}
+			l.insert(item)
+
+		case DeleteOperationType:
+			if op.Index < 0 {
+				return fmt.Errorf("op[%d] (%s): index: must be GTE 0", i, op.Type)
+			}
+			if op.Index >= l.Len() {
+				return fmt.Errorf("op[%d] (%s): index: must be LT than list length", i, op.Type)
+			}
+
+			// Cut
+			item, _ := l.At(op.Index)
+			l.delete(item)
+
+		default:
+			return fmt.Errorf("op[%d] (%s): unknown type", i, op.Type)
+
+		}
+	}
+
+	return nil
+}
+
+// Ascend iterates over items in the list order until the handler returns false.
+func (l *IndexedList) Ascend(handler func(item ListItem) bool) {
+	if l == nil {
+		return
+	}
+
+	stack := make([]*indexedListNode, 0, int(l.root.getHeight())+1)
+	n := l.root
+	for n != nil || len(stack) > 0 {
+		for n != nil {
+			stack = append(stack, n)
+			n = n.left
+		}
+
+		n = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !handler(n.item) {
+			return
+		}
+		n = n.right
+	}
+}
+
+// Export returns the list as a StorageList.
+func (l *IndexedList) Export() StorageList {
+	list := make(StorageList, 0, l.Len())
+	l.Ascend(func(item ListItem) bool {
+		list = append(list, item)
+		return true
+	})
+
+	return list
+}
+
+// insert adds a new item to the tree and the ID index.
+func (l *IndexedList) insert(item ListItem) {
+	var insert func(n *indexedListNode) *indexedListNode
+	insert = func(n *indexedListNode) *indexedListNode {
+		if n == nil {
+			newNode := newIndexedListNode(item)
+			l.ids[item.Id] = newNode
+			return newNode
+		}
+
+		if CompareListItems(l.codec, item, n.item) < 0 {
+			n.left = insert(n.left)
+		} else {
+			n.right = insert(n.right)
+		}
+
+		return n.rebalance()
+	}
+
+	l.root = insert(l.root)
+}
+
+// delete removes an existing item from the tree and the ID index.
+func (l *IndexedList) delete(item ListItem) {
+	var remove func(n *indexedListNode) *indexedListNode
+	remove = func(n *indexedListNode) *indexedListNode {
+		if n == nil {
+			return nil
+		}
+
+		switch res := CompareListItems(l.codec, item, n.item); {
+		case res < 0:
+			n.left = remove(n.left)
+		case res > 0:
+			n.right = remove(n.right)
+		default:
+			if n.left == nil {
+				return n.right
+			}
+			if n.right == nil {
+				return n.left
+			}
+
+			var minNode *indexedListNode
+			n.right, minNode = n.right.cutMin()
+			minNode.left, minNode.right = n.left, n.right
+			n = minNode
+		}
+
+		return n.rebalance()
+	}
+
+	l.root = remove(l.root)
+	delete(l.ids, item.Id)
+}
+
+// NewIndexedList creates a new IndexedList object from the list sorted using the total sort order.
+func NewIndexedList(codec ValueCodec, list StorageList) (*IndexedList, error) {
+	if codec == nil {
+		return nil, fmt.Errorf("%s: nil", "codec")
+	}
+
+	l := &IndexedList{
+		codec: codec,
+		ids:   make(map[string]*indexedListNode, len(list)),
+	}
+
+	var build func(items StorageList) (*indexedListNode, error)
+	build = func(items StorageList) (*indexedListNode, error) {
+		if len(items) == 0 {
+			return nil, nil
+		}
+
+		mid := len(items) / 2
+		if !items.IsOrdered(codec, mid) {
+			return nil, fmt.Errorf("item (%s): breaks the sort order", items[mid].Id)
+		}
+
+		n := newIndexedListNode(items[mid])
+		l.ids[n.item.Id] = n
+
+		var err error
+		if n.left, err = build(items[:mid]); err != nil {
+			return nil, err
+		}
+		if n.right, err = build(items[mid+1:]); err != nil {
+			return nil, err
+		}
+		n.update()
+
+		return n, nil
+	}
+
+	root, err := build(list)
+	if err != nil {
+		return nil, err
+	}
+	l.root = root
+
+	return l, nil
+}
+
+// newIndexedListNode creates a new leaf node.
+func newIndexedListNode(item ListItem) *indexedListNode {
+	itemHash := NewListItemHash(item.Id, item.Value)
+
+	return &indexedListNode{
+		item:     item,
+		itemHash: itemHash,
+		hash:     itemHash,
+		size:     1,
+		height:   1,
+	}
+}
+
+// getSize returns the subtree size (nil-safe).
+func (n *indexedListNode) getSize() int32 {
+	if n == nil {
+		return 0
+	}
+
+	return n.size
+}
+
+// getHeight returns the subtree height (nil-safe).
+func (n *indexedListNode) getHeight() int8 {
+	if n == nil {
+		return 0
+	}
+
+	return n.height
+}
+
+// getHash returns the subtree hash (nil-safe).
+func (n *indexedListNode) getHash() ListHash {
+	if n == nil {
+		return EmptyListHash
+	}
+
+	return n.hash
+}
+
+// update recalculates the node size, height and hash using its children.
+func (n *indexedListNode) update() {
+	n.size = n.left.getSize() + n.right.getSize() + 1
+	n.hash = n.left.getHash().Concat(n.itemHash).Concat(n.right.getHash())
+
+	n.height = n.left.getHeight()
+	if rightHeight := n.right.getHeight(); rightHeight > n.height {
+		n.height = rightHeight
+	}
+	n.height++
+}
+
+// rebalance restores the AVL invariant for the node and returns a new subtree root.
+func (n *indexedListNode) rebalance() *indexedListNode {
+	n.update()
+
+	switch balance := n.left.getHeight() - n.right.getHeight(); {
+	case balance > 1:
+		if n.left.left.getHeight() < n.left.right.getHeight() {
+			n.left = n.left.rotateLeft()
+		}
+		return n.rotateRight()
+	case balance < -1:
+		if n.right.right.getHeight() < n.right.left.getHeight() {
+			n.right = n.right.rotateRight()
+		}
+		return n.rotateLeft()
+	}
+
+	return n
+}
+
+// rotateLeft performs the left subtree rotation.
+func (n *indexedListNode) rotateLeft() *indexedListNode {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	n.update()
+	r.update()
+
+	return r
+}
+
+// rotateRight performs the right subtree rotation.
+func (n *indexedListNode) rotateRight() *indexedListNode {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	n.update()
+	l.update()
+
+	return l
+}
+
+// cutMin removes the leftmost node from the subtree and returns a new subtree root alongside the removed node.
+func (n *indexedListNode) cutMin() (*indexedListNode, *indexedListNode) {
+	if n.left == nil {
+		return n.right, n
+	}
+
+	var minNode *indexedListNode
+	n.left, minNode = n.left.cutMin()
+
+	return n.rebalance(), minNode
+}
@@ -0,0 +1,166 @@
+package model_test
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+	"github.com/itiky/collaborate-storage/storage"
+)
+
+var testCodec = model.MustGetValueCodec(model.Int32ValueCodecName)
+
+// newTestIndexedList creates a new IndexedList object with items {a: 10, b: 20, c: 30}.
+func newTestIndexedList(t *testing.T) *model.IndexedList {
+	list, err := model.NewIndexedList(testCodec, model.StorageList{
+		{Id: "a", Value: model.NewInt32Value(10)},
+		{Id: "b", Value: model.NewInt32Value(20)},
+		{Id: "c", Value: model.NewInt32Value(30)},
+	})
+	require.NoError(t, err)
+
+	return list
+}
+
+// Test applies random storage diffs to IndexedList and StorageList (model.ApplyListOperations) and compares them.
+func Test_IndexedList_VsSlice(t *testing.T) {
+	st := storage.NewStorage(testCodec)
+	now := model.HLCFromTime(time.Now())
+
+	var refList model.StorageList
+	list, err := model.NewIndexedList(testCodec, nil)
+	require.NoError(t, err)
+
+	// Small values range to get a lot of equal values
+	newValue := func() model.StorageValue {
+		return model.NewInt32Value(int32(rand.Intn(10)))
+	}
+
+	for batch := 0; batch < 200; batch++ {
+		ops := make([]storage.StorageOperation, 0)
+		for n := 0; n < 10; n++ {
+			var op storage.StorageOperation
+			if len(refList) == 0 || rand.Intn(3) == 0 {
+				op, err = storage.NewSetOperation(uuid.New().String(), newValue(), 0, now)
+			} else if rand.Intn(2) == 0 {
+				op, err = storage.NewSetOperation(refList[rand.Intn(len(refList))].Id, newValue(), 0, now)
+			} else {
+				op, err = storage.NewDeleteOperation(refList[rand.Intn(len(refList))].Id, 0, now)
+			}
+			require.NoError(t, err)
+			ops = append(ops, op)
+		}
+
+		listOps := st.ApplyOperations(ops...)
+		refList, err = model.ApplyListOperations(testCodec, refList, listOps...)
+		require.NoError(t, err)
+		require.NoError(t, list.Apply(listOps...), "batch[%d]", batch)
+		require.Equal(t, len(refList), list.Len(), "batch[%d]: length", batch)
+		require.Equal(t, refList.Checksum(), list.Checksum(), "batch[%d]: checksum", batch)
+		require.Equal(t, refList.Checksum(), st.Checksum(), "batch[%d]: storage checksum", batch)
+	}
+
+	require.Equal(t, refList, list.Export())
+	for i, refItem := range refList {
+		item, idx, found := list.Get(refItem.Id)
+		require.True(t, found, "item[%d]: Get", i)
+		require.Equal(t, i, idx, "item[%d]: Get index", i)
+		require.Equal(t, refItem, item, "item[%d]: Get item", i)
+
+		item, found = list.At(i)
+		require.True(t, found, "item[%d]: At", i)
+		require.Equal(t, refItem, item, "item[%d]: At item", i)
+	}
+}
+
+// Test rejects invalid operations (the list is not changed by the ones failing the index / ID checks).
+func Test_IndexedList_ApplyErrors(t *testing.T) {
+	type testCase struct {
+		name string
+		op   model.ListOperation
+		// List is not changed on error
+		unchanged bool
+	}
+	newValue := model.NewInt32Value(25)
+	testCases := []testCase{
+		{name: "insert: negative index", op: model.ListOperation{Type: model.InsertOperationType, Id: "d", Index: -1, Value: newValue}, unchanged: true},
+		{name: "insert: index out of range", op: model.ListOperation{Type: model.InsertOperationType, Id: "d", Index: 4, Value: newValue}, unchanged: true},
+		{name: "insert: existing ID", op: model.ListOperation{Type: model.InsertOperationType, Id: "b", Index: 2, Value: newValue}, unchanged: true},
+		{name: "insert: breaks the sort order", op: model.ListOperation{Type: model.InsertOperationType, Id: "d", Index: 0, Value: newValue}, unchanged: true},
+		{name: "update: negative index", op: model.ListOperation{Type: model.UpdateOperationType, Index: -1, NewIndex: 0, Value: newValue}, unchanged: true},
+		{name: "update: index out of range", op: model.ListOperation{Type: model.UpdateOperationType, Index: 3, NewIndex: 0, Value: newValue}, unchanged: true},
+		{name: "update: negative newIndex", op: model.ListOperation{Type: model.UpdateOperationType, Index: 0, NewIndex: -1, Value: newValue}, unchanged: true},
+		{name: "update: newIndex out of range", op: model.ListOperation{Type: model.UpdateOperationType, Index: 0, NewIndex: 3, Value: newValue}, unchanged: true},
+		{name: "update: breaks the sort order", op: model.ListOperation{Type: model.UpdateOperationType, Index: 0, NewIndex: 0, Value: newValue}},
+		{name: "delete: negative index", op: model.ListOperation{Type: model.DeleteOperationType, Index: -1}, unchanged: true},
+		{name: "delete: index out of range", op: model.ListOperation{Type: model.DeleteOperationType, Index: 3}, unchanged: true},
+		{name: "unknown type", op: model.ListOperation{Type: "move", Index: 0}, unchanged: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			list := newTestIndexedList(t)
+			listBefore, checksumBefore := list.Export(), list.Checksum()
+
+			require.Error(t, list.Apply(tc.op))
+			if tc.unchanged {
+				require.Equal(t, listBefore, list.Export())
+				require.Equal(t, checksumBefore, list.Checksum())
+			}
+		})
+	}
+
+	// Operations before the failed one are applied
+	list := newTestIndexedList(t)
+	err := list.Apply(
+		model.ListOperation{Type: model.DeleteOperationType, Index: 0},
+		model.ListOperation{Type: model.DeleteOperationType, Index: 2},
+	)
+	require.Error(t, err)
+	require.Equal(t, 2, list.Len())
+}
+
+// Test looks up items by missing IDs and positions.
+func Test_IndexedList_Missing(t *testing.T) {
+	list := newTestIndexedList(t)
+
+	item, idx, found := list.Get("d")
+	require.False(t, found)
+	require.Equal(t, -1, idx)
+	require.Equal(t, model.ListItem{}, item)
+
+	// Deleted item
+	require.NoError(t, list.Apply(model.ListOperation{Type: model.DeleteOperationType, Index: 1}))
+	_, idx, found = list.Get("b")
+	require.False(t, found)
+	require.Equal(t, -1, idx)
+
+	_, found = list.At(-1)
+	require.False(t, found)
+	_, found = list.At(list.Len())
+	require.False(t, found)
+
+	// Nil list is empty
+	var nilList *model.IndexedList
+	_, idx, found = nilList.Get("a")
+	require.False(t, found)
+	require.Equal(t, -1, idx)
+	require.Equal(t, 0, nilList.Len())
+	require.Equal(t, model.StorageList{}.Checksum(), nilList.Checksum())
+}
+
+// Test rejects invalid constructor inputs.
+func Test_IndexedList_New(t *testing.T) {
+	_, err := model.NewIndexedList(nil, nil)
+	require.Error(t, err)
+
+	_, err = model.NewIndexedList(testCodec, model.StorageList{
+		{Id: "a", Value: model.NewInt32Value(20)},
+		{Id: "b", Value: model.NewInt32Value(10)},
+	})
+	require.Error(t, err)
+}
@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 // Get the latest list snapshot RPC request.
 type (
 	GetListSnapshotRequest struct {
@@ -10,6 +12,31 @@ type (
 	GetListSnapshotResponse struct {
 		// Snapshot version
 		Version int
+		// ValueCodec name used to compare values
+		ValueCodec string
+		// Snapshot data
+		Data StorageList
+		// Snapshot data checksum (StorageList.Checksum, 0 - unknown)
+		Checksum uint64
+		// The highest UpdateListRequest.Sequence applied for the client
+		ClientSequence uint64
+		// Server clock (to be merged into the client one)
+		Clock HLC
+	}
+)
+
+// Get the list snapshot of a previous version RPC request (admin).
+type (
+	GetListAtVersionRequest struct {
+		// Snapshot version
+		Version int
+	}
+
+	GetListAtVersionResponse struct {
+		// Snapshot version
+		Version int
+		// ValueCodec name used to compare values
+		ValueCodec string
 		// Snapshot data
 		Data StorageList
 	}
@@ -22,6 +49,9 @@ type (
 		ClientId ClientId
 		// Client snapshot version
 		Version int
+		// Request sequence number (per client, monotonically increasing, 0 - not tracked).
+		// Request with a sequence number not greater than the highest applied one is a duplicate (dropped).
+		Sequence uint64
 		// Update operations
 		Operations []OperationRequest
 	}
@@ -30,9 +60,26 @@ type (
 		Type  OperationType
 		Id    string
 		Value StorageValue
+		// Client HLC timestamp the operation was made at (operations are ordered by it, zero - stamped by the server)
+		Timestamp HLC
 	}
 
-	UpdateListResponse struct{}
+	UpdateListResponse struct {
+		// Version that includes the operations (committed)
+		Version int
+		// Per-operation results (UpdateListRequest.Operations order)
+		Results []OperationResult
+		// Request was already applied (Version and Results are the original ones if known, Results are empty otherwise)
+		Duplicate bool
+		// Server clock (to be merged into the client one)
+		Clock HLC
+	}
+
+	OperationResult struct {
+		Status OperationStatus
+		// Rejection reason (RejectedOperationStatus only)
+		ErrorCode OperationErrorCode
+	}
 )
 
 // Get snapshot update operation to bump local snapshot version.
@@ -40,6 +87,8 @@ type (
 	GetListUpdatesRequest struct {
 		// Local snapshot version
 		Version int
+		// If Version is the latest one, wait for a new version up to the timeout (long polling, 0 - no wait)
+		WaitTimeout time.Duration
 	}
 
 	GetListUpdatesResponse struct {
@@ -47,5 +96,82 @@ type (
 		Version int
 		// Operations to apply in order to upgrade GetListUpdatesRequest.Version tot Version
 		Operations []ListOperation
+		// Version snapshot checksum to verify the upgraded one (StorageList.Checksum, 0 - unknown)
+		Checksum uint64
+		// GetListUpdatesRequest.Version is not served anymore (history was rewritten), the latest snapshot must be requested
+		ResyncRequired bool
+		// GetListUpdatesRequest.Version is older than the history retention window, the latest snapshot must be requested
+		SnapshotRequired bool
+		// Server clock (to be merged into the client one)
+		Clock HLC
+	}
+)
+
+// Subscribe to the list updates push stream request.
+// Stream is a long-lived TCP connection: client sends SubscribeRequest, server sends ListUpdateEvent objects (GOB encoded).
+type (
+	SubscribeRequest struct {
+		// ClientID
+		ClientId ClientId
+		// Local snapshot version (the first event upgrades it to the latest one)
+		Version int
+	}
+
+	ListUpdateEvent struct {
+		// Snapshot version operations are applied to
+		FromVersion int
+		// Snapshot version
+		Version int
+		// Operations to apply in order to upgrade FromVersion to Version
+		Operations []ListOperation
+		// Version snapshot checksum to verify the upgraded one (StorageList.Checksum, 0 - unknown)
+		Checksum uint64
+		// Events were dropped (slow consumer), updates must be requested using the GetListUpdates RPC
+		ResyncRequired bool
+		// Server clock (to be merged into the client one)
+		Clock HLC
+	}
+)
+
+// Squash document versions RPC request (admin).
+type (
+	SquashVersionsRequest struct {
+		// The first version to squash
+		FromVersion int
+		// The last version to squash (squashed version gets this number)
+		ToVersion int
+	}
+
+	SquashVersionsResponse struct {
+		// The latest snapshot version
+		LatestVersion int
+	}
+)
+
+// Remove document version RPC request (admin).
+type (
+	RemoveVersionRequest struct {
+		// Version to remove (the later versions get new numbers)
+		Version int
+	}
+
+	RemoveVersionResponse struct {
+		// The latest snapshot version
+		LatestVersion int
+	}
+)
+
+// Replace document version operations RPC request (admin).
+type (
+	ReplaceVersionRequest struct {
+		// Version to replace (the later versions get new numbers)
+		Version int
+		// New version operations (unstamped ones get the server timestamp)
+		Operations []OperationRequest
+	}
+
+	ReplaceVersionResponse struct {
+		// The latest snapshot version
+		LatestVersion int
 	}
 )
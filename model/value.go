@@ -0,0 +1,264 @@
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	Int32ValueCodecName    = "int32"
+	BytesValueCodecName    = "bytes"
+	Record64ValueCodecName = "record64"
+
+	DefaultValueCodecName = Int32ValueCodecName
+)
+
+type (
+	// ValueCodec defines StorageValue payload format and its sort order.
+	ValueCodec interface {
+		// Unique codec name (persisted within storage files and sent to clients)
+		Name() string
+		// Compare returns -1 if a is LT b, 1 if a is GT b and 0 if they are equal
+		Compare(a, b StorageValue) int
+		// Validate checks the payload format
+		Validate(v StorageValue) error
+		// Format returns a human readable value representation
+		Format(v StorageValue) string
+		// Random generates a random value (used by mock data generator and client load generator)
+		Random() StorageValue
+	}
+
+	// Int32ValueCodec implements ValueCodec interface for 32-bit signed integers.
+	// Value is encoded as big-endian with the sign bit flipped, so the bytes order matches the numbers order.
+	Int32ValueCodec struct{}
+
+	// BytesValueCodec implements ValueCodec interface for opaque byte strings sorted lexicographically.
+	BytesValueCodec struct {
+		// Random value length range
+		RandomMinLen int
+		RandomMaxLen int
+	}
+
+	// RecordValueCodec implements ValueCodec interface for fixed size records sorted by the key part.
+	RecordValueCodec struct {
+		name      string
+		size      int
+		keyOffset int
+		keyLen    int
+	}
+)
+
+var valueCodecs = struct {
+	sync.RWMutex
+	codecs map[string]ValueCodec
+}{
+	codecs: make(map[string]ValueCodec),
+}
+
+// RegisterValueCodec registers a new ValueCodec making it available by name.
+// Panics on duplicate.
+func RegisterValueCodec(codec ValueCodec) {
+	valueCodecs.Lock()
+	defer valueCodecs.Unlock()
+
+	if _, found := valueCodecs.codecs[codec.Name()]; found {
+		panic(fmt.Errorf("value codec (%s): already registered", codec.Name()))
+	}
+	valueCodecs.codecs[codec.Name()] = codec
+}
+
+// GetValueCodec returns a registered ValueCodec by name.
+func GetValueCodec(name string) (ValueCodec, error) {
+	valueCodecs.RLock()
+	defer valueCodecs.RUnlock()
+
+	codec, found := valueCodecs.codecs[name]
+	if !found {
+		return nil, fmt.Errorf("value codec (%s): not registered", name)
+	}
+
+	return codec, nil
+}
+
+// GetValueCodecNames returns all registered ValueCodec names.
+func GetValueCodecNames() []string {
+	valueCodecs.RLock()
+	defer valueCodecs.RUnlock()
+
+	names := make([]string, 0, len(valueCodecs.codecs))
+	for name := range valueCodecs.codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// MustGetValueCodec returns a registered ValueCodec by name.
+// Panics on failure.
+func MustGetValueCodec(name string) ValueCodec {
+	codec, err := GetValueCodec(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return codec
+}
+
+// NewInt32Value creates a new StorageValue for Int32ValueCodec.
+func NewInt32Value(v int32) StorageValue {
+	value := make(StorageValue, 4)
+	binary.BigEndian.PutUint32(value, uint32(v)^(1<<31))
+
+	return value
+}
+
+// Int32Value decodes Int32ValueCodec StorageValue.
+func Int32Value(v StorageValue) int32 {
+	return int32(binary.BigEndian.Uint32(v) ^ (1 << 31))
+}
+
+// Name implements ValueCodec interface.
+func (c Int32ValueCodec) Name() string {
+	return Int32ValueCodecName
+}
+
+// Compare implements ValueCodec interface.
+func (c Int32ValueCodec) Compare(a, b StorageValue) int {
+	return bytes.Compare(a, b)
+}
+
+// Validate implements ValueCodec interface.
+func (c Int32ValueCodec) Validate(v StorageValue) error {
+	if len(v) != 4 {
+		return fmt.Errorf("length: must be 4 bytes")
+	}
+
+	return nil
+}
+
+// Format implements ValueCodec interface.
+func (c Int32ValueCodec) Format(v StorageValue) string {
+	if c.Validate(v) != nil {
+		return "invalid(" + hex.EncodeToString(v) + ")"
+	}
+
+	return strconv.FormatInt(int64(Int32Value(v)), 10)
+}
+
+// Random implements ValueCodec interface.
+func (c Int32ValueCodec) Random() StorageValue {
+	return NewInt32Value(rand.Int31())
+}
+
+// Name implements ValueCodec interface.
+func (c BytesValueCodec) Name() string {
+	return BytesValueCodecName
+}
+
+// Compare implements ValueCodec interface.
+func (c BytesValueCodec) Compare(a, b StorageValue) int {
+	return bytes.Compare(a, b)
+}
+
+// Validate implements ValueCodec interface.
+func (c BytesValueCodec) Validate(v StorageValue) error {
+	return nil
+}
+
+// Format implements ValueCodec interface.
+func (c BytesValueCodec) Format(v StorageValue) string {
+	return hex.EncodeToString(v)
+}
+
+// Random implements ValueCodec interface.
+func (c BytesValueCodec) Random() StorageValue {
+	return randomBytes(c.RandomMinLen + rand.Intn(c.RandomMaxLen-c.RandomMinLen+1))
+}
+
+// NewRecordValueCodec creates a new RecordValueCodec object.
+// Records are sorted by the [keyOffset:keyOffset+keyLen] bytes.
+func NewRecordValueCodec(name string, size, keyOffset, keyLen int) (RecordValueCodec, error) {
+	if name == "" {
+		return RecordValueCodec{}, fmt.Errorf("%s: empty", "name")
+	}
+	if size <= 0 {
+		return RecordValueCodec{}, fmt.Errorf("%s: must be GT 0", "size")
+	}
+	if keyOffset < 0 {
+		return RecordValueCodec{}, fmt.Errorf("%s: must be GTE 0", "keyOffset")
+	}
+	if keyLen <= 0 || keyOffset+keyLen > size {
+		return RecordValueCodec{}, fmt.Errorf("%s: must be GT 0 and fit the record size", "keyLen")
+	}
+
+	return RecordValueCodec{
+		name:      name,
+		size:      size,
+		keyOffset: keyOffset,
+		keyLen:    keyLen,
+	}, nil
+}
+
+// Name implements ValueCodec interface.
+func (c RecordValueCodec) Name() string {
+	return c.name
+}
+
+// Compare implements ValueCodec interface.
+func (c RecordValueCodec) Compare(a, b StorageValue) int {
+	return bytes.Compare(c.Key(a), c.Key(b))
+}
+
+// Validate implements ValueCodec interface.
+func (c RecordValueCodec) Validate(v StorageValue) error {
+	if len(v) != c.size {
+		return fmt.Errorf("length: must be %d bytes", c.size)
+	}
+
+	return nil
+}
+
+// Format implements ValueCodec interface.
+func (c RecordValueCodec) Format(v StorageValue) string {
+	return hex.EncodeToString(c.Key(v)) + ":" + hex.EncodeToString(v)
+}
+
+// Random implements ValueCodec interface.
+func (c RecordValueCodec) Random() StorageValue {
+	return randomBytes(c.size)
+}
+
+// Key returns the record key part.
+func (c RecordValueCodec) Key(v StorageValue) []byte {
+	if len(v) < c.keyOffset+c.keyLen {
+		return v
+	}
+
+	return v[c.keyOffset : c.keyOffset+c.keyLen]
+}
+
+// randomBytes generates a random byte slice.
+func randomBytes(n int) StorageValue {
+	value := make(StorageValue, n)
+	rand.Read(value)
+
+	return value
+}
+
+func init() {
+	RegisterValueCodec(Int32ValueCodec{})
+	RegisterValueCodec(BytesValueCodec{RandomMinLen: 16, RandomMaxLen: 64})
+
+	record64Codec, err := NewRecordValueCodec(Record64ValueCodecName, 64, 0, 8)
+	if err != nil {
+		panic(err)
+	}
+	RegisterValueCodec(record64Codec)
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// ErrNoSnapshot is returned by the list update methods until the first snapshot is received (value codec is unknown).
+var ErrNoSnapshot = errors.New("snapshot is not received yet")
+
+type (
+	// ChangeEvent describes a local snapshot change.
+	ChangeEvent struct {
+		// Previous snapshot version
+		FromVersion int
+		// Current snapshot version
+		Version int
+		// Operations applied to the local snapshot in order (empty if Reset is set).
+		// Snapshot includes the client operations not confirmed by the server yet (tentative),
+		// they are rolled back and replayed on top of a server update (FromVersion and Version are equal for a local change).
+		Operations []model.ListOperation
+		// Snapshot was replaced (initial download / resync): the list should be reread
+		Reset bool
+		// Server acks of the client operations (FromVersion and Version are equal)
+		Acks []OperationAck
+	}
+
+	// OperationAck is the server ack of a client operation.
+	OperationAck struct {
+		Operation model.OperationRequest
+		// Operation result (status is empty if the result is unknown: a duplicate of a request handled long ago)
+		Result model.OperationResult
+		// Committed version: an applied operation is visible starting from it (the outcome of an unknown one is visible within it)
+		Version int
+	}
+
+	// ChangeHandler is a local snapshot change callback.
+	// Events are delivered in order by a single goroutine: handler must not block, but might call the client API methods.
+	ChangeHandler func(event ChangeEvent)
+)
+
+// Insert applies a new item insert operation to the local snapshot and queues it (sent with the next request).
+// Returns the new item ID.
+func (c *Client) Insert(value model.StorageValue) (string, error) {
+	if err := c.validateValue(value); err != nil {
+		return "", err
+	}
+
+	id := uuid.New().String()
+	err := c.queueOperation(model.OperationRequest{
+		Type:  model.InsertOperationType,
+		Id:    id,
+		Value: value,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Update applies an item update operation to the local snapshot and queues it (sent with the next request).
+func (c *Client) Update(id string, value model.StorageValue) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("%s: invalid: %w", "id", err)
+	}
+	if err := c.validateValue(value); err != nil {
+		return err
+	}
+
+	return c.queueOperation(model.OperationRequest{
+		Type:  model.UpdateOperationType,
+		Id:    id,
+		Value: value,
+	})
+}
+
+// Delete applies an item delete operation to the local snapshot and queues it (sent with the next request).
+func (c *Client) Delete(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("%s: invalid: %w", "id", err)
+	}
+
+	return c.queueOperation(model.OperationRequest{
+		Type: model.DeleteOperationType,
+		Id:   id,
+	})
+}
+
+// Get returns the local snapshot item by ID.
+func (c *Client) Get(id string) (model.ListItem, bool) {
+	c.snapshotLock.RLock()
+	defer c.snapshotLock.RUnlock()
+
+	item, _, found := c.snapshotData.Get(id)
+
+	return item, found
+}
+
+// At returns the local snapshot item by its position within the list sort order.
+func (c *Client) At(index int) (model.ListItem, bool) {
+	c.snapshotLock.RLock()
+	defer c.snapshotLock.RUnlock()
+
+	return c.snapshotData.At(index)
+}
+
+// Len returns the local snapshot length.
+func (c *Client) Len() int {
+	c.snapshotLock.RLock()
+	defer c.snapshotLock.RUnlock()
+
+	return c.snapshotData.Len()
+}
+
+// Version returns the local snapshot server version (tentative operations are not counted).
+func (c *Client) Version() int {
+	c.snapshotLock.RLock()
+	defer c.snapshotLock.RUnlock()
+
+	return c.snapshotVersion
+}
+
+// ValueCodec returns the snapshot values codec (nil until the first snapshot is received).
+func (c *Client) ValueCodec() model.ValueCodec {
+	c.snapshotLock.RLock()
+	defer c.snapshotLock.RUnlock()
+
+	return c.valueCodec
+}
+
+// Subscribe registers the local snapshot change handler.
+// Returns the function to unregister it.
+func (c *Client) Subscribe(handler ChangeHandler) func() {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	c.handlerSeq++
+	handlerId := c.handlerSeq
+	c.handlers[handlerId] = handler
+
+	return func() {
+		c.handlersLock.Lock()
+		defer c.handlersLock.Unlock()
+
+		delete(c.handlers, handlerId)
+	}
+}
+
+// validateValue checks the value using the snapshot codec.
+func (c *Client) validateValue(value model.StorageValue) error {
+	codec := c.ValueCodec()
+	if codec == nil {
+		return ErrNoSnapshot
+	}
+	if err := codec.Validate(value); err != nil {
+		return fmt.Errorf("%s: %w", "value", err)
+	}
+
+	return nil
+}
+
+// queueOperation stamps the operation, applies it to the local snapshot as a tentative one and adds it to the pending ones.
+func (c *Client) queueOperation(op model.OperationRequest) error {
+	c.snapshotLock.Lock()
+	defer c.snapshotLock.Unlock()
+	if c.valueCodec == nil {
+		return ErrNoSnapshot
+	}
+
+	op.Timestamp = c.clock.Now()
+	listOps, err := c.addTentative(op)
+	if err != nil {
+		return fmt.Errorf("applying tentative operation: %w", err)
+	}
+
+	c.pendingLock.Lock()
+	c.pendingOps = append(c.pendingOps, op)
+	c.pendingLock.Unlock()
+
+	if len(listOps) > 0 {
+		c.notifyHandlers(ChangeEvent{FromVersion: c.snapshotVersion, Version: c.snapshotVersion, Operations: listOps})
+	}
+
+	return nil
+}
+
+// takePendingOperations returns the pending operations clearing the queue.
+func (c *Client) takePendingOperations() []model.OperationRequest {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	ops := c.pendingOps
+	c.pendingOps = nil
+
+	return ops
+}
+
+// notifyHandlers queues the change event for the registered handlers.
+// Must be called with snapshotLock held (events are queued in the snapshot changes order).
+func (c *Client) notifyHandlers(event ChangeEvent) {
+	c.handlersLock.Lock()
+	defer c.handlersLock.Unlock()
+
+	if len(c.handlers) == 0 {
+		return
+	}
+	c.changeEvents = append(c.changeEvents, event)
+
+	select {
+	case c.changeSignalCh <- struct{}{}:
+	default:
+	}
+}
+
+// dispatcher delivers the queued change events to the registered handlers.
+func (c *Client) dispatcher() {
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-c.changeSignalCh:
+		}
+
+		c.handlersLock.Lock()
+		events := c.changeEvents
+		c.changeEvents = nil
+		handlers := make([]ChangeHandler, 0, len(c.handlers))
+		for _, handler := range c.handlers {
+			handlers = append(handlers, handler)
+		}
+		c.handlersLock.Unlock()
+
+		for _, event := range events {
+			for _, handler := range handlers {
+				handler(event)
+			}
+		}
+	}
+}
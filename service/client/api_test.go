@@ -0,0 +1,181 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// Test rejects list updates until the first snapshot is received.
+func Test_Client_NoSnapshot(t *testing.T) {
+	c := newTestClient(t, "127.0.0.1:1")
+
+	_, err := c.Insert(testCodec.Random())
+	require.ErrorIs(t, err, ErrNoSnapshot)
+	require.ErrorIs(t, c.Update(uuid.New().String(), testCodec.Random()), ErrNoSnapshot)
+	require.ErrorIs(t, c.Delete(uuid.New().String()), ErrNoSnapshot)
+
+	require.Nil(t, c.ValueCodec())
+	require.Equal(t, 0, c.Len())
+	_, found := c.At(0)
+	require.False(t, found)
+	require.NoError(t, c.outbox.close())
+}
+
+// Test applies the list updates to the local snapshot right away and syncs them with the server.
+func Test_Client_API(t *testing.T) {
+	svc, serverUrl := newTestServer(t)
+	c := newTestClient(t, serverUrl)
+	c.Start()
+	defer c.Stop()
+	waitForSnapshot(t, c)
+
+	_, serverList := getServerList(t, svc)
+	require.Equal(t, serverList, exportSnapshot(c))
+	require.Equal(t, len(serverList), c.Len())
+	for i, serverItem := range serverList {
+		item, found := c.At(i)
+		require.True(t, found)
+		require.Equal(t, serverItem, item)
+	}
+	_, found := c.At(len(serverList))
+	require.False(t, found)
+
+	// Insert
+	value := testCodec.Random()
+	id, err := c.Insert(value)
+	require.NoError(t, err)
+	item, found := c.Get(id)
+	require.True(t, found)
+	require.Equal(t, value, item.Value)
+	require.Equal(t, len(serverList)+1, c.Len())
+
+	// Update (the item is moved within the sort order)
+	value = testCodec.Random()
+	require.NoError(t, c.Update(id, value))
+	item, found = c.Get(id)
+	require.True(t, found)
+	require.Equal(t, value, item.Value)
+	list := exportSnapshot(c)
+	for i := range list {
+		require.True(t, list.IsOrdered(testCodec, i))
+	}
+
+	// Delete of an existing one and an update of a missing one (no local effect)
+	deletedItem, found := c.At(0)
+	require.True(t, found)
+	require.NoError(t, c.Delete(deletedItem.Id))
+	_, found = c.Get(deletedItem.Id)
+	require.False(t, found)
+	require.NoError(t, c.Update(uuid.New().String(), testCodec.Random()))
+	require.Equal(t, len(serverList), c.Len())
+
+	// Invalid input
+	require.Error(t, c.Update("abc", testCodec.Random()))
+	require.Error(t, c.Delete("abc"))
+	_, err = c.Insert(model.StorageValue{1})
+	require.Error(t, err)
+
+	// Server gets the same list
+	expected := exportSnapshot(c)
+	require.Eventually(t, func() bool {
+		version, serverList := getServerList(t, svc)
+		return c.Version() == version && len(c.tentativeOpsCopy()) == 0 && serverList.Checksum() == expected.Checksum()
+	}, testWaitTimeout, 10*time.Millisecond)
+	require.Equal(t, expected, exportSnapshot(c))
+}
+
+// Test delivers the change events to the subscribed handlers in order (handlers might call the client API).
+func Test_Client_Subscribe(t *testing.T) {
+	svc, serverUrl := newTestServer(t)
+	c := newTestClient(t, serverUrl)
+
+	var eventsLock sync.Mutex
+	events := make([]ChangeEvent, 0)
+	unsubscribe := c.Subscribe(func(event ChangeEvent) {
+		// Handler is not blocked by the snapshot lock
+		c.Len()
+
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+		events = append(events, event)
+	})
+	otherEventsCnt := 0
+	unsubscribeOther := c.Subscribe(func(event ChangeEvent) {
+		otherEventsCnt++
+	})
+	unsubscribeOther()
+
+	getEvents := func() []ChangeEvent {
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+		return append([]ChangeEvent(nil), events...)
+	}
+
+	c.Start()
+	defer c.Stop()
+	waitForSnapshot(t, c)
+
+	// Initial snapshot
+	require.Eventually(t, func() bool {
+		return len(getEvents()) == 1
+	}, testWaitTimeout, 10*time.Millisecond)
+	initVersion, _ := getServerList(t, svc)
+	require.Equal(t, ChangeEvent{FromVersion: 0, Version: initVersion, Reset: true}, getEvents()[0])
+
+	// Local change followed by the server ack and the snapshot update
+	value := testCodec.Random()
+	id, err := c.Insert(value)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		events := getEvents()
+		return events[len(events)-1].Version > initVersion
+	}, testWaitTimeout, 10*time.Millisecond)
+
+	events = getEvents()
+	require.GreaterOrEqual(t, len(events), 4)
+	require.Equal(t, initVersion, events[1].FromVersion)
+	require.Equal(t, initVersion, events[1].Version)
+	require.Len(t, events[1].Operations, 1)
+	require.Equal(t, model.InsertOperationType, events[1].Operations[0].Type)
+	require.Equal(t, id, events[1].Operations[0].Id)
+
+	var ack OperationAck
+	for _, event := range events[2:] {
+		if len(event.Acks) > 0 {
+			ack = event.Acks[0]
+			break
+		}
+	}
+	require.Equal(t, id, ack.Operation.Id)
+	require.Equal(t, model.AppliedOperationStatus, ack.Result.Status)
+	require.Greater(t, ack.Version, initVersion)
+
+	lastEvent := events[len(events)-1]
+	require.Equal(t, ack.Version, lastEvent.Version)
+	require.False(t, lastEvent.Reset)
+	item, found := c.Get(id)
+	require.True(t, found)
+	require.Equal(t, value, item.Value)
+
+	// Events are ordered
+	for i := 1; i < len(events); i++ {
+		require.Equal(t, events[i-1].Version, events[i].FromVersion, "event %d", i)
+	}
+	require.Equal(t, 0, otherEventsCnt)
+
+	// No events after unsubscribe
+	unsubscribe()
+	eventsCnt := len(getEvents())
+	_, err = c.Insert(testCodec.Random())
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(c.tentativeOpsCopy()) == 0
+	}, testWaitTimeout, 10*time.Millisecond)
+	require.Len(t, getEvents(), eventsCnt)
+}
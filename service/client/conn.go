@@ -0,0 +1,95 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+const (
+	// Server connection dial timeout
+	dialTimeout = 5 * time.Second
+	// TCP keep-alive period (detects a dead server connection while waiting for a long poll / push event)
+	dialKeepAlive = 15 * time.Second
+	// RPC call timeouts (a call not finished within it is considered lost with the connection)
+	callTimeout         = 30 * time.Second
+	snapshotCallTimeout = 5 * time.Minute
+	// Reconnect backoff limits
+	reconnectBackoffMin = 500 * time.Millisecond
+	reconnectBackoffMax = 30 * time.Second
+)
+
+// errCallTimeout is returned by a RPC call not finished within the timeout.
+var errCallTimeout = errors.New("rpc call timeout")
+
+// dial connects to the server endpoint.
+func dial(url string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: dialKeepAlive,
+	}
+
+	conn, err := dialer.Dial("tcp", url)
+	if err != nil {
+		return nil, fmt.Errorf("dial (%s): %w", url, err)
+	}
+
+	return conn, nil
+}
+
+// dialRPC connects to the RPC server.
+func dialRPC(url string) (*rpc.Client, error) {
+	conn, err := dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return rpc.NewClient(conn), nil
+}
+
+// call invokes the RPC method waiting for the result up to the timeout.
+func (c *Client) call(serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+	call := c.rpcClient.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return fmt.Errorf("%s: %w", serviceMethod, errCallTimeout)
+	}
+}
+
+// scheduleReconnect schedules the next reconnect attempt using the jittered exponential backoff.
+// Jitter spreads reconnects of clients disconnected at once (server restart).
+func (c *Client) scheduleReconnect() time.Duration {
+	c.reconnectBackoff *= 2
+	if c.reconnectBackoff < reconnectBackoffMin {
+		c.reconnectBackoff = reconnectBackoffMin
+	}
+	if c.reconnectBackoff > reconnectBackoffMax {
+		c.reconnectBackoff = reconnectBackoffMax
+	}
+
+	delay := c.reconnectBackoff/2 + time.Duration(rand.Int63n(int64(c.reconnectBackoff/2)+1))
+	c.reconnectCh = time.After(delay)
+
+	return delay
+}
+
+// isConnectionError checks if the error is caused by a broken server connection.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, rpc.ErrShutdown) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errCallTimeout) ||
+		errors.As(err, &netErr)
+}
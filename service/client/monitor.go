@@ -13,20 +13,18 @@ var monitor *Monitor
 // Monitor keeps Client stats.
 type Monitor struct {
 	sync.Mutex
-	updReqDur        *movingaverage.MovingAverage
-	diffReqDur       *movingaverage.MovingAverage
-	consistencyDur   *movingaverage.MovingAverage
-	updReqSend       int
-	diffReqSend      int
-	consistencyReset time.Time
-	stopCh           chan struct{}
+	updReqDur   *movingaverage.MovingAverage
+	diffReqDur  *movingaverage.MovingAverage
+	updReqSend  int
+	diffReqSend int
+	stopCh      chan struct{}
 }
 
-func (m *Monitor) UpdatesSend(count int, dur time.Duration) {
+func (m *Monitor) UpdatesSend(dur time.Duration) {
 	m.Lock()
 	defer m.Unlock()
 
-	m.updReqSend += count
+	m.updReqSend++
 	m.updReqDur.Add(float64(dur/time.Microsecond) / 1000.0)
 }
 
@@ -38,21 +36,6 @@ func (m *Monitor) UpdatesReceived(count int, dur time.Duration) {
 	m.diffReqDur.Add(float64(dur/time.Microsecond) / 1000.0)
 }
 
-func (m *Monitor) ConsistencyReset(ts time.Time) {
-	m.Lock()
-	defer m.Unlock()
-
-	m.consistencyReset = ts
-}
-
-func (m *Monitor) ConsistencyAchieved(ts time.Time) {
-	m.Lock()
-	defer m.Unlock()
-
-	dur := ts.Sub(m.consistencyReset)
-	m.consistencyDur.Add(float64(dur/time.Microsecond) / 1000.0)
-}
-
 // Start starts the Monitor worker.
 func (m *Monitor) Start() {
 	if m.stopCh != nil {
@@ -60,7 +43,7 @@ func (m *Monitor) Start() {
 	}
 
 	m.stopCh = make(chan struct{})
-	go m.worker()
+	go m.worker(m.stopCh)
 }
 
 // Stop stops the Monitor worker.
@@ -70,16 +53,17 @@ func (m *Monitor) Stop() {
 	}
 
 	close(m.stopCh)
+	m.stopCh = nil
 }
 
-// worker does the actual job.
-func (m *Monitor) worker() {
+// worker does the actual job (until stopCh is closed).
+func (m *Monitor) worker(stopCh <-chan struct{}) {
 	const period = 5 * time.Second
 
 	tickCh := time.Tick(period)
 	for {
 		select {
-		case <-m.stopCh:
+		case <-stopCh:
 			// Stop the monitor
 			return
 		case <-tickCh:
@@ -93,7 +77,6 @@ func (m *Monitor) worker() {
 			log.Printf("  - Diff requests / s:       %.2f", diffReqPerSec)
 			log.Printf("  - Update request dur [ms]: %.2f", m.updReqDur.Avg())
 			log.Printf("  - Diff request dur [ms]:   %.2f", m.diffReqDur.Avg())
-			log.Printf("  - Consistancy dur [ms]:    %.2f", m.consistencyDur.Avg())
 			m.updReqSend = 0
 			m.diffReqSend = 0
 
@@ -104,8 +87,7 @@ func (m *Monitor) worker() {
 
 func init() {
 	monitor = &Monitor{
-		updReqDur:      movingaverage.New(3),
-		diffReqDur:     movingaverage.New(3),
-		consistencyDur: movingaverage.New(3),
+		updReqDur:  movingaverage.New(3),
+		diffReqDur: movingaverage.New(3),
 	}
 }
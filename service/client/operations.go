@@ -1,16 +1,22 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
+	"net/rpc"
 	"time"
 
-	"github.com/google/uuid"
-
 	"github.com/itiky/collaborate-storage/model"
 )
 
+var (
+	// errSnapshotDiverged is returned when the local snapshot doesn't match the server one (resync is required).
+	errSnapshotDiverged = errors.New("snapshot diverged")
+	// errLocalStateBroken is returned when tentative operations can't be applied to the local snapshot (a bug).
+	errLocalStateBroken = errors.New("local state is broken")
+)
+
 // initSnapshot fetches the initial snapshot version.
 func (c *Client) initSnapshot() error {
 	req := model.GetListSnapshotRequest{
@@ -19,90 +25,247 @@ func (c *Client) initSnapshot() error {
 	res := model.GetListSnapshotResponse{}
 
 	opStart := time.Now()
-	if err := c.rpcClient.Call("SortedListService.GetList", req, &res); err != nil {
+	if err := c.call("SortedListService.GetList", req, &res, snapshotCallTimeout); err != nil {
 		return fmt.Errorf("rpc: %w", err)
 	}
 	opDur := time.Since(opStart)
 
-	c.snapshotVersion = res.Version
-	c.snapshotData = res.Data
+	codec, err := model.GetValueCodec(res.ValueCodec)
+	if err != nil {
+		return err
+	}
+	snapshotData, err := model.NewIndexedList(codec, res.Data)
+	if err != nil {
+		return fmt.Errorf("snapshot data: %w", err)
+	}
+	if checksum := snapshotData.Checksum(); res.Checksum != 0 && checksum != res.Checksum {
+		return fmt.Errorf("snapshot data: checksum %x, expected %x", checksum, res.Checksum)
+	}
+
+	c.observeClock(res.Clock)
+	c.snapshotLock.Lock()
+	defer c.snapshotLock.Unlock()
 
-	log.Printf("%s: initial snapshot v%d received: %d items within %v", c.String(), res.Version, len(res.Data), opDur)
+	// Tentative operations are replayed on top of the new snapshot (the previous one is dropped with their effect)
+	fromVersion := c.snapshotVersion
+	c.valueCodec = codec
+	c.snapshotVersion = res.Version
+	c.snapshotData = snapshotData
+	if _, err := c.replayTentative(); err != nil {
+		return fmt.Errorf("%w: replaying tentative operations: %v", errLocalStateBroken, err)
+	}
+	if res.ClientSequence > c.sequence {
+		c.sequence = res.ClientSequence
+	}
+	log.Printf("%s: initial snapshot v%d received: %d items within %v (%d tentative ops)", c.String(), res.Version, len(res.Data), opDur, len(c.tentativeOps))
+	c.notifyHandlers(ChangeEvent{FromVersion: fromVersion, Version: res.Version, Reset: true})
 
 	return nil
 }
 
-// sendUpdates creates random storage operations and sends them.
+// sendUpdates moves the operations queued using the client API to the outbox and sends the pending requests.
+// Requests are only queued while the client is offline (sent after reconnect).
 func (c *Client) sendUpdates() error {
-	sendOpsPrevLen := len(c.sendOps)
-
-	getIdFromSnapshot := func() string {
-		itemIdx := rand.Intn(len(c.snapshotData))
-		return c.snapshotData[itemIdx].Id
-	}
-	getNewValue := func() model.StorageValue {
-		return model.StorageValue(rand.Int31())
-	}
-
-	sendN := rand.Intn(c.opsSendMax) + 1
-	sendOps := make([]model.OperationRequest, 0, sendN)
-	for i := 0; i < sendN; i++ {
-		sendOp := model.OperationRequest{}
-
-		switch rand.Intn(3) {
-		case 0:
-			sendOp.Type = model.InsertOperationType
-
-			sendOp.Id = uuid.New().String()
-			sendOp.Value = getNewValue()
-		case 1:
-			sendOp.Type = model.UpdateOperationType
-
-			sendOp.Id = getIdFromSnapshot()
-			sendOp.Value = getNewValue()
-		case 2:
-			sendOp.Type = model.DeleteOperationType
-
-			// Check if this delete is not a duplicate
-			for {
-				itemId := getIdFromSnapshot()
-				found := false
-				for _, op := range sendOps {
-					if op.Type == model.DeleteOperationType && op.Id == itemId {
-						found = true
-						break
-					}
-				}
-				if !found {
-					sendOp.Id = itemId
-					break
-				}
-			}
+	ops := c.takePendingOperations()
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > c.outbox.maxOps {
+			n = c.outbox.maxOps
+		}
+
+		c.sequence++
+		req := model.UpdateListRequest{
+			ClientId:   c.id,
+			Version:    c.snapshotVersion,
+			Sequence:   c.sequence,
+			Operations: ops[:n],
+		}
+		if err := c.outbox.push(req); err != nil {
+			return err
 		}
+		ops = ops[n:]
 
-		sendOps = append(sendOps, sendOp)
-		c.sendOps[c.reqOperationToMatchStr(sendOp)] = true
+		if c.rpcClient == nil {
+			log.Printf("%s: updates send: offline: request #%d queued (%d pending)", c.String(), req.Sequence, c.outbox.len())
+		}
 	}
 
-	req := model.UpdateListRequest{
-		ClientId:   c.id,
-		Version:    c.snapshotVersion,
-		Operations: sendOps,
+	if c.rpcClient == nil {
+		return nil
 	}
 
+	return c.flushOutbox()
+}
+
+// flushOutbox sends the outbox requests in order until it is empty.
+// Request rejected with model.BusyError (or failed on the server side) is resent (with the same sequence number) after the backoff,
+// one rejected with model.RequestTooLargeError is split, one rejected with model.InvalidRequestError is dropped.
+func (c *Client) flushOutbox() error {
+	for c.outbox.len() > 0 {
+		if time.Now().Before(c.sendRetryAt) {
+			return nil
+		}
+
+		req, err := c.outbox.head()
+		if err != nil {
+			return err
+		}
+		sent, err := c.sendRequest(req)
+		if err != nil {
+			return err
+		}
+		if !sent {
+			return nil
+		}
+		if err := c.outbox.pop(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendRequest sends the update request and handles the ack.
+// Returns false if the request should be resent (after c.sendRetryAt if the server is busy).
+func (c *Client) sendRequest(req model.UpdateListRequest) (bool, error) {
+	sendOps := req.Operations
+
+	res := model.UpdateListResponse{}
+
 	opStart := time.Now()
-	if err := c.rpcClient.Call("SortedListService.UpdateList", req, nil); err != nil {
-		return fmt.Errorf("rpc: %w", err)
+	err := c.call("SortedListService.UpdateList", req, &res, callTimeout)
+	if busyErr, ok := model.ParseBusyError(err); ok {
+		retryAfter := c.backoffSend(busyErr.RetryAfter)
+		log.Printf("%s: updates send: request #%d: server is busy, retrying in %v", c.String(), req.Sequence, retryAfter)
+		return false, nil
+	}
+	if tooLargeErr, ok := model.ParseRequestTooLargeError(err); ok {
+		log.Printf("%s: updates send: request #%d: %d ops: server accepts up to %d ops per request: splitting", c.String(), req.Sequence, len(sendOps), tooLargeErr.MaxOps)
+		if err := c.outbox.split(tooLargeErr.MaxOps); err != nil {
+			return false, err
+		}
+		c.sequence = c.outbox.sequence
+		return false, nil
+	}
+	if invalidErr, ok := model.ParseInvalidRequestError(err); ok {
+		log.Printf("%s: updates send: request #%d: rejected: %s: %d ops dropped", c.String(), req.Sequence, invalidErr.Reason, len(sendOps))
+		return true, c.dropRequest(req)
+	}
+	var serverErr rpc.ServerError
+	if errors.As(err, &serverErr) {
+		retryAfter := c.backoffSend(0)
+		log.Printf("%s: updates send: request #%d: %v: retrying in %v", c.String(), req.Sequence, err, retryAfter)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("rpc: %w", err)
 	}
 	opDur := time.Since(opStart)
+	c.sendBackoff = 0
+	c.observeClock(res.Clock)
+
+	// Original results are unknown if the request was handled long ago: the outcome is visible within the version at the latest
+	resultsUnknown := res.Duplicate && len(res.Results) == 0
+	if resultsUnknown {
+		log.Printf("%s: [%v] updates send: request #%d was already handled, results are unknown (settled by v%d)", c.String(), opDur, req.Sequence, res.Version)
+	} else if len(res.Results) != len(sendOps) {
+		return false, fmt.Errorf("response results: %d, expected %d", len(res.Results), len(sendOps))
+	}
+
+	// Ignored / rejected operations are never visible, applied ones are visible starting from the committed version
+	ignoredCnt, rejectedCnt, resolvedCnt := 0, 0, 0
+	acks := make([]OperationAck, 0, len(sendOps))
+	c.snapshotLock.Lock()
+	for i, sendOp := range sendOps {
+		if resultsUnknown {
+			acks = append(acks, OperationAck{Operation: sendOp, Version: res.Version})
+			if c.settleTentative(sendOp, res.Version) {
+				resolvedCnt++
+			}
+			continue
+		}
 
-	log.Printf("%s: [%v] updates send: %d ops", c.String(), opDur, len(sendOps))
+		acks = append(acks, OperationAck{Operation: sendOp, Result: res.Results[i], Version: res.Version})
+		switch res.Results[i].Status {
+		case model.AppliedOperationStatus:
+		case model.IgnoredOperationStatus:
+			ignoredCnt++
+		default:
+			// Operation targets an item changed concurrently (deleted by another client)
+			rejectedCnt++
+		}
+		if c.ackTentative(sendOp, res.Results[i], res.Version) {
+			resolvedCnt++
+		}
+	}
+	var listOps []model.ListOperation
+	if resolvedCnt > 0 {
+		// Revert the local effect of operations refused by the server (or already received with the snapshot)
+		var err error
+		if listOps, err = c.rebaseTentative(nil); err != nil {
+			c.snapshotLock.Unlock()
+			return false, fmt.Errorf("rebasing tentative operations: %w", err)
+		}
+	}
+	c.notifyHandlers(ChangeEvent{FromVersion: c.snapshotVersion, Version: c.snapshotVersion, Operations: listOps, Acks: acks})
+	c.snapshotLock.Unlock()
 
 	// Update stats
-	monitor.UpdatesSend(len(sendOps), opDur)
-	if sendOpsPrevLen == 0 {
-		monitor.ConsistencyReset(opStart)
+	monitor.UpdatesSend(opDur)
+	if resultsUnknown {
+		return true, nil
 	}
+	log.Printf("%s: [%v] updates send: %d ops (%d ignored, %d rejected), committed in v%d", c.String(), opDur, len(sendOps), ignoredCnt, rejectedCnt, res.Version)
+
+	return true, nil
+}
+
+// backoffSend postpones update requests using the exponential backoff (or the server retry duration if it is longer).
+func (c *Client) backoffSend(serverRetryAfter time.Duration) time.Duration {
+	const (
+		sendBackoffMin = 100 * time.Millisecond
+		sendBackoffMax = 10 * time.Second
+	)
+
+	c.sendBackoff *= 2
+	if c.sendBackoff < sendBackoffMin {
+		c.sendBackoff = sendBackoffMin
+	}
+	if c.sendBackoff > sendBackoffMax {
+		c.sendBackoff = sendBackoffMax
+	}
+	retryAfter := c.sendBackoff
+	if serverRetryAfter > retryAfter {
+		retryAfter = serverRetryAfter
+	}
+	c.sendRetryAt = time.Now().Add(retryAfter)
+
+	return retryAfter
+}
+
+// dropRequest reverts the local effect of the request rejected by the server.
+func (c *Client) dropRequest(req model.UpdateListRequest) error {
+	c.snapshotLock.Lock()
+	defer c.snapshotLock.Unlock()
+
+	resolvedCnt := 0
+	acks := make([]OperationAck, 0, len(req.Operations))
+	for _, op := range req.Operations {
+		result := model.OperationResult{Status: model.RejectedOperationStatus, ErrorCode: model.InternalErrorCode}
+		acks = append(acks, OperationAck{Operation: op, Result: result})
+		if c.ackTentative(op, result, 0) {
+			resolvedCnt++
+		}
+	}
+
+	var listOps []model.ListOperation
+	if resolvedCnt > 0 {
+		var err error
+		if listOps, err = c.rebaseTentative(nil); err != nil {
+			return fmt.Errorf("rebasing tentative operations: %w", err)
+		}
+	}
+	c.notifyHandlers(ChangeEvent{FromVersion: c.snapshotVersion, Version: c.snapshotVersion, Operations: listOps, Acks: acks})
 
 	return nil
 }
@@ -115,65 +278,136 @@ func (c *Client) pollUpdates() error {
 	res := model.GetListUpdatesResponse{}
 
 	opStart := time.Now()
-	if err := c.rpcClient.Call("SortedListService.GetListUpdates", req, &res); err != nil {
+	if err := c.call("SortedListService.GetListUpdates", req, &res, callTimeout); err != nil {
 		return fmt.Errorf("rpc: %w", err)
 	}
 
-	if res.Version == c.snapshotVersion {
+	return c.handleUpdatesResponse(res, opStart)
+}
+
+// startLongPoll requests a new snapshot version waiting for it on the server side (the result is sent to doneCh).
+func (c *Client) startLongPoll(doneCh chan *rpc.Call) {
+	req := model.GetListUpdatesRequest{
+		Version:     c.snapshotVersion,
+		WaitTimeout: c.longPollDur,
+	}
+	c.rpcClient.Go("SortedListService.GetListUpdates", req, &model.GetListUpdatesResponse{}, doneCh)
+}
+
+// handleLongPoll updates the local state with the long poll result.
+func (c *Client) handleLongPoll(call *rpc.Call) error {
+	if call.Error != nil {
+		return fmt.Errorf("rpc: %w", call.Error)
+	}
+
+	return c.handleUpdatesResponse(*call.Reply.(*model.GetListUpdatesResponse), time.Now())
+}
+
+// handleUpdatesResponse updates the local state with the GetListUpdates response.
+func (c *Client) handleUpdatesResponse(res model.GetListUpdatesResponse, opStart time.Time) error {
+	c.observeClock(res.Clock)
+	if res.ResyncRequired {
+		log.Printf("%s: snapshot v%d is not served anymore (latest: v%d): resyncing", c.String(), c.snapshotVersion, res.Version)
+		return c.initSnapshot()
+	}
+	if res.SnapshotRequired {
+		log.Printf("%s: snapshot v%d is older than the server history (latest: v%d): resyncing", c.String(), c.snapshotVersion, res.Version)
+		return c.initSnapshot()
+	}
+
+	return c.applyUpdates(res.Version, res.Operations, res.Checksum, opStart)
+}
+
+// handleUpdateEvent updates the local state with the pushed event.
+// Outdated events are skipped, updates are requested using the GetListUpdates RPC on a version gap or dropped events.
+func (c *Client) handleUpdateEvent(event model.ListUpdateEvent) error {
+	opStart := time.Now()
+	c.observeClock(event.Clock)
+
+	switch {
+	case event.ResyncRequired:
+		log.Printf("%s: push events were dropped (latest: v%d): polling", c.String(), event.Version)
+		return c.pollUpdates()
+	case event.Version <= c.snapshotVersion:
 		return nil
+	case event.FromVersion != c.snapshotVersion:
+		log.Printf("%s: push event v%d -> v%d doesn't match snapshot v%d: polling", c.String(), event.FromVersion, event.Version, c.snapshotVersion)
+		return c.pollUpdates()
 	}
 
-	newSnapshot, err := model.ApplyListOperations(c.snapshotData, res.Operations...)
+	return c.applyUpdates(event.Version, event.Operations, event.Checksum, opStart)
+}
+
+// applyUpdates applies list operations to the local snapshot upgrading it to the version.
+// Tentative operations are rolled back before and replayed after (if not visible within the new version).
+// Upgraded snapshot is verified using the version checksum (if set): the latest snapshot is requested on a mismatch.
+func (c *Client) applyUpdates(version int, listOps []model.ListOperation, checksum uint64, opStart time.Time) error {
+	if version == c.snapshotVersion {
+		return nil
+	}
+
+	c.snapshotLock.Lock()
+	fromVersion := c.snapshotVersion
+	viewOps, err := c.rebaseTentative(func() ([]model.ListOperation, error) {
+		if err := c.snapshotData.Apply(listOps...); err != nil {
+			return nil, fmt.Errorf("%w: model.IndexedList.Apply: %v", errSnapshotDiverged, err)
+		}
+		if localChecksum := c.snapshotData.Checksum(); checksum != 0 && localChecksum != checksum {
+			return nil, fmt.Errorf("%w: checksum %x, expected %x", errSnapshotDiverged, localChecksum, checksum)
+		}
+		c.snapshotVersion = version
+
+		return listOps, nil
+	})
+	if errors.Is(err, errSnapshotDiverged) {
+		c.snapshotLock.Unlock()
+		log.Printf("%s: snapshot v%d -> v%d upgrade (%d ops): %v: resyncing", c.String(), fromVersion, version, len(listOps), err)
+		return c.initSnapshot()
+	}
+	defer c.snapshotLock.Unlock()
 	if err != nil {
-		log.Fatalf("model.ApplyListOperations: %v", err)
+		return fmt.Errorf("rebasing tentative operations: %w", err)
 	}
 	opStop := time.Now()
 	opDur := opStop.Sub(opStart)
 
-	c.snapshotVersion = res.Version
-	c.snapshotData = newSnapshot
-
-	for _, listOp := range res.Operations {
-		listOpStr := c.listOperationToMatchStr(listOp)
-		if c.sendOps[listOpStr] {
-			delete(c.sendOps, listOpStr)
-		}
-	}
-	log.Printf("%s: [%v] snapshot updated to v%d: %d ops (%d unhandled)", c.String(), opDur, res.Version, len(res.Operations), len(c.sendOps))
+	log.Printf("%s: [%v] snapshot updated to v%d: %d ops (%d tentative)", c.String(), opDur, version, len(listOps), len(c.tentativeOps))
 
 	// Update stats
-	monitor.UpdatesReceived(len(res.Operations), opDur)
-	if len(c.sendOps) == 0 {
-		monitor.ConsistencyAchieved(opStop)
-	}
+	monitor.UpdatesReceived(len(listOps), opDur)
+	c.notifyHandlers(ChangeEvent{FromVersion: fromVersion, Version: version, Operations: viewOps})
 
 	return nil
 }
 
-// reqOperationToMatchStr builds a string representation of model.OperationRequest (used for c.sendOps matching).
-func (c *Client) reqOperationToMatchStr(op model.OperationRequest) string {
-	switch op.Type {
-	case model.InsertOperationType:
-		return fmt.Sprintf("%s: %s -> %d", op.Type, op.Id, op.Value)
-	case model.UpdateOperationType:
-		return fmt.Sprintf("%s: %s -> %d", op.Type, op.Id, op.Value)
-	case model.DeleteOperationType:
-		return fmt.Sprintf("%s: %s", op.Type, op.Id)
+// observeClock merges the server clock into the local one (operations made after are ordered after the observed ones).
+func (c *Client) observeClock(serverClock model.HLC) {
+	if serverClock.IsZero() {
+		return
+	}
+	if _, err := c.clock.Update(serverClock); err != nil {
+		log.Printf("%s: server clock: %v", c.String(), err)
 	}
-
-	return ""
 }
 
-// listOperationToMatchStr builds a string representation of model.ListOperation (used for c.sendOps matching).
-func (c *Client) listOperationToMatchStr(op model.ListOperation) string {
-	switch op.Type {
-	case model.InsertOperationType:
-		return fmt.Sprintf("%s: %s -> %d", op.Type, op.Id, op.Value)
-	case model.UpdateOperationType:
-		return fmt.Sprintf("%s: %s -> %d", op.Type, op.Id, op.Value)
-	case model.DeleteOperationType:
-		return fmt.Sprintf("%s: %s", op.Type, op.Id)
+// reconcile brings the local snapshot up to date after the connection is (re)established
+// and pushes the pending requests rebased on top of it (conflicts are resolved by the server policy).
+func (c *Client) reconcile() error {
+	if c.valueCodec == nil || c.resyncRequired {
+		if err := c.initSnapshot(); err != nil {
+			return err
+		}
+		c.resyncRequired = false
+	} else if err := c.pollUpdates(); err != nil {
+		return err
+	}
+
+	if c.outbox.len() > 0 {
+		log.Printf("%s: rebasing %d pending requests on v%d", c.String(), c.outbox.len(), c.snapshotVersion)
+		if err := c.outbox.rebase(c.snapshotVersion); err != nil {
+			return err
+		}
 	}
 
-	return ""
+	return c.flushOutbox()
 }
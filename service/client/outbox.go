@@ -0,0 +1,292 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/itiky/collaborate-storage/internal/fileutil"
+	"github.com/itiky/collaborate-storage/model"
+)
+
+const (
+	// Max number of operations per request (queued operations are split / merged up to it).
+	requestMaxOps = 500
+	// Outbox log is compacted once it has more records than this (and twice the number of pending requests).
+	outboxCompactRecords = 1000
+)
+
+const (
+	outboxRecordTypeState  outboxRecordType = "state"
+	outboxRecordTypePush   outboxRecordType = "push"
+	outboxRecordTypeSent   outboxRecordType = "sent"
+	outboxRecordTypePop    outboxRecordType = "pop"
+	outboxRecordTypeRebase outboxRecordType = "rebase"
+)
+
+type (
+	// outbox keeps update requests not acknowledged by the server yet (in order).
+	// Every change is appended to the log file within the state directory (if set), so requests made offline survive a client restart.
+	// Log starts with the whole outbox state record, it is compacted (rewritten with a single state record) when it grows.
+	outbox struct {
+		clientId model.ClientId
+		filePath string   // empty - not persisted
+		file     *os.File // log file opened for append
+		records  int      // number of log records
+		maxOps   int      // max number of operations per request
+		sequence uint64   // the latest request sequence number pushed
+		entries  []outboxEntry
+	}
+
+	// outboxEntry is an outbox request.
+	outboxEntry struct {
+		Request model.UpdateListRequest
+		// Request might have been received by the server (it can't be merged with others)
+		Sent bool
+	}
+
+	outboxRecordType string
+
+	// outboxRecord is an outbox log record.
+	outboxRecord struct {
+		Type outboxRecordType
+		// State: the whole outbox
+		ClientId model.ClientId
+		Sequence uint64
+		Entries  []outboxEntry
+		// Push: a new request (merged into the last one if Merged is set)
+		Request model.UpdateListRequest
+		Merged  bool
+		// Rebase: the snapshot version
+		Version int
+	}
+)
+
+// len returns the number of requests pending.
+func (o *outbox) len() int {
+	return len(o.entries)
+}
+
+// push appends a new request.
+// Request is merged into the last one if it was never sent (keeping the operations order and timestamps),
+// the merged request gets the latest sequence number.
+func (o *outbox) push(req model.UpdateListRequest) error {
+	n := len(o.entries)
+	merged := n > 0 && !o.entries[n-1].Sent && len(o.entries[n-1].Request.Operations)+len(req.Operations) <= o.maxOps
+
+	return o.change(outboxRecord{Type: outboxRecordTypePush, Request: req, Merged: merged})
+}
+
+// head returns the first request marking it as sent.
+func (o *outbox) head() (model.UpdateListRequest, error) {
+	if len(o.entries) == 0 {
+		return model.UpdateListRequest{}, errors.New("outbox is empty")
+	}
+
+	if !o.entries[0].Sent {
+		if err := o.change(outboxRecord{Type: outboxRecordTypeSent}); err != nil {
+			return model.UpdateListRequest{}, err
+		}
+	}
+
+	return o.entries[0].Request, nil
+}
+
+// pop drops the first request (acknowledged by the server).
+func (o *outbox) pop() error {
+	if len(o.entries) == 0 {
+		return nil
+	}
+
+	return o.change(outboxRecord{Type: outboxRecordTypePop})
+}
+
+// rebase moves pending requests on top of the snapshot version.
+func (o *outbox) rebase(version int) error {
+	return o.change(outboxRecord{Type: outboxRecordTypeRebase, Version: version})
+}
+
+// split lowers the max number of operations per request splitting the pending requests.
+// Requests get new sequence numbers: only the first one could have been sent and it was rejected (its number is not used by the server).
+func (o *outbox) split(maxOps int) error {
+	o.maxOps = maxOps
+
+	entries := make([]outboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		for ops := entry.Request.Operations; len(ops) > 0; {
+			n := len(ops)
+			if n > maxOps {
+				n = maxOps
+			}
+
+			req := entry.Request
+			o.sequence++
+			req.Sequence, req.Operations = o.sequence, append([]model.OperationRequest(nil), ops[:n]...)
+			entries = append(entries, outboxEntry{Request: req})
+			ops = ops[n:]
+		}
+	}
+	o.entries = entries
+
+	return o.compact()
+}
+
+// close closes the log file.
+func (o *outbox) close() error {
+	if o.file == nil {
+		return nil
+	}
+	err := o.file.Close()
+	o.file = nil
+
+	return err
+}
+
+// change applies the record and appends it to the log (the log is compacted instead if it has grown).
+func (o *outbox) change(rec outboxRecord) error {
+	o.apply(rec)
+	if o.filePath == "" {
+		return nil
+	}
+
+	if o.records >= outboxCompactRecords && o.records >= 2*len(o.entries) {
+		return o.compact()
+	}
+
+	frame, err := fileutil.EncodeRecord(rec)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if _, err := o.file.Write(frame); err != nil {
+		return fmt.Errorf("outbox: write: %w", err)
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("outbox: sync: %w", err)
+	}
+	o.records++
+
+	return nil
+}
+
+// apply applies the record to the outbox state.
+func (o *outbox) apply(rec outboxRecord) {
+	switch rec.Type {
+	case outboxRecordTypeState:
+		o.sequence, o.entries = rec.Sequence, rec.Entries
+	case outboxRecordTypePush:
+		req := rec.Request
+		if n := len(o.entries); rec.Merged && n > 0 {
+			last := &o.entries[n-1].Request
+			last.Operations = append(last.Operations, req.Operations...)
+			last.Version, last.Sequence = req.Version, req.Sequence
+		} else {
+			req.Operations = append([]model.OperationRequest(nil), req.Operations...)
+			o.entries = append(o.entries, outboxEntry{Request: req})
+		}
+		if req.Sequence > o.sequence {
+			o.sequence = req.Sequence
+		}
+	case outboxRecordTypeSent:
+		if len(o.entries) > 0 {
+			o.entries[0].Sent = true
+		}
+	case outboxRecordTypePop:
+		if len(o.entries) > 0 {
+			o.entries = o.entries[1:]
+		}
+	case outboxRecordTypeRebase:
+		for i := range o.entries {
+			o.entries[i].Request.Version = rec.Version
+		}
+	}
+}
+
+// compact rewrites the log with a single state record (using a temporary file and the atomic rename).
+func (o *outbox) compact() error {
+	if o.filePath == "" {
+		return nil
+	}
+
+	frame, err := fileutil.EncodeRecord(outboxRecord{
+		Type:     outboxRecordTypeState,
+		ClientId: o.clientId,
+		Sequence: o.sequence,
+		Entries:  o.entries,
+	})
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := o.close(); err != nil {
+		return fmt.Errorf("outbox: close: %w", err)
+	}
+	if err := fileutil.WriteFileAtomic(o.filePath, frame); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+
+	file, err := os.OpenFile(o.filePath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("outbox: open file (%s): %w", o.filePath, err)
+	}
+	o.file, o.records = file, 1
+
+	return nil
+}
+
+// replay applies the log records.
+// Reading stops at a torn / corrupted record (crash during append), the following records are dropped.
+func (o *outbox) replay(reader io.Reader) error {
+	for offset, i := int64(0), 0; ; i++ {
+		rec := outboxRecord{}
+		frameLen, err := fileutil.ReadRecord(reader, &rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Printf("outbox: record %d at offset %d: %v (dropped)", i, offset, err)
+			return nil
+		}
+		if i == 0 {
+			if rec.Type != outboxRecordTypeState {
+				return fmt.Errorf("outbox: record %d (%s): state record expected", i, rec.Type)
+			}
+			if rec.ClientId != o.clientId {
+				return fmt.Errorf("outbox: belongs to client %d", rec.ClientId)
+			}
+		}
+		o.apply(rec)
+		offset += frameLen
+	}
+}
+
+// newOutbox creates a new outbox object loading the pending requests from the state directory (if set).
+func newOutbox(clientId model.ClientId, stateDir string) (*outbox, error) {
+	o := &outbox{clientId: clientId, maxOps: requestMaxOps}
+	if stateDir == "" {
+		return o, nil
+	}
+	o.filePath = filepath.Join(stateDir, outboxFileName)
+
+	file, err := os.Open(o.filePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("outbox: open file (%s): %w", o.filePath, err)
+	default:
+		err := o.replay(bufio.NewReader(file))
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Log is rewritten on start (a torn tail is dropped)
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
@@ -0,0 +1,204 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// newTestOutboxDir creates a temporary state directory.
+func newTestOutboxDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "outbox")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	return dir
+}
+
+// newTestOutboxRequest creates an update request with random insert operations.
+func newTestOutboxRequest(sequence uint64, n int) model.UpdateListRequest {
+	req := model.UpdateListRequest{
+		ClientId: 1,
+		Version:  1,
+		Sequence: sequence,
+	}
+	for i := 0; i < n; i++ {
+		req.Operations = append(req.Operations, model.OperationRequest{
+			Type:      model.InsertOperationType,
+			Id:        uuid.New().String(),
+			Value:     testCodec.Random(),
+			Timestamp: model.HLC{Wall: int64(sequence), Logical: uint32(i)},
+		})
+	}
+
+	return req
+}
+
+// reopenTestOutbox closes the outbox and loads it from the state directory.
+func reopenTestOutbox(t *testing.T, o *outbox, dir string) *outbox {
+	require.NoError(t, o.close())
+
+	restored, err := newOutbox(o.clientId, dir)
+	require.NoError(t, err)
+	require.Equal(t, o.sequence, restored.sequence)
+	require.Equal(t, o.entries, restored.entries)
+
+	return restored
+}
+
+// Test restores the pending requests from the log.
+func Test_Outbox_Restore(t *testing.T) {
+	dir := newTestOutboxDir(t)
+	o, err := newOutbox(1, dir)
+	require.NoError(t, err)
+	require.Equal(t, 0, o.len())
+
+	// Requests never sent are merged
+	req1, req2, req3 := newTestOutboxRequest(1, 2), newTestOutboxRequest(2, 1), newTestOutboxRequest(3, 2)
+	require.NoError(t, o.push(req1))
+	require.NoError(t, o.push(req2))
+	require.Equal(t, 1, o.len())
+	head, err := o.head()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), head.Sequence)
+	require.Equal(t, append(append([]model.OperationRequest(nil), req1.Operations...), req2.Operations...), head.Operations)
+
+	// Sent request is not merged
+	require.NoError(t, o.push(req3))
+	require.Equal(t, 2, o.len())
+	require.True(t, o.entries[0].Sent)
+	o = reopenTestOutbox(t, o, dir)
+
+	// Rebase and pop
+	require.NoError(t, o.rebase(5))
+	require.NoError(t, o.pop())
+	require.Equal(t, 1, o.len())
+	require.Equal(t, 5, o.entries[0].Request.Version)
+	require.Equal(t, req3.Operations, o.entries[0].Request.Operations)
+	o = reopenTestOutbox(t, o, dir)
+
+	require.NoError(t, o.pop())
+	require.NoError(t, o.pop())
+	_, err = o.head()
+	require.Error(t, err)
+	o = reopenTestOutbox(t, o, dir)
+	require.Equal(t, uint64(3), o.sequence)
+	require.NoError(t, o.close())
+
+	// Log of another client
+	_, err = newOutbox(2, dir)
+	require.Error(t, err)
+
+	// Not persisted
+	o, err = newOutbox(1, "")
+	require.NoError(t, err)
+	require.NoError(t, o.push(req1))
+	require.Equal(t, 1, o.len())
+	require.NoError(t, o.close())
+}
+
+// Test compacts the log once it grows.
+func Test_Outbox_Compact(t *testing.T) {
+	dir := newTestOutboxDir(t)
+	o, err := newOutbox(1, dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, o.records)
+
+	// Push, send and pop: 3 records per request
+	sequence := uint64(0)
+	for i := 0; i < outboxCompactRecords; i++ {
+		sequence++
+		require.NoError(t, o.push(newTestOutboxRequest(sequence, 1)))
+		_, err := o.head()
+		require.NoError(t, err)
+		require.NoError(t, o.pop())
+		require.LessOrEqual(t, o.records, outboxCompactRecords)
+	}
+	for i := 0; i < 3; i++ {
+		sequence++
+		require.NoError(t, o.push(newTestOutboxRequest(sequence, 1)))
+		_, err := o.head()
+		require.NoError(t, err)
+	}
+	// The first one is sent, the next ones are merged
+	require.Equal(t, 2, o.len())
+
+	o = reopenTestOutbox(t, o, dir)
+	require.Equal(t, 1, o.records)
+	require.Equal(t, sequence, o.sequence)
+	require.NoError(t, o.close())
+}
+
+// Test splits pending requests giving them new sequence numbers.
+func Test_Outbox_Split(t *testing.T) {
+	dir := newTestOutboxDir(t)
+	o, err := newOutbox(1, dir)
+	require.NoError(t, err)
+
+	require.NoError(t, o.push(newTestOutboxRequest(1, 5)))
+	_, err = o.head()
+	require.NoError(t, err)
+	require.NoError(t, o.push(newTestOutboxRequest(2, 3)))
+	ops := append(append([]model.OperationRequest(nil), o.entries[0].Request.Operations...), o.entries[1].Request.Operations...)
+
+	require.NoError(t, o.split(2))
+	require.Equal(t, 2, o.maxOps)
+	require.Equal(t, 5, o.len())
+	require.Equal(t, uint64(7), o.sequence)
+	splitOps, splitLens := make([]model.OperationRequest, 0, len(ops)), make([]int, 0, o.len())
+	for i, entry := range o.entries {
+		require.False(t, entry.Sent)
+		require.Equal(t, uint64(3+i), entry.Request.Sequence)
+		splitOps = append(splitOps, entry.Request.Operations...)
+		splitLens = append(splitLens, len(entry.Request.Operations))
+	}
+	require.Equal(t, ops, splitOps)
+	require.Equal(t, []int{2, 2, 1, 2, 1}, splitLens)
+
+	// Split requests survive a restart (the max number of operations is not persisted: a new request is merged)
+	o = reopenTestOutbox(t, o, dir)
+	require.NoError(t, o.push(newTestOutboxRequest(8, 1)))
+	require.Equal(t, 5, o.len())
+	require.Len(t, o.entries[4].Request.Operations, 2)
+	require.Equal(t, uint64(8), o.sequence)
+	o = reopenTestOutbox(t, o, dir)
+	require.NoError(t, o.close())
+}
+
+// Test drops a torn log tail (crash during append).
+func Test_Outbox_TornTail(t *testing.T) {
+	dir := newTestOutboxDir(t)
+	o, err := newOutbox(1, dir)
+	require.NoError(t, err)
+
+	require.NoError(t, o.push(newTestOutboxRequest(1, 2)))
+	_, err = o.head()
+	require.NoError(t, err)
+	require.NoError(t, o.push(newTestOutboxRequest(2, 2)))
+	require.NoError(t, o.close())
+	expected := o.entries
+
+	file, err := os.OpenFile(o.filePath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	o, err = newOutbox(1, dir)
+	require.NoError(t, err)
+	require.Equal(t, expected, o.entries)
+	require.Equal(t, uint64(2), o.sequence)
+
+	// Log is rewritten: new records follow the valid ones
+	require.NoError(t, o.pop())
+	o = reopenTestOutbox(t, o, dir)
+	require.Equal(t, expected[1:], o.entries)
+	require.NoError(t, o.close())
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// subscribe connects to the list updates push stream and forwards received events to the worker.
+// Stream errors are sent to errCh (the worker closes the connection on stop).
+func (c *Client) subscribe(eventCh chan<- model.ListUpdateEvent, errCh chan<- error) (net.Conn, error) {
+	conn, err := dial(c.pushUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	req := model.SubscribeRequest{
+		ClientId: c.id,
+		Version:  c.snapshotVersion,
+	}
+	if err := gob.NewEncoder(conn).Encode(req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("subscribe request: GOB marshal: %w", err)
+	}
+
+	go func() {
+		decoder := gob.NewDecoder(conn)
+		for {
+			event := model.ListUpdateEvent{}
+			if err := decoder.Decode(&event); err != nil {
+				select {
+				case errCh <- fmt.Errorf("event: GOB unmarshal: %w", err):
+				case <-c.stopCh:
+				}
+				return
+			}
+
+			select {
+			case eventCh <- event:
+			case <-c.stopCh:
+				return
+			}
+		}
+	}()
+
+	return conn, nil
+}
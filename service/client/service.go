@@ -1,30 +1,61 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/itiky/collaborate-storage/model"
 )
 
+// Client keeps a local list snapshot in sync with the server and sends the list updates.
+// Client API methods are safe for concurrent use, the state is handled by the worker.
 type Client struct {
 	// Config
-	id         model.ClientId // unique ID
-	opsSendDur time.Duration  // storage updates send period
-	opsSendMax int            // max number of storage updates per request
-	pollDur    time.Duration  // snapshot update polling duration
+	id          model.ClientId // unique ID
+	opsSendDur  time.Duration  // queued storage updates send period
+	pollDur     time.Duration  // snapshot update polling duration
+	longPollDur time.Duration  // snapshot update long polling wait timeout (polling by pollDur is used if 0)
+	pushUrl     string         // list updates push stream url (polling is used if empty)
+	serverUrl   string         // RPC server url
+	stateDir    string         // local state (outbox, snapshot) directory (empty - not persisted)
 	// State
-	sendOps         map[string]bool   // keeps send operations which are not yet visible to client
-	snapshotVersion int               // current snapshot version
-	snapshotData    model.StorageList // current snapshot data
+	valueCodec       model.ValueCodec   // snapshot values codec
+	sequence         uint64             // the latest update request sequence number
+	outbox           *outbox            // update requests not acknowledged yet
+	sendBackoff      time.Duration      // the current busy server backoff
+	sendRetryAt      time.Time          // update requests are not sent until
+	clock            *model.HLClock     // operations timestamps source (merged with the server clock)
+	snapshotVersion  int                // current snapshot version
+	snapshotData     *model.IndexedList // current snapshot data (including tentative operations)
+	savedVersion     int                // snapshot version saved to the state directory (-1 - not saved)
+	offlineSince     time.Time          // the connection lost time (client is offline if rpcClient is nil)
+	reconnectCh      <-chan time.Time   // the next reconnect attempt timer (nil if online)
+	reconnectBackoff time.Duration      // the current reconnect backoff
+	resyncRequired   bool               // a fresh snapshot is downloaded on reconnect (instead of upgrading the local one)
+	// Shared state (accessed by the API)
+	snapshotLock   sync.RWMutex             // guards valueCodec, snapshotVersion, snapshotData and tentativeOps
+	tentativeOps   []tentativeOp            // client operations applied to snapshotData, but not visible within snapshotVersion yet
+	pendingLock    sync.Mutex               // guards pendingOps
+	pendingOps     []model.OperationRequest // operations queued using the API (not in the outbox yet)
+	handlersLock   sync.Mutex               // guards handlers and changeEvents
+	handlers       map[uint64]ChangeHandler // snapshot change handlers
+	handlerSeq     uint64                   // the latest handler ID
+	changeEvents   []ChangeEvent            // change events not delivered to handlers yet
+	changeSignalCh chan struct{}            // signals a new change event
 	//
-	rpcClient *rpc.Client
-	stopCh    chan interface{}
+	rpcClient  *rpc.Client
+	pushConn   net.Conn                   // push stream connection (nil if not subscribed)
+	pushErrCh  chan error                 // push stream errors (per connection)
+	eventCh    chan model.ListUpdateEvent // pushed events
+	longPollCh chan *rpc.Call             // long poll results (per connection)
+	stopCh     chan interface{}
+	doneCh     chan struct{} // closed on the worker exit
 }
 
 // String implements the stringer interface.
@@ -38,102 +69,280 @@ func (c *Client) Start() {
 		return
 	}
 	c.stopCh = make(chan interface{})
+	c.doneCh = make(chan struct{})
 
 	monitor.Start()
+	go c.dispatcher()
 	go c.worker()
 }
 
-// Stop stops the Client worker.
+// Stop stops the Client worker (waits for the local state to be saved).
 func (c *Client) Stop() {
 	if c.stopCh == nil {
 		return
 	}
 
 	close(c.stopCh)
+	<-c.doneCh
 	monitor.Stop()
 }
 
 // worker does the actual job.
 func (c *Client) worker() {
+	defer close(c.doneCh)
+
 	log.Printf("%s: start", c.String())
 	log.Printf("%s: opsSendDur: %v", c.String(), c.opsSendDur)
-	log.Printf("%s: opsSendMax: %v", c.String(), c.opsSendMax)
 	log.Printf("%s: pollDur:    %v", c.String(), c.pollDur)
+	log.Printf("%s: longPollDur: %v", c.String(), c.longPollDur)
+	log.Printf("%s: pushUrl:    %s", c.String(), c.pushUrl)
+	log.Printf("%s: stateDir:   %s", c.String(), c.stateDir)
 
-	if err := c.initSnapshot(); err != nil {
-		log.Fatalf("%s: snapshot initialization: %v", c.String(), err)
+	if c.rpcClient != nil {
+		if err := c.goOnline(); err != nil {
+			c.handleError("snapshot initialization", err)
+		}
+	} else {
+		log.Printf("%s: offline: reconnecting in %v", c.String(), c.scheduleReconnect())
 	}
 
 	sendCh := time.Tick(c.opsSendDur)
 	pollCh := time.Tick(c.pollDur)
+	saveCh := time.Tick(snapshotSavePeriod)
+
+	// Push stream / back-to-back long polls replace polling
+	if c.pushUrl != "" || c.longPollDur > 0 {
+		pollCh = nil
+	}
+
 	for {
 		select {
 		case <-sendCh:
 			// Send storage operations
 			if err := c.sendUpdates(); err != nil {
-				log.Fatalf("%s: sending updates: %v", c.String(), err)
+				c.handleError("sending updates", err)
 			}
 		case <-pollCh:
 			// Update the local snapshot
+			if c.rpcClient == nil {
+				continue
+			}
 			if err := c.pollUpdates(); err != nil {
-				log.Fatalf("%s: polling updates: %v", c.String(), err)
+				c.handleError("polling updates", err)
+			}
+		case call := <-c.longPollCh:
+			// Update the local snapshot and start the next long poll
+			if err := c.handleLongPoll(call); err != nil {
+				c.handleError("long polling updates", err)
+				continue
+			}
+			c.startLongPoll(c.longPollCh)
+		case event := <-c.eventCh:
+			// Update the local snapshot with the pushed event
+			if c.rpcClient == nil {
+				continue
 			}
+			if err := c.handleUpdateEvent(event); err != nil {
+				c.handleError("handling pushed updates", err)
+			}
+		case err := <-c.pushErrCh:
+			c.handleError("push stream", err)
+		case <-saveCh:
+			// Persist the local snapshot for a warm restart
+			if err := c.saveSnapshot(); err != nil {
+				log.Printf("%s: saving snapshot: %v", c.String(), err)
+			}
+		case <-c.reconnectCh:
+			// Try to restore the connection
+			c.reconnect()
 		case <-c.stopCh:
 			// Stop the client
 			log.Printf("%s: stop", c.String())
-			c.rpcClient.Close()
+			if err := c.saveSnapshot(); err != nil {
+				log.Printf("%s: saving snapshot: %v", c.String(), err)
+			}
+			if c.pushConn != nil {
+				c.pushConn.Close()
+			}
+			if c.rpcClient != nil {
+				c.rpcClient.Close()
+			}
+			if err := c.outbox.close(); err != nil {
+				log.Printf("%s: closing outbox: %v", c.String(), err)
+			}
 			return
 		}
 	}
 }
 
-// NewClient creates a new Client object.
-func NewClient(id model.ClientId, opsSendDur, pollDur time.Duration, opsSendMax int, serverUrl string) (*Client, error) {
-	const (
-		numOfRetries     = 120
-		retryFallbackDur = 500 * time.Millisecond
-	)
+// goOnline reconciles the local state with the server and starts listening for updates (push stream / long polling).
+func (c *Client) goOnline() error {
+	if err := c.reconcile(); err != nil {
+		return err
+	}
+	c.reconnectCh, c.reconnectBackoff = nil, 0
+
+	switch {
+	case c.pushUrl != "":
+		c.pushErrCh = make(chan error, 1)
+		pushConn, err := c.subscribe(c.eventCh, c.pushErrCh)
+		if err != nil {
+			return fmt.Errorf("subscribing: %w", err)
+		}
+		c.pushConn = pushConn
+	case c.longPollDur > 0:
+		c.longPollCh = make(chan *rpc.Call, 1)
+		c.startLongPoll(c.longPollCh)
+	}
+
+	return nil
+}
+
+// goOffline drops the server connection (lost or reset on an error): operations are queued to the outbox until the connection is restored.
+func (c *Client) goOffline(reason error) {
+	if c.rpcClient == nil {
+		return
+	}
+
+	log.Printf("%s: disconnected: %v: working offline (%d requests pending)", c.String(), reason, c.outbox.len())
 
+	c.rpcClient.Close()
+	c.rpcClient = nil
+	if c.pushConn != nil {
+		c.pushConn.Close()
+		c.pushConn = nil
+	}
+	c.pushErrCh, c.longPollCh = nil, nil
+	if c.reconnectCh == nil {
+		c.offlineSince = time.Now()
+		if err := c.saveSnapshot(); err != nil {
+			log.Printf("%s: saving snapshot: %v", c.String(), err)
+		}
+	}
+	log.Printf("%s: reconnecting in %v", c.String(), c.scheduleReconnect())
+}
+
+// reconnect dials the server and reconciles the local state (the next attempt is scheduled on failure).
+// Snapshot is upgraded using the GetListUpdates RPC (or re-downloaded), requests never acknowledged are resent.
+func (c *Client) reconnect() {
+	rpcClient, err := dialRPC(c.serverUrl)
+	if err != nil {
+		log.Printf("%s: reconnect: %v: retrying in %v", c.String(), err, c.scheduleReconnect())
+		return
+	}
+	c.rpcClient = rpcClient
+
+	log.Printf("%s: reconnected after %v offline: reconciling v%d (%d requests pending)", c.String(), time.Since(c.offlineSince), c.snapshotVersion, c.outbox.len())
+	if err := c.goOnline(); err != nil {
+		c.handleError("reconciling", err)
+	}
+}
+
+// handleError handles the worker action error:
+// a connection error switches the client to the offline mode, the local state inconsistency (a bug) is fatal.
+// On other errors (server errors, unexpected responses) the connection is dropped and restored after the backoff
+// downloading a fresh snapshot.
+func (c *Client) handleError(action string, err error) {
+	switch {
+	case errors.Is(err, errLocalStateBroken):
+		log.Fatalf("%s: %s: %v", c.String(), action, err)
+	case isConnectionError(err):
+		c.goOffline(fmt.Errorf("%s: %w", action, err))
+	default:
+		log.Printf("%s: %s: %v: resyncing", c.String(), action, err)
+		c.resyncRequired = true
+		c.goOffline(fmt.Errorf("%s: %w", action, err))
+	}
+}
+
+// NewClient creates a new Client object.
+// Client ID must be unique (duplicate requests are detected per client ID): if not set (0), a random one is generated
+// and persisted within the state directory.
+// Client starts offline (using the saved snapshot if any) if the server is not available.
+func NewClient(id model.ClientId, opsSendDur, pollDur, longPollDur time.Duration, serverUrl, pushUrl, stateDir string) (*Client, error) {
 	if opsSendDur <= 0 {
 		return nil, fmt.Errorf("%s: must be GT 0", "opsSendDur")
 	}
 	if pollDur <= 0 {
 		return nil, fmt.Errorf("%s: must be GT 0", "pollDur")
 	}
-	if opsSendMax < 1 {
-		return nil, fmt.Errorf("%s: must be GTE 1", "opsSendMax")
+	if longPollDur < 0 {
+		return nil, fmt.Errorf("%s: must be GTE 0", "longPollDur")
+	}
+	if stateDir != "" {
+		if err := os.MkdirAll(stateDir, 0755); err != nil {
+			return nil, fmt.Errorf("%s: creating: %w", "stateDir", err)
+		}
+	}
+
+	id, err := loadClientId(id, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	clock, err := model.NewHLClock(0)
+	if err != nil {
+		return nil, fmt.Errorf("model.NewHLClock: %w", err)
+	}
+
+	outbox, err := newOutbox(id, stateDir)
+	if err != nil {
+		return nil, err
 	}
 
 	c := Client{
 		id: id,
 		//
-		opsSendDur: opsSendDur,
-		opsSendMax: opsSendMax,
-		pollDur:    pollDur,
+		opsSendDur:  opsSendDur,
+		pollDur:     pollDur,
+		longPollDur: longPollDur,
+		pushUrl:     pushUrl,
+		serverUrl:   serverUrl,
+		stateDir:    stateDir,
 		//
-		sendOps: make(map[string]bool),
+		savedVersion:   -1,
+		sequence:       outbox.sequence,
+		outbox:         outbox,
+		clock:          clock,
+		eventCh:        make(chan model.ListUpdateEvent),
+		handlers:       make(map[uint64]ChangeHandler),
+		changeSignalCh: make(chan struct{}, 1),
 	}
-
-	for retry := 0; retry < numOfRetries; retry++ {
-		client, err := rpc.Dial("tcp", serverUrl)
-		if err == nil {
-			c.rpcClient = client
-			break
+	// Requests made before the restart must stay ordered before the new ones (and are applied to the snapshot as tentative)
+	for _, entry := range outbox.entries {
+		for _, op := range entry.Request.Operations {
+			c.observeClock(op.Timestamp)
+			c.tentativeOps = append(c.tentativeOps, tentativeOp{op: op})
 		}
+	}
+	if outbox.len() > 0 {
+		log.Printf("%s: %d pending requests loaded", c.String(), outbox.len())
+	}
 
-		if netErr, ok := err.(*net.OpError); ok {
-			if sysErr, ok := netErr.Err.(*os.SyscallError); ok {
-				if sysErr.Err == syscall.ECONNREFUSED {
-					time.Sleep(retryFallbackDur)
-					continue
-				}
-			}
+	// Saved snapshot is upgraded using the GetListUpdates RPC on start (warm restart) instead of downloading the whole list
+	found, err := c.loadSnapshot()
+	if err != nil {
+		return nil, fmt.Errorf("loading snapshot: %w", err)
+	}
+	if found {
+		if _, err := c.replayTentative(); err != nil {
+			return nil, fmt.Errorf("applying pending requests: %w", err)
 		}
+		log.Printf("%s: saved snapshot v%d loaded: %d items", c.String(), c.snapshotVersion, c.snapshotData.Len())
+	}
 
-		return nil, fmt.Errorf("rpc.Dial(%s): %w", serverUrl, err)
+	rpcClient, err := dialRPC(serverUrl)
+	if err == nil {
+		c.rpcClient = rpcClient
+		return &c, nil
 	}
-	if c.rpcClient == nil {
-		return nil, fmt.Errorf("RPC connection failed after %d retries with %v fallback", numOfRetries, retryFallbackDur)
+
+	// Server is not available: client starts offline and reconnects in background
+	c.offlineSince = time.Now()
+	if found {
+		log.Printf("%s: %v: starting offline with the saved snapshot v%d", c.String(), err, c.snapshotVersion)
+	} else {
+		log.Printf("%s: %v: starting offline (no snapshot yet)", c.String(), err)
 	}
 
 	return &c, nil
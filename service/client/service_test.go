@@ -0,0 +1,93 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+	"github.com/itiky/collaborate-storage/service/server"
+	"github.com/itiky/collaborate-storage/storage"
+)
+
+const testWaitTimeout = 5 * time.Second
+
+var testCodec = model.MustGetValueCodec(model.Int32ValueCodecName)
+
+// newTestServer starts a SortedListService RPC server for the generated base file.
+// Returns the service and the RPC server url.
+func newTestServer(t *testing.T) (*server.SortedListService, string) {
+	dir, err := ioutil.TempDir("", "client")
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "base.dat")
+	require.NoError(t, storage.GenAndSaveInitialStorage(filePath, 100, testCodec))
+
+	svc, err := server.NewSortedListService(server.Config{
+		ChSize:         100,
+		BatchPeriod:    10 * time.Millisecond,
+		FilePath:       filePath,
+		PushBufferSize: 10,
+	})
+	require.NoError(t, err)
+
+	rpcServer := rpc.NewServer()
+	require.NoError(t, rpcServer.Register(svc))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go rpcServer.Accept(listener)
+	svc.Start()
+
+	t.Cleanup(func() {
+		listener.Close()
+		svc.Stop()
+		os.RemoveAll(dir)
+	})
+
+	return svc, listener.Addr().String()
+}
+
+// newTestClient creates a Client object polling the server (not started).
+func newTestClient(t *testing.T, serverUrl string) *Client {
+	c, err := NewClient(1, 10*time.Millisecond, 10*time.Millisecond, 0, serverUrl, "", "")
+	require.NoError(t, err)
+
+	return c
+}
+
+// waitForSnapshot waits for the client to receive the initial snapshot.
+func waitForSnapshot(t *testing.T, c *Client) {
+	require.Eventually(t, func() bool {
+		return c.ValueCodec() != nil
+	}, testWaitTimeout, 10*time.Millisecond)
+}
+
+// exportSnapshot returns the client local snapshot data.
+func exportSnapshot(c *Client) model.StorageList {
+	c.snapshotLock.RLock()
+	defer c.snapshotLock.RUnlock()
+
+	return c.snapshotData.Export()
+}
+
+// tentativeOpsCopy returns the tentative operations.
+func (c *Client) tentativeOpsCopy() []tentativeOp {
+	c.snapshotLock.RLock()
+	defer c.snapshotLock.RUnlock()
+
+	return append([]tentativeOp(nil), c.tentativeOps...)
+}
+
+// getServerList returns the server latest version data.
+func getServerList(t *testing.T, svc *server.SortedListService) (int, model.StorageList) {
+	res := model.GetListSnapshotResponse{}
+	require.NoError(t, svc.GetList(model.GetListSnapshotRequest{ClientId: 1}, &res))
+
+	return res.Version, res.Data
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/itiky/collaborate-storage/internal/fileutil"
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// Local state file names (within the state directory).
+const (
+	identityFileName = "client.dat"
+	outboxFileName   = "outbox.dat"
+	snapshotFileName = "snapshot.dat"
+)
+
+// Snapshot is saved periodically (if changed) in case the client is not stopped gracefully.
+const snapshotSavePeriod = 1 * time.Minute
+
+// identityFile is the client identity file format.
+type identityFile struct {
+	ClientId model.ClientId
+}
+
+// snapshotFile is the local snapshot file format.
+type snapshotFile struct {
+	ClientId model.ClientId
+	// Snapshot version
+	Version int
+	// model.ValueCodec name used to compare values
+	ValueCodec string
+	// Snapshot data
+	Data model.StorageList
+	// The latest client clock timestamp
+	Clock model.HLC
+}
+
+// saveSnapshot writes the current snapshot to the state directory (if set and changed since the last save).
+// Tentative operations are not saved (they are restored from the outbox).
+// Snapshot is only exported under the lock, it is encoded and written without blocking the API.
+func (c *Client) saveSnapshot() error {
+	if c.stateDir == "" || c.valueCodec == nil || c.snapshotVersion == c.savedVersion {
+		return nil
+	}
+
+	c.snapshotLock.Lock()
+	if _, err := c.rollbackTentative(); err != nil {
+		c.snapshotLock.Unlock()
+		return fmt.Errorf("rolling back tentative operations: %w", err)
+	}
+	file := snapshotFile{
+		ClientId:   c.id,
+		Version:    c.snapshotVersion,
+		ValueCodec: c.valueCodec.Name(),
+		Data:       c.snapshotData.Export(),
+		Clock:      c.clock.Last(),
+	}
+	_, err := c.replayTentative()
+	c.snapshotLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("%w: replaying tentative operations: %v", errLocalStateBroken, err)
+	}
+
+	if err := fileutil.WriteRecordFile(filepath.Join(c.stateDir, snapshotFileName), file); err != nil {
+		return err
+	}
+	c.savedVersion = file.Version
+	log.Printf("%s: snapshot v%d saved: %d items", c.String(), file.Version, len(file.Data))
+
+	return nil
+}
+
+// loadSnapshot reads the snapshot from the state directory (if set).
+// Returns false if there is no saved snapshot.
+func (c *Client) loadSnapshot() (bool, error) {
+	if c.stateDir == "" {
+		return false, nil
+	}
+
+	file := snapshotFile{}
+	found, err := readStateFile(filepath.Join(c.stateDir, snapshotFileName), &file)
+	if err != nil || !found {
+		return false, err
+	}
+	if file.ClientId != c.id {
+		return false, fmt.Errorf("snapshot belongs to client %d", file.ClientId)
+	}
+
+	codec, err := model.GetValueCodec(file.ValueCodec)
+	if err != nil {
+		return false, err
+	}
+	snapshotData, err := model.NewIndexedList(codec, file.Data)
+	if err != nil {
+		return false, fmt.Errorf("snapshot data: %w", err)
+	}
+	c.valueCodec = codec
+	c.snapshotVersion = file.Version
+	c.snapshotData = snapshotData
+	c.savedVersion = file.Version
+	c.observeClock(file.Clock)
+
+	return true, nil
+}
+
+// loadClientId returns the client ID persisted within the state directory (if set).
+// A random ID is generated (and persisted) if the ID is not set (0), the set one must match the persisted one.
+func loadClientId(id model.ClientId, stateDir string) (model.ClientId, error) {
+	filePath := ""
+	if stateDir != "" {
+		filePath = filepath.Join(stateDir, identityFileName)
+
+		file := identityFile{}
+		found, err := readStateFile(filePath, &file)
+		if err != nil {
+			return 0, fmt.Errorf("identity: %w", err)
+		}
+		if found {
+			if id != 0 && id != file.ClientId {
+				return 0, fmt.Errorf("identity: state directory belongs to client %d", file.ClientId)
+			}
+			return file.ClientId, nil
+		}
+	}
+
+	// Sequence numbers are tracked per client ID on the server, so IDs must not collide
+	for id == 0 {
+		buf := make([]byte, 4)
+		if _, err := rand.Read(buf); err != nil {
+			return 0, fmt.Errorf("identity: generating ID: %w", err)
+		}
+		id = model.ClientId(binary.BigEndian.Uint32(buf))
+	}
+
+	if filePath != "" {
+		if err := fileutil.WriteRecordFile(filePath, identityFile{ClientId: id}); err != nil {
+			return 0, fmt.Errorf("identity: %w", err)
+		}
+	}
+
+	return id, nil
+}
+
+// readStateFile reads the state file (refer to fileutil.ReadRecordFile).
+// Returns false if the file doesn't exist.
+func readStateFile(filePath string, v interface{}) (bool, error) {
+	err := fileutil.ReadRecordFile(filePath, v)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
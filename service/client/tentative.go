@@ -0,0 +1,183 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// tentativeOp is a client operation applied to the local snapshot before it is visible within the server snapshot.
+// Tentative operations are rolled back before a server diff is applied and replayed on top of it (if still pending).
+type tentativeOp struct {
+	op model.OperationRequest
+	// Committed version (0 - not acknowledged yet)
+	version int
+	// Operation was rejected / ignored by the server (dropped on the next rebase)
+	dropped bool
+	// List operations reverting the local effect (empty if the operation had no local effect)
+	undo []model.ListOperation
+}
+
+// addTentative applies a new client operation to the local snapshot.
+// Must be called with snapshotLock held.
+func (c *Client) addTentative(op model.OperationRequest) ([]model.ListOperation, error) {
+	c.tentativeOps = append(c.tentativeOps, tentativeOp{op: op})
+
+	return c.applyTentative(&c.tentativeOps[len(c.tentativeOps)-1])
+}
+
+// ackTentative updates the tentative operation state with the server ack.
+// Returns true if the operation is not tentative anymore: rejected / ignored or already visible within the snapshot
+// (the tentative layer should be rebased).
+// Must be called with snapshotLock held.
+func (c *Client) ackTentative(op model.OperationRequest, result model.OperationResult, version int) bool {
+	for i := range c.tentativeOps {
+		tOp := &c.tentativeOps[i]
+		if tOp.op.Timestamp != op.Timestamp {
+			continue
+		}
+
+		if result.Status == model.AppliedOperationStatus {
+			tOp.version = version
+			return version <= c.snapshotVersion
+		}
+		tOp.dropped = true
+		return true
+	}
+
+	return false
+}
+
+// settleTentative marks the operation with unknown result (a duplicate of a request handled long ago) as settled by the version:
+// its outcome (applied or not) is visible within the version snapshot.
+// Returns true if the snapshot already includes the version (the tentative layer should be rebased).
+// Must be called with snapshotLock held.
+func (c *Client) settleTentative(op model.OperationRequest, version int) bool {
+	for i := range c.tentativeOps {
+		tOp := &c.tentativeOps[i]
+		if tOp.op.Timestamp != op.Timestamp {
+			continue
+		}
+
+		tOp.version = version
+		return version <= c.snapshotVersion
+	}
+
+	return false
+}
+
+// rebaseTentative rolls back tentative operations, calls the upgrade function for the server state
+// and replays operations still pending on top of it.
+// Returns the list operations applied to the local snapshot (rollback, upgrade, replay).
+// Must be called with snapshotLock held.
+func (c *Client) rebaseTentative(upgradeFn func() ([]model.ListOperation, error)) ([]model.ListOperation, error) {
+	listOps, err := c.rollbackTentative()
+	if err != nil {
+		return nil, fmt.Errorf("%w: rollback: %v", errLocalStateBroken, err)
+	}
+
+	if upgradeFn != nil {
+		upgradeOps, err := upgradeFn()
+		if err != nil {
+			return nil, err
+		}
+		listOps = append(listOps, upgradeOps...)
+	}
+
+	replayOps, err := c.replayTentative()
+	if err != nil {
+		return nil, fmt.Errorf("%w: replay: %v", errLocalStateBroken, err)
+	}
+
+	return append(listOps, replayOps...), nil
+}
+
+// rollbackTentative reverts the local effect of all tentative operations (the snapshot matches the server version).
+// Must be called with snapshotLock held.
+func (c *Client) rollbackTentative() ([]model.ListOperation, error) {
+	listOps := make([]model.ListOperation, 0)
+	for i := len(c.tentativeOps) - 1; i >= 0; i-- {
+		tOp := &c.tentativeOps[i]
+		for j := len(tOp.undo) - 1; j >= 0; j-- {
+			listOps = append(listOps, tOp.undo[j])
+		}
+		tOp.undo = nil
+	}
+	if len(listOps) == 0 {
+		return listOps, nil
+	}
+
+	if err := c.snapshotData.Apply(listOps...); err != nil {
+		return nil, err
+	}
+
+	return listOps, nil
+}
+
+// replayTentative drops operations visible within the server snapshot (or rejected) and applies the rest.
+// Must be called with snapshotLock held.
+func (c *Client) replayTentative() ([]model.ListOperation, error) {
+	tOps := c.tentativeOps[:0]
+	for _, tOp := range c.tentativeOps {
+		if tOp.dropped || (tOp.version > 0 && tOp.version <= c.snapshotVersion) {
+			continue
+		}
+		tOps = append(tOps, tOp)
+	}
+	c.tentativeOps = tOps
+
+	listOps := make([]model.ListOperation, 0)
+	for i := range c.tentativeOps {
+		tOpListOps, err := c.applyTentative(&c.tentativeOps[i])
+		if err != nil {
+			return nil, err
+		}
+		listOps = append(listOps, tOpListOps...)
+	}
+
+	return listOps, nil
+}
+
+// applyTentative applies the operation local effect saving the undo operations.
+// Operation that would be rejected by the server (insert of an existing item, update / delete of a missing one) has no effect.
+// Must be called with snapshotLock held.
+func (c *Client) applyTentative(tOp *tentativeOp) ([]model.ListOperation, error) {
+	op := tOp.op
+	item := model.ListItem{Id: op.Id, Value: op.Value}
+	tOp.undo = nil
+
+	curItem, idx, found := c.snapshotData.Get(op.Id)
+
+	var listOp, undoOp model.ListOperation
+	switch {
+	case op.Type == model.DeleteOperationType && found:
+		listOp = model.ListOperation{Type: model.DeleteOperationType, Id: op.Id, Index: idx}
+		undoOp = model.ListOperation{Type: model.InsertOperationType, Id: op.Id, Index: idx, Value: curItem.Value}
+	case op.Type == model.DeleteOperationType:
+		return nil, nil
+	case op.Type == model.InsertOperationType && found:
+		return nil, nil
+	case op.Type == model.UpdateOperationType && !found:
+		return nil, nil
+	case !found:
+		// Insert / upsert of a new item
+		newIdx := c.snapshotData.Search(item)
+		listOp = model.ListOperation{Type: model.InsertOperationType, Id: op.Id, Index: newIdx, Value: op.Value}
+		undoOp = model.ListOperation{Type: model.DeleteOperationType, Id: op.Id, Index: newIdx}
+	default:
+		// Update / upsert of an existing item (the new index is calculated for the list without the item)
+		newIdx := c.snapshotData.Search(item)
+		if newIdx > idx {
+			newIdx--
+		}
+		listOp = model.ListOperation{Type: model.UpdateOperationType, Id: op.Id, Index: idx, NewIndex: newIdx, Value: op.Value}
+		undoOp = model.ListOperation{Type: model.UpdateOperationType, Id: op.Id, Index: newIdx, NewIndex: idx, Value: curItem.Value}
+	}
+
+	if err := c.snapshotData.Apply(listOp); err != nil {
+		return nil, err
+	}
+	tOp.undo = []model.ListOperation{undoOp}
+
+	return []model.ListOperation{listOp}, nil
+}
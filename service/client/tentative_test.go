@@ -0,0 +1,159 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// newTestTentativeClient creates an offline Client object with the snapshot version set.
+func newTestTentativeClient(t *testing.T, version int, list model.StorageList) *Client {
+	c := newTestClient(t, "127.0.0.1:1")
+
+	snapshotData, err := model.NewIndexedList(testCodec, list)
+	require.NoError(t, err)
+	c.valueCodec, c.snapshotVersion, c.snapshotData = testCodec, version, snapshotData
+
+	return c
+}
+
+// Test rolls back tentative operations on a server update and replays them on top of it.
+func Test_Client_TentativeRebase(t *testing.T) {
+	idA, idB, idC := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	newItem := func(id string, v int32) model.ListItem {
+		return model.ListItem{Id: id, Value: model.NewInt32Value(v)}
+	}
+	c := newTestTentativeClient(t, 1, model.StorageList{newItem(idA, 1), newItem(idB, 5)})
+
+	// Local changes
+	c.snapshotLock.Lock()
+	insertOp := model.OperationRequest{Type: model.InsertOperationType, Id: idC, Value: model.NewInt32Value(3), Timestamp: c.clock.Now()}
+	_, err := c.addTentative(insertOp)
+	require.NoError(t, err)
+	updateOp := model.OperationRequest{Type: model.UpdateOperationType, Id: idB, Value: model.NewInt32Value(0), Timestamp: c.clock.Now()}
+	_, err = c.addTentative(updateOp)
+	require.NoError(t, err)
+	deleteOp := model.OperationRequest{Type: model.DeleteOperationType, Id: idA, Timestamp: c.clock.Now()}
+	_, err = c.addTentative(deleteOp)
+	require.NoError(t, err)
+	c.snapshotLock.Unlock()
+	require.Equal(t, model.StorageList{newItem(idB, 0), newItem(idC, 3)}, exportSnapshot(c))
+
+	// Remote update (another client deletes B and updates A): local operations are replayed on top of it,
+	// the update of the deleted item has no local effect
+	require.NoError(t, c.applyUpdates(2, []model.ListOperation{
+		{Type: model.DeleteOperationType, Id: idB, Index: 1},
+		{Type: model.UpdateOperationType, Id: idA, Index: 0, NewIndex: 0, Value: model.NewInt32Value(2)},
+	}, model.StorageList{newItem(idA, 2)}.Checksum(), time.Now()))
+	require.Equal(t, 2, c.Version())
+	require.Equal(t, model.StorageList{newItem(idC, 3)}, exportSnapshot(c))
+	require.Len(t, c.tentativeOpsCopy(), 3)
+	require.Empty(t, c.tentativeOps[1].undo)
+
+	// Rollback brings the server state back
+	c.snapshotLock.Lock()
+	_, err = c.rollbackTentative()
+	require.NoError(t, err)
+	require.Equal(t, model.StorageList{newItem(idA, 2)}, c.snapshotData.Export())
+	_, err = c.replayTentative()
+	require.NoError(t, err)
+	c.snapshotLock.Unlock()
+	require.Equal(t, model.StorageList{newItem(idC, 3)}, exportSnapshot(c))
+
+	// Applied operations are acked with a version not received yet: they stay tentative until the snapshot includes it
+	c.snapshotLock.Lock()
+	applied := model.OperationResult{Status: model.AppliedOperationStatus}
+	require.False(t, c.ackTentative(insertOp, applied, 3))
+	require.False(t, c.ackTentative(deleteOp, applied, 3))
+	require.True(t, c.ackTentative(updateOp, model.OperationResult{Status: model.RejectedOperationStatus, ErrorCode: model.ItemNotFoundErrorCode}, 3))
+	_, err = c.rebaseTentative(nil)
+	require.NoError(t, err)
+	c.snapshotLock.Unlock()
+	require.Len(t, c.tentativeOpsCopy(), 2)
+	require.Equal(t, model.StorageList{newItem(idC, 3)}, exportSnapshot(c))
+
+	serverList := model.StorageList{newItem(idC, 3)}
+	require.NoError(t, c.applyUpdates(3, []model.ListOperation{
+		{Type: model.DeleteOperationType, Id: idA, Index: 0},
+		{Type: model.InsertOperationType, Id: idC, Index: 0, Value: model.NewInt32Value(3)},
+	}, serverList.Checksum(), time.Now()))
+	require.Empty(t, c.tentativeOpsCopy())
+	require.Equal(t, serverList, exportSnapshot(c))
+}
+
+// Test reverts the local effect of operations rejected / ignored by the server.
+func Test_Client_TentativeRejected(t *testing.T) {
+	idA, idB := uuid.New().String(), uuid.New().String()
+	serverList := model.StorageList{{Id: idA, Value: model.NewInt32Value(1)}}
+	c := newTestTentativeClient(t, 1, serverList)
+
+	c.snapshotLock.Lock()
+	defer c.snapshotLock.Unlock()
+
+	updateOp := model.OperationRequest{Type: model.UpdateOperationType, Id: idA, Value: model.NewInt32Value(7), Timestamp: c.clock.Now()}
+	_, err := c.addTentative(updateOp)
+	require.NoError(t, err)
+	insertOp := model.OperationRequest{Type: model.InsertOperationType, Id: idB, Value: model.NewInt32Value(0), Timestamp: c.clock.Now()}
+	_, err = c.addTentative(insertOp)
+	require.NoError(t, err)
+	require.Equal(t, 2, c.snapshotData.Len())
+
+	// Unknown operation
+	otherOp := model.OperationRequest{Type: model.DeleteOperationType, Id: idA, Timestamp: c.clock.Now()}
+	require.False(t, c.ackTentative(otherOp, model.OperationResult{Status: model.IgnoredOperationStatus}, 2))
+
+	// Rejected insert is reverted, the update stays
+	require.True(t, c.ackTentative(insertOp, model.OperationResult{Status: model.RejectedOperationStatus, ErrorCode: model.ItemExistsErrorCode}, 2))
+	listOps, err := c.rebaseTentative(nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.ListOperation{
+		{Type: model.DeleteOperationType, Id: idB, Index: 0},
+		{Type: model.UpdateOperationType, Id: idA, Index: 0, NewIndex: 0, Value: model.NewInt32Value(1)},
+		{Type: model.UpdateOperationType, Id: idA, Index: 0, NewIndex: 0, Value: model.NewInt32Value(7)},
+	}, listOps)
+	require.Equal(t, model.StorageList{{Id: idA, Value: model.NewInt32Value(7)}}, c.snapshotData.Export())
+
+	// Ignored update is reverted
+	require.True(t, c.ackTentative(updateOp, model.OperationResult{Status: model.IgnoredOperationStatus}, 2))
+	_, err = c.rebaseTentative(nil)
+	require.NoError(t, err)
+	require.Empty(t, c.tentativeOps)
+	require.Equal(t, serverList, c.snapshotData.Export())
+}
+
+// Test settles operations of a duplicate request with unknown results by the version acked.
+func Test_Client_TentativeDuplicateAck(t *testing.T) {
+	idA, idB := uuid.New().String(), uuid.New().String()
+	c := newTestTentativeClient(t, 3, model.StorageList{})
+
+	c.snapshotLock.Lock()
+	opA := model.OperationRequest{Type: model.InsertOperationType, Id: idA, Value: model.NewInt32Value(1), Timestamp: c.clock.Now()}
+	_, err := c.addTentative(opA)
+	require.NoError(t, err)
+	opB := model.OperationRequest{Type: model.InsertOperationType, Id: idB, Value: model.NewInt32Value(2), Timestamp: c.clock.Now()}
+	_, err = c.addTentative(opB)
+	require.NoError(t, err)
+
+	// Settled by the version already received: the outcome is visible within the snapshot (A was not applied)
+	require.True(t, c.settleTentative(opA, 2))
+	// Settled by a version not received yet
+	require.False(t, c.settleTentative(opB, 4))
+	_, err = c.rebaseTentative(nil)
+	require.NoError(t, err)
+	require.Len(t, c.tentativeOps, 1)
+	require.Equal(t, opB, c.tentativeOps[0].op)
+	require.Equal(t, model.StorageList{{Id: idB, Value: model.NewInt32Value(2)}}, c.snapshotData.Export())
+	c.snapshotLock.Unlock()
+
+	// Version received: B is visible within it and is not tentative anymore
+	serverList := model.StorageList{{Id: idB, Value: model.NewInt32Value(2)}}
+	require.NoError(t, c.applyUpdates(4, []model.ListOperation{
+		{Type: model.InsertOperationType, Id: idB, Index: 0, Value: model.NewInt32Value(2)},
+	}, serverList.Checksum(), time.Now()))
+	require.Empty(t, c.tentativeOpsCopy())
+	require.Equal(t, serverList, exportSnapshot(c))
+}
@@ -0,0 +1,180 @@
+package generator
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/itiky/collaborate-storage/model"
+	"github.com/itiky/collaborate-storage/service/client"
+)
+
+// Generator produces random list operations using the client API (load generator).
+// Consistency duration (from the first applied ack till the snapshot includes all the applied operations) is tracked using the client change events.
+type Generator struct {
+	// Config
+	opsPeriod time.Duration // operations generation period
+	opsMax    int           // max number of operations per period
+	// State
+	sendOpsLock sync.Mutex
+	sendOps     map[string]int // applied operations which are not yet visible within the snapshot (match string -> committed version)
+	//
+	client      *client.Client
+	unsubscribe func()
+	stopCh      chan interface{}
+}
+
+// Start starts the Generator worker.
+func (g *Generator) Start() {
+	if g.stopCh != nil {
+		return
+	}
+	g.stopCh = make(chan interface{})
+
+	monitor.Start()
+	g.unsubscribe = g.client.Subscribe(g.handleChange)
+	go g.worker()
+}
+
+// Stop stops the Generator worker.
+func (g *Generator) Stop() {
+	if g.stopCh == nil {
+		return
+	}
+
+	close(g.stopCh)
+	g.unsubscribe()
+	monitor.Stop()
+}
+
+// worker does the actual job.
+func (g *Generator) worker() {
+	tickCh := time.Tick(g.opsPeriod)
+	for {
+		select {
+		case <-g.stopCh:
+			return
+		case <-tickCh:
+			if err := g.generate(); err != nil {
+				log.Printf("Generator: %v", err)
+			}
+		}
+	}
+}
+
+// generate queues a random number of random insert / update / delete operations.
+// Updated / deleted items are picked from the client snapshot, nothing is generated until it is received.
+func (g *Generator) generate() error {
+	codec := g.client.ValueCodec()
+	if codec == nil {
+		return nil
+	}
+
+	// Pick a random item (snapshot might be changed concurrently, so the index might be outdated)
+	getIdFromSnapshot := func() (string, bool) {
+		n := g.client.Len()
+		if n == 0 {
+			return "", false
+		}
+		item, found := g.client.At(rand.Intn(n))
+		return item.Id, found
+	}
+
+	deletedIds := make(map[string]bool)
+	opsN := rand.Intn(g.opsMax) + 1
+	for i := 0; i < opsN; i++ {
+		switch rand.Intn(3) {
+		case 0:
+			if _, err := g.client.Insert(codec.Random()); err != nil {
+				return fmt.Errorf("insert: %w", err)
+			}
+		case 1:
+			itemId, found := getIdFromSnapshot()
+			if !found {
+				continue
+			}
+			if err := g.client.Update(itemId, codec.Random()); err != nil {
+				return fmt.Errorf("update: %w", err)
+			}
+		case 2:
+			// Check if this delete is not a duplicate
+			itemId, found := getIdFromSnapshot()
+			if !found || deletedIds[itemId] {
+				continue
+			}
+			deletedIds[itemId] = true
+
+			if err := g.client.Delete(itemId); err != nil {
+				return fmt.Errorf("delete: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// handleChange tracks the generated operations acked by the server until they are visible within the snapshot.
+func (g *Generator) handleChange(event client.ChangeEvent) {
+	g.sendOpsLock.Lock()
+	defer g.sendOpsLock.Unlock()
+
+	now := time.Now()
+	sendOpsPrevLen, appliedCnt := len(g.sendOps), 0
+	for _, ack := range event.Acks {
+		if ack.Result.Status != model.AppliedOperationStatus {
+			continue
+		}
+		g.sendOps[operationToMatchStr(ack.Operation)] = ack.Version
+		appliedCnt++
+	}
+	if appliedCnt > 0 {
+		monitor.OpsApplied(appliedCnt)
+		if sendOpsPrevLen == 0 {
+			monitor.ConsistencyReset(now)
+		}
+	}
+
+	// Drop operations included into the snapshot version
+	if len(g.sendOps) == 0 {
+		return
+	}
+	for sendOpStr, version := range g.sendOps {
+		if version <= event.Version {
+			delete(g.sendOps, sendOpStr)
+		}
+	}
+	if len(g.sendOps) == 0 {
+		monitor.ConsistencyAchieved(now)
+	}
+}
+
+// operationToMatchStr builds a string representation of model.OperationRequest (used for sendOps matching).
+func operationToMatchStr(op model.OperationRequest) string {
+	if op.Type == model.DeleteOperationType {
+		return fmt.Sprintf("%s: %s", op.Type, op.Id)
+	}
+
+	return fmt.Sprintf("%s: %s -> %x", op.Type, op.Id, op.Value)
+}
+
+// NewGenerator creates a new Generator object.
+func NewGenerator(c *client.Client, opsPeriod time.Duration, opsMax int) (*Generator, error) {
+	if c == nil {
+		return nil, fmt.Errorf("%s: nil", "client")
+	}
+	if opsPeriod <= 0 {
+		return nil, fmt.Errorf("%s: must be GT 0", "opsPeriod")
+	}
+	if opsMax < 1 {
+		return nil, fmt.Errorf("%s: must be GTE 1", "opsMax")
+	}
+
+	return &Generator{
+		opsPeriod: opsPeriod,
+		opsMax:    opsMax,
+		sendOps:   make(map[string]int),
+		client:    c,
+	}, nil
+}
@@ -0,0 +1,27 @@
+package generator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// Test builds distinct match strings for all the operation types.
+func Test_OperationToMatchStr(t *testing.T) {
+	id, value := "a3bb189e-8bf9-3888-9912-ace4e6543002", model.StorageValue{0, 0, 0, 1}
+
+	matchStrs := make(map[string]bool)
+	for _, opType := range []model.OperationType{model.InsertOperationType, model.UpdateOperationType, model.UpsertOperationType, model.DeleteOperationType} {
+		matchStr := operationToMatchStr(model.OperationRequest{Type: opType, Id: id, Value: value})
+		require.NotEmpty(t, matchStr, opType)
+		matchStrs[matchStr] = true
+	}
+	require.Len(t, matchStrs, 4)
+
+	require.NotEqual(t,
+		operationToMatchStr(model.OperationRequest{Type: model.UpsertOperationType, Id: id, Value: value}),
+		operationToMatchStr(model.OperationRequest{Type: model.UpsertOperationType, Id: id, Value: model.StorageValue{0, 0, 0, 2}}),
+	)
+}
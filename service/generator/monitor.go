@@ -0,0 +1,92 @@
+package generator
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	movingaverage "github.com/RobinUS2/golang-moving-average"
+)
+
+var monitor *Monitor
+
+// Monitor keeps Generator stats.
+type Monitor struct {
+	sync.Mutex
+	consistencyDur   *movingaverage.MovingAverage
+	opsApplied       int
+	consistencyReset time.Time
+	stopCh           chan struct{}
+}
+
+func (m *Monitor) OpsApplied(count int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.opsApplied += count
+}
+
+func (m *Monitor) ConsistencyReset(ts time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.consistencyReset = ts
+}
+
+func (m *Monitor) ConsistencyAchieved(ts time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	dur := ts.Sub(m.consistencyReset)
+	m.consistencyDur.Add(float64(dur/time.Microsecond) / 1000.0)
+}
+
+// Start starts the Monitor worker.
+func (m *Monitor) Start() {
+	if m.stopCh != nil {
+		return
+	}
+
+	m.stopCh = make(chan struct{})
+	go m.worker()
+}
+
+// Stop stops the Monitor worker.
+func (m *Monitor) Stop() {
+	if m.stopCh == nil {
+		return
+	}
+
+	close(m.stopCh)
+}
+
+// worker does the actual job.
+func (m *Monitor) worker() {
+	const period = 5 * time.Second
+
+	tickCh := time.Tick(period)
+	for {
+		select {
+		case <-m.stopCh:
+			// Stop the monitor
+			return
+		case <-tickCh:
+			// Print the report
+			m.Lock()
+
+			opsAppliedPerSec := float64(m.opsApplied) / (float64(period) / float64(time.Second))
+			log.Printf("Generator monitor:")
+			log.Printf("  - Applied ops / s:         %.2f", opsAppliedPerSec)
+			log.Printf("  - Consistancy dur [ms]:    %.2f", m.consistencyDur.Avg())
+			m.opsApplied = 0
+
+			m.Unlock()
+		}
+	}
+}
+
+func init() {
+	monitor = &Monitor{
+		consistencyDur: movingaverage.New(3),
+	}
+}
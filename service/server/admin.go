@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// AdminService implements an admin RPC server service.
+// Requests are expensive / change the history, so the service is served on a separate (non-public) listener.
+type AdminService struct {
+	svc *SortedListService
+	// Previous versions are built one at a time (every build loads a base state and replays the history)
+	buildLock sync.Mutex
+}
+
+// GetListAtVersion returns a storage snapshot of a previous version.
+func (s *AdminService) GetListAtVersion(req model.GetListAtVersionRequest, res *model.GetListAtVersionResponse) error {
+	s.buildLock.Lock()
+	defer s.buildLock.Unlock()
+
+	st, err := s.svc.docHistory.BuildStorage(req.Version)
+	if err != nil {
+		return fmt.Errorf("building storage: %w", err)
+	}
+	res.Version = req.Version
+	res.ValueCodec = st.ValueCodec().Name()
+	res.Data = st.Export()
+
+	return nil
+}
+
+// SquashVersions merges a range of document versions into one.
+// Push subscribers are notified to request updates (clients within the range must resync).
+func (s *AdminService) SquashVersions(req model.SquashVersionsRequest, res *model.SquashVersionsResponse) error {
+	if err := s.svc.docHistory.Squash(req.FromVersion, req.ToVersion); err != nil {
+		return fmt.Errorf("squash: %w", err)
+	}
+	log.Printf("AdminService: versions [v%d, v%d] squashed", req.FromVersion, req.ToVersion)
+	s.svc.publishResync()
+
+	res.LatestVersion = s.svc.docHistory.GetLatestVersion()
+
+	return nil
+}
+
+// RemoveVersion removes a document version rebuilding the later ones.
+// Push subscribers are notified to request updates (clients with a rebuilt version must resync).
+func (s *AdminService) RemoveVersion(req model.RemoveVersionRequest, res *model.RemoveVersionResponse) error {
+	if err := s.svc.docHistory.RemoveVersion(req.Version); err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+	log.Printf("AdminService: version v%d removed", req.Version)
+	s.svc.publishResync()
+
+	res.LatestVersion = s.svc.docHistory.GetLatestVersion()
+
+	return nil
+}
+
+// ReplaceVersion replaces a document version operations rebuilding it and the later ones.
+// Push subscribers are notified to request updates (clients with a rebuilt version must resync).
+func (s *AdminService) ReplaceVersion(req model.ReplaceVersionRequest, res *model.ReplaceVersionResponse) error {
+	stOps, err := s.svc.newStorageOperations(0, req.Operations)
+	if err != nil {
+		return err
+	}
+	if err := s.svc.docHistory.ReplaceVersion(req.Version, stOps...); err != nil {
+		return fmt.Errorf("replace: %w", err)
+	}
+	log.Printf("AdminService: version v%d replaced (%d operations)", req.Version, len(stOps))
+	s.svc.publishResync()
+
+	res.LatestVersion = s.svc.docHistory.GetLatestVersion()
+
+	return nil
+}
+
+// NewAdminService creates a new AdminService object.
+func NewAdminService(svc *SortedListService) (*AdminService, error) {
+	if svc == nil {
+		return nil, fmt.Errorf("%s: nil", "svc")
+	}
+
+	return &AdminService{
+		svc: svc,
+	}, nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// Test notifies push subscribers to resync once the history is rewritten.
+func Test_AdminService_Rewrite(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rewrite func(a *AdminService, v1, v2 int) (int, error)
+	}{
+		{
+			name: "squash",
+			rewrite: func(a *AdminService, v1, v2 int) (int, error) {
+				res := model.SquashVersionsResponse{}
+				err := a.SquashVersions(model.SquashVersionsRequest{FromVersion: v1, ToVersion: v2}, &res)
+				return res.LatestVersion, err
+			},
+		},
+		{
+			name: "remove",
+			rewrite: func(a *AdminService, v1, v2 int) (int, error) {
+				res := model.RemoveVersionResponse{}
+				err := a.RemoveVersion(model.RemoveVersionRequest{Version: v1}, &res)
+				return res.LatestVersion, err
+			},
+		},
+		{
+			name: "replace",
+			rewrite: func(a *AdminService, v1, v2 int) (int, error) {
+				res := model.ReplaceVersionResponse{}
+				err := a.ReplaceVersion(model.ReplaceVersionRequest{
+					Version: v1,
+					Operations: []model.OperationRequest{
+						{Type: model.InsertOperationType, Id: uuid.New().String(), Value: testCodec.Random()},
+					},
+				}, &res)
+				return res.LatestVersion, err
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestService(t, Config{})
+			a, err := NewAdminService(s)
+			require.NoError(t, err)
+
+			v1 := commitTestVersion(t, s, 2)
+			v2 := commitTestVersion(t, s, 2)
+			sub := s.pushHub.subscribe(1)
+
+			latestVersion, err := tc.rewrite(a, v1, v2)
+			require.NoError(t, err)
+			require.Equal(t, s.docHistory.GetLatestVersion(), latestVersion)
+
+			events, dropped := sub.pop()
+			require.False(t, dropped)
+			require.Equal(t, []model.ListUpdateEvent{{Version: latestVersion, ResyncRequired: true}}, events)
+
+			// Failed rewrite publishes nothing
+			_, err = tc.rewrite(a, 1000, 1001)
+			require.Error(t, err)
+			events, _ = sub.pop()
+			require.Empty(t, events)
+		})
+	}
+
+	// Invalid operations are rejected
+	s := newTestService(t, Config{})
+	a, err := NewAdminService(s)
+	require.NoError(t, err)
+	v1 := commitTestVersion(t, s, 2)
+	err = a.ReplaceVersion(model.ReplaceVersionRequest{
+		Version:    v1,
+		Operations: []model.OperationRequest{{Type: model.InsertOperationType, Id: "abc", Value: testCodec.Random()}},
+	}, &model.ReplaceVersionResponse{})
+	_, ok := model.ParseInvalidRequestError(err)
+	require.True(t, ok)
+}
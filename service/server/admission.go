@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+type (
+	// AdmissionPolicy defines UpdateList requests limits.
+	// Zero values disable the corresponding rule.
+	AdmissionPolicy struct {
+		// Max number of operations per request
+		MaxRequestOps int
+		// Max number of operations queued (not committed yet)
+		MaxQueueOps int
+		// Per-client operations rate limit [ops/s]
+		ClientRate float64
+		// Per-client operations burst (token bucket size)
+		ClientBurst int
+	}
+
+	// rateLimiter implements the per-client token bucket rate limiter.
+	rateLimiter struct {
+		sync.Mutex
+		rate    float64
+		burst   float64
+		buckets map[model.ClientId]*tokenBucket
+	}
+
+	// tokenBucket keeps a client tokens state.
+	tokenBucket struct {
+		tokens    float64
+		updatedAt time.Time
+	}
+)
+
+// Validate validates the policy.
+func (p AdmissionPolicy) Validate() error {
+	if p.MaxRequestOps < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "MaxRequestOps")
+	}
+	if p.MaxQueueOps < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "MaxQueueOps")
+	}
+	if p.MaxQueueOps > 0 && p.MaxRequestOps > p.MaxQueueOps {
+		return fmt.Errorf("%s: must be GTE MaxRequestOps", "MaxQueueOps")
+	}
+	if p.ClientRate < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "ClientRate")
+	}
+	if p.ClientRate > 0 {
+		if p.ClientBurst <= 0 {
+			return fmt.Errorf("%s: must be GT 0", "ClientBurst")
+		}
+		// Request larger than the bucket would never be admitted
+		if p.MaxRequestOps <= 0 {
+			return fmt.Errorf("%s: must be GT 0 (ClientRate is set)", "MaxRequestOps")
+		}
+		if p.MaxRequestOps > p.ClientBurst {
+			return fmt.Errorf("%s: must be GTE MaxRequestOps", "ClientBurst")
+		}
+	}
+
+	return nil
+}
+
+// take takes n tokens from the client bucket.
+// Returns 0 on success or the duration to wait for the tokens to be refilled.
+// Error is returned if n exceeds the bucket size (tokens would never be refilled).
+func (l *rateLimiter) take(clientId model.ClientId, n int, now time.Time) (time.Duration, error) {
+	if float64(n) > l.burst {
+		return 0, fmt.Errorf("%d operations: must be LTE client burst %d", n, int(l.burst))
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	bucket, found := l.buckets[clientId]
+	if !found {
+		bucket = &tokenBucket{tokens: l.burst, updatedAt: now}
+		l.buckets[clientId] = bucket
+	}
+
+	// Refill
+	if elapsed := now.Sub(bucket.updatedAt); elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed.Seconds()*l.rate)
+		bucket.updatedAt = now
+	}
+
+	if lack := float64(n) - bucket.tokens; lack > 0 {
+		return time.Duration(math.Ceil(lack / l.rate * float64(time.Second))), nil
+	}
+	bucket.tokens -= float64(n)
+
+	return 0, nil
+}
+
+// refund returns n tokens taken for a request that wasn't queued.
+func (l *rateLimiter) refund(clientId model.ClientId, n int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if bucket, found := l.buckets[clientId]; found {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+float64(n))
+	}
+}
+
+// prune drops buckets refilled by now (an idle client gets a full bucket anyway).
+func (l *rateLimiter) prune(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	for clientId, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, clientId)
+		}
+	}
+}
+
+// newRateLimiter creates a new rateLimiter object (nil if rate is not set).
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[model.ClientId]*tokenBucket),
+	}
+}
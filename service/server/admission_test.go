@@ -0,0 +1,210 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// Test takes, refills, refunds and prunes client tokens.
+func Test_RateLimiter(t *testing.T) {
+	const clientId = model.ClientId(1)
+	now := time.Now()
+
+	type step struct {
+		// Action: take, refund or prune
+		action string
+		at     time.Duration
+		n      int
+		// Expected take result / prune result (bucket is kept)
+		retryAfter time.Duration
+		err        bool
+		kept       bool
+	}
+
+	testCases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "burst rejection",
+			steps: []step{
+				{action: "take", n: 20},
+				{action: "take", n: 1, retryAfter: 100 * time.Millisecond},
+				{action: "take", n: 5, retryAfter: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "request larger than burst",
+			steps: []step{
+				{action: "take", n: 21, err: true},
+				{action: "take", n: 20},
+			},
+		},
+		{
+			name: "refill",
+			steps: []step{
+				{action: "take", n: 20},
+				{action: "take", at: time.Second, n: 10},
+				{action: "take", at: time.Second, n: 1, retryAfter: 100 * time.Millisecond},
+				{action: "take", at: 10 * time.Second, n: 20},
+			},
+		},
+		{
+			name: "refund",
+			steps: []step{
+				{action: "take", n: 20},
+				{action: "refund", n: 5},
+				{action: "take", n: 5},
+				{action: "take", n: 1, retryAfter: 100 * time.Millisecond},
+			},
+		},
+		{
+			name: "refund is capped by burst",
+			steps: []step{
+				{action: "take", n: 5},
+				{action: "refund", n: 100},
+				{action: "take", n: 20},
+				{action: "take", n: 1, retryAfter: 100 * time.Millisecond},
+			},
+		},
+		{
+			name: "idle pruning",
+			steps: []step{
+				{action: "take", n: 20},
+				{action: "prune", at: time.Second, kept: true},
+				{action: "prune", at: 2 * time.Second},
+				{action: "take", at: 2 * time.Second, n: 20},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newRateLimiter(10, 20)
+			for i, s := range tc.steps {
+				switch s.action {
+				case "take":
+					retryAfter, err := l.take(clientId, s.n, now.Add(s.at))
+					if s.err {
+						require.Error(t, err, "step %d", i)
+						continue
+					}
+					require.NoError(t, err, "step %d", i)
+					require.Equal(t, s.retryAfter, retryAfter, "step %d", i)
+				case "refund":
+					l.refund(clientId, s.n)
+				case "prune":
+					l.prune(now.Add(s.at))
+					_, found := l.buckets[clientId]
+					require.Equal(t, s.kept, found, "step %d", i)
+				}
+			}
+		})
+	}
+
+	require.Nil(t, newRateLimiter(0, 10))
+}
+
+// Test admits requests within the queue / rate limits and releases reservations of requests not queued.
+func Test_SortedListService_Admit(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy AdmissionPolicy
+		// Requests ops count, expected busy (true) or admitted (false) result
+		ops  []int
+		busy []bool
+		// Expected queued ops after
+		queuedOps int64
+	}{
+		{
+			name:      "disabled",
+			ops:       []int{1000, 1000},
+			busy:      []bool{false, false},
+			queuedOps: 2000,
+		},
+		{
+			name:      "queue is full",
+			policy:    AdmissionPolicy{MaxRequestOps: 10, MaxQueueOps: 15},
+			ops:       []int{10, 6, 5},
+			busy:      []bool{false, true, false},
+			queuedOps: 15,
+		},
+		{
+			name:      "client burst",
+			policy:    AdmissionPolicy{MaxRequestOps: 10, ClientRate: 1, ClientBurst: 15},
+			ops:       []int{10, 6, 5},
+			busy:      []bool{false, true, false},
+			queuedOps: 15,
+		},
+		{
+			name:      "full queue doesn't take tokens",
+			policy:    AdmissionPolicy{MaxRequestOps: 10, MaxQueueOps: 10, ClientRate: 1, ClientBurst: 20},
+			ops:       []int{10, 10},
+			busy:      []bool{false, true},
+			queuedOps: 10,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.policy.Validate())
+			s := &SortedListService{
+				batchPeriod:     time.Second,
+				admissionPolicy: tc.policy,
+				rateLimiter:     newRateLimiter(tc.policy.ClientRate, tc.policy.ClientBurst),
+			}
+
+			for i, n := range tc.ops {
+				err := s.admit(1, n)
+				if !tc.busy[i] {
+					require.NoError(t, err, "request %d", i)
+					continue
+				}
+				busyErr, ok := model.ParseBusyError(err)
+				require.True(t, ok, "request %d: %v", i, err)
+				require.True(t, busyErr.RetryAfter > 0, "request %d", i)
+			}
+			require.Equal(t, tc.queuedOps, s.queuedOps)
+
+			// Release returns the queue space and the tokens
+			s.release(1, int(tc.queuedOps))
+			require.Equal(t, int64(0), s.queuedOps)
+			if s.rateLimiter != nil {
+				retryAfter, err := s.rateLimiter.take(1, int(tc.queuedOps), time.Now())
+				require.NoError(t, err)
+				require.Equal(t, time.Duration(0), retryAfter)
+			}
+		})
+	}
+}
+
+// Test refunds the client tokens if the request can't be queued.
+func Test_SortedListService_UpdateListQueueFull(t *testing.T) {
+	s := newTestService(t, Config{
+		AdmissionPolicy: AdmissionPolicy{MaxRequestOps: 10, ClientRate: 0.001, ClientBurst: 10},
+	})
+
+	req := model.UpdateListRequest{ClientId: 1, Sequence: 1}
+	for i := 0; i < 10; i++ {
+		req.Operations = append(req.Operations, model.OperationRequest{
+			Type:  model.InsertOperationType,
+			Id:    uuid.New().String(),
+			Value: testCodec.Random(),
+		})
+	}
+
+	// The worker is not started: the operations channel is full
+	err := s.UpdateList(req, &model.UpdateListResponse{})
+	busyErr, ok := model.ParseBusyError(err)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, s.batchPeriod, busyErr.RetryAfter)
+	require.Equal(t, int64(0), s.queuedOps)
+
+	// Tokens are refunded: the retry is admitted
+	require.NoError(t, s.admit(1, 10))
+}
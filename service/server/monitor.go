@@ -15,6 +15,7 @@ type Monitor struct {
 	sync.Mutex
 	opsHandled  int
 	diffHandled int
+	reqsBusy    int
 	diffReqDur  *movingaverage.MovingAverage
 	stopCh      chan struct{}
 }
@@ -27,6 +28,14 @@ func (m *Monitor) OpsHandled(count int) {
 	m.opsHandled += count
 }
 
+// RequestBusy increments the update requests rejected by the admission control metric.
+func (m *Monitor) RequestBusy() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.reqsBusy++
+}
+
 // DiffRequestServed updates the service.GetListUpdates handling duration metric.
 func (m *Monitor) DiffRequestServed(dur time.Duration) {
 	m.Lock()
@@ -43,7 +52,7 @@ func (m *Monitor) Start() {
 	}
 
 	m.stopCh = make(chan struct{})
-	go m.worker()
+	go m.worker(m.stopCh)
 }
 
 // Stop stops the Monitor worker.
@@ -53,16 +62,17 @@ func (m *Monitor) Stop() {
 	}
 
 	close(m.stopCh)
+	m.stopCh = nil
 }
 
-// worker does the actual job.
-func (m *Monitor) worker() {
+// worker does the actual job (until stopCh is closed).
+func (m *Monitor) worker(stopCh <-chan struct{}) {
 	const period = 5 * time.Second
 
 	tickCh := time.Tick(period)
 	for {
 		select {
-		case <-m.stopCh:
+		case <-stopCh:
 			// Stop the monitor
 			return
 		case <-tickCh:
@@ -71,12 +81,15 @@ func (m *Monitor) worker() {
 
 			updsPerSec := float64(m.opsHandled) / (float64(period) / float64(time.Second))
 			diffsPerSec := float64(m.diffHandled) / (float64(period) / float64(time.Second))
+			busyPerSec := float64(m.reqsBusy) / (float64(period) / float64(time.Second))
 			log.Printf("Monitor:")
 			log.Printf("  - Storate updates / s:   %.2f", updsPerSec)
 			log.Printf("  - Diff requests / s:     %.2f", diffsPerSec)
 			log.Printf("  - Diff request dur [ms]: %.2f", m.diffReqDur.Avg())
+			log.Printf("  - Busy responses / s:    %.2f", busyPerSec)
 			m.opsHandled = 0
 			m.diffHandled = 0
+			m.reqsBusy = 0
 
 			m.Unlock()
 		}
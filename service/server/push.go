@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+const (
+	// Subscribe request read timeout
+	pushHandshakeTimeout = 5 * time.Second
+	// Event write timeout (subscriber is dropped on timeout)
+	pushWriteTimeout = 5 * time.Second
+)
+
+type (
+	// pushHub keeps the list updates subscribers.
+	pushHub struct {
+		sync.Mutex
+		// Max number of events buffered per subscriber
+		bufferSize  int
+		subscribers map[*pushSubscriber]bool
+	}
+
+	// pushSubscriber keeps a subscriber events queue.
+	// Queue overflow drops all the buffered events: subscriber gets a single ResyncRequired event instead.
+	pushSubscriber struct {
+		sync.Mutex
+		clientId model.ClientId
+		queue    []model.ListUpdateEvent
+		dropped  bool
+		// Queue update signal
+		signalCh chan struct{}
+	}
+)
+
+// Publish pushes the event to all the subscribers queues.
+func (h *pushHub) Publish(event model.ListUpdateEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	for sub := range h.subscribers {
+		sub.push(event, h.bufferSize)
+	}
+}
+
+// subscribe adds a new subscriber.
+func (h *pushHub) subscribe(clientId model.ClientId) *pushSubscriber {
+	h.Lock()
+	defer h.Unlock()
+
+	sub := &pushSubscriber{
+		clientId: clientId,
+		signalCh: make(chan struct{}, 1),
+	}
+	h.subscribers[sub] = true
+
+	return sub
+}
+
+// unsubscribe removes the subscriber.
+func (h *pushHub) unsubscribe(sub *pushSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.subscribers, sub)
+}
+
+// push adds the event to the queue (drops the queue on overflow).
+func (s *pushSubscriber) push(event model.ListUpdateEvent, bufferSize int) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case s.dropped:
+		return
+	case len(s.queue) >= bufferSize:
+		s.queue, s.dropped = nil, true
+	default:
+		s.queue = append(s.queue, event)
+	}
+
+	select {
+	case s.signalCh <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns and clears the queued events.
+func (s *pushSubscriber) pop() ([]model.ListUpdateEvent, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	events, dropped := s.queue, s.dropped
+	s.queue, s.dropped = nil, false
+
+	return events, dropped
+}
+
+// newPushHub creates a new pushHub object.
+func newPushHub(bufferSize int) *pushHub {
+	return &pushHub{
+		bufferSize:  bufferSize,
+		subscribers: make(map[*pushSubscriber]bool),
+	}
+}
+
+// ServePush accepts the list updates push stream connections until the listener is closed.
+func (s *SortedListService) ServePush(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("SortedListService: push: accept: %v", err)
+			return
+		}
+
+		go func() {
+			if err := s.handlePushConn(conn); err != nil {
+				log.Printf("SortedListService: push (%s): %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// handlePushConn handles a subscriber connection: reads the subscribe request and pushes events until disconnect.
+func (s *SortedListService) handlePushConn(conn net.Conn) error {
+	defer conn.Close()
+
+	// Handshake
+	req := model.SubscribeRequest{}
+	if err := conn.SetReadDeadline(time.Now().Add(pushHandshakeTimeout)); err != nil {
+		return fmt.Errorf("set read deadline: %w", err)
+	}
+	if err := gob.NewDecoder(conn).Decode(&req); err != nil {
+		return fmt.Errorf("subscribe request: GOB unmarshal: %w", err)
+	}
+	if req.ClientId <= 0 {
+		return fmt.Errorf("subscribe request: %s: must be GT 0", "ClientId")
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("reset read deadline: %w", err)
+	}
+
+	// Subscribe before the catch-up event is built, so no version is missed (subscriber skips the outdated ones)
+	sub := s.pushHub.subscribe(req.ClientId)
+	defer s.pushHub.unsubscribe(sub)
+
+	catchUpEvent := model.ListUpdateEvent{
+		FromVersion: req.Version,
+	}
+	if version, listOps, err := s.docHistory.GetOutputDiffWithLatest(req.Version); err == nil {
+		catchUpEvent.Version, catchUpEvent.Operations = version, listOps
+		catchUpEvent.Checksum, _ = s.docHistory.GetVersionChecksum(version)
+	} else {
+		catchUpEvent.Version, catchUpEvent.ResyncRequired = version, true
+	}
+
+	// Client doesn't send anything after the handshake: read is used to detect disconnect
+	closedCh := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closedCh)
+	}()
+
+	log.Printf("SortedListService: push: client %d subscribed (v%d)", req.ClientId, req.Version)
+	defer log.Printf("SortedListService: push: client %d unsubscribed", req.ClientId)
+
+	encoder := gob.NewEncoder(conn)
+	send := func(event model.ListUpdateEvent) error {
+		event.Clock = s.clock.Last()
+		if err := conn.SetWriteDeadline(time.Now().Add(pushWriteTimeout)); err != nil {
+			return fmt.Errorf("set write deadline: %w", err)
+		}
+		if err := encoder.Encode(event); err != nil {
+			return fmt.Errorf("event v%d: GOB marshal: %w", event.Version, err)
+		}
+
+		return nil
+	}
+
+	if err := send(catchUpEvent); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-s.stopCh:
+			return nil
+		case <-closedCh:
+			return nil
+		case <-sub.signalCh:
+		}
+
+		events, dropped := sub.pop()
+		if dropped {
+			log.Printf("SortedListService: push: client %d: events dropped (slow consumer)", req.ClientId)
+			events = []model.ListUpdateEvent{
+				{
+					Version:        s.docHistory.GetLatestVersion(),
+					ResyncRequired: true,
+				},
+			}
+		}
+		for _, event := range events {
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/gob"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// Test queues events per subscriber dropping the queue of a slow one on overflow.
+func Test_PushHub(t *testing.T) {
+	h := newPushHub(2)
+	sub1, sub2 := h.subscribe(1), h.subscribe(2)
+
+	h.Publish(model.ListUpdateEvent{FromVersion: 0, Version: 1})
+	h.Publish(model.ListUpdateEvent{FromVersion: 1, Version: 2})
+	require.Len(t, sub1.signalCh, 1)
+	events, dropped := sub1.pop()
+	require.False(t, dropped)
+	require.Equal(t, []model.ListUpdateEvent{{FromVersion: 0, Version: 1}, {FromVersion: 1, Version: 2}}, events)
+
+	// sub2 doesn't read its queue: overflow drops all the buffered events
+	h.Publish(model.ListUpdateEvent{FromVersion: 2, Version: 3})
+	events, dropped = sub2.pop()
+	require.True(t, dropped)
+	require.Empty(t, events)
+
+	// Queue is reset on pop
+	h.Publish(model.ListUpdateEvent{FromVersion: 3, Version: 4})
+	events, dropped = sub2.pop()
+	require.False(t, dropped)
+	require.Equal(t, []model.ListUpdateEvent{{FromVersion: 3, Version: 4}}, events)
+
+	// Unsubscribed one gets nothing
+	h.unsubscribe(sub1)
+	sub1.pop()
+	h.Publish(model.ListUpdateEvent{FromVersion: 4, Version: 5})
+	events, dropped = sub1.pop()
+	require.False(t, dropped)
+	require.Empty(t, events)
+	events, _ = sub2.pop()
+	require.Len(t, events, 1)
+}
+
+// testPushConn is a push stream client connection.
+type testPushConn struct {
+	conn    net.Conn
+	decoder *gob.Decoder
+	errCh   chan error
+}
+
+// newTestPushConn starts handling a push stream connection sending the subscribe request.
+func newTestPushConn(t *testing.T, s *SortedListService, req model.SubscribeRequest) *testPushConn {
+	serverConn, clientConn := net.Pipe()
+	pushConn := &testPushConn{
+		conn:    clientConn,
+		decoder: gob.NewDecoder(clientConn),
+		errCh:   make(chan error, 1),
+	}
+	go func() {
+		pushConn.errCh <- s.handlePushConn(serverConn)
+	}()
+	require.NoError(t, gob.NewEncoder(clientConn).Encode(req))
+
+	return pushConn
+}
+
+// read receives the next event.
+func (c *testPushConn) read(t *testing.T) model.ListUpdateEvent {
+	event := model.ListUpdateEvent{}
+	require.NoError(t, c.decoder.Decode(&event))
+
+	return event
+}
+
+// Test sends the catch-up event on subscribe and pushes the committed versions after.
+func Test_SortedListService_PushConn(t *testing.T) {
+	s := newTestService(t, Config{PushBufferSize: 1})
+	s.stopCh = make(chan interface{})
+	defer close(s.stopCh)
+
+	v1 := commitTestVersion(t, s, 5)
+	v2 := commitTestVersion(t, s, 5)
+
+	// Invalid handshake
+	pushConn := newTestPushConn(t, s, model.SubscribeRequest{Version: v1})
+	require.Error(t, <-pushConn.errCh)
+	pushConn.conn.Close()
+
+	// Catch-up
+	pushConn = newTestPushConn(t, s, model.SubscribeRequest{ClientId: 1, Version: v1})
+	event := pushConn.read(t)
+	require.Equal(t, v1, event.FromVersion)
+	require.Equal(t, v2, event.Version)
+	require.Len(t, event.Operations, 5)
+	require.False(t, event.ResyncRequired)
+	checksum, _ := s.docHistory.GetVersionChecksum(v2)
+	require.Equal(t, checksum, event.Checksum)
+	require.False(t, event.Clock.IsZero())
+
+	// New versions
+	v3 := commitTestVersion(t, s, 3)
+	event = pushConn.read(t)
+	require.Equal(t, v2, event.FromVersion)
+	require.Equal(t, v3, event.Version)
+	require.Len(t, event.Operations, 3)
+
+	// Slow subscriber: events are dropped (a buffered one might be sent before) and a single resync event is sent instead
+	latestVersion := v3
+	for i := 0; i < 3; i++ {
+		latestVersion = commitTestVersion(t, s, 1)
+	}
+	event = pushConn.read(t)
+	if !event.ResyncRequired {
+		require.Equal(t, v3, event.FromVersion)
+		event = pushConn.read(t)
+	}
+	require.True(t, event.ResyncRequired)
+	require.Equal(t, latestVersion, event.Version)
+
+	// Disconnect
+	pushConn.conn.Close()
+	require.NoError(t, <-pushConn.errCh)
+	require.Empty(t, s.pushHub.subscribers)
+
+	// Catch-up from a version not served anymore
+	require.NoError(t, s.docHistory.RemoveVersion(v2))
+	pushConn = newTestPushConn(t, s, model.SubscribeRequest{ClientId: 1, Version: v2})
+	event = pushConn.read(t)
+	require.True(t, event.ResyncRequired)
+	require.Equal(t, s.docHistory.GetLatestVersion(), event.Version)
+	pushConn.conn.Close()
+	require.NoError(t, <-pushConn.errCh)
+}
@@ -1,24 +1,133 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/itiky/collaborate-storage/model"
 	"github.com/itiky/collaborate-storage/storage"
 )
 
-// SortedListService implements an RPC server service.
-type SortedListService struct {
-	// Config
-	batchPeriod time.Duration
-	// State
-	docHistory *storage.DocumentHistory
-	opsCh      chan []storage.StorageOperation
-	//
-	stopCh chan interface{}
+// Max GetListUpdates long polling wait duration (lowered in tests).
+var maxUpdatesWaitTimeout = time.Minute
+
+const (
+	// Idle client acks are dropped after (a duplicate retried later gets no results)
+	clientAckTTL = 10 * time.Minute
+	// Idle client state (acks, rate limiter buckets) pruning period
+	clientStatePrunePeriod = time.Minute
+)
+
+type (
+	// Config defines the SortedListService settings.
+	Config struct {
+		// Input operations channel size
+		ChSize int
+		// Queued operations handling (version commit) period
+		BatchPeriod time.Duration
+		// Initial storage state (v0) file path
+		FilePath string
+		// Write-ahead log file path (empty - disabled)
+		WALPath string
+		// Checkpoints directory (empty - disabled)
+		CheckpointDir string
+		// Checkpoints writing period
+		CheckpointPeriod time.Duration
+		// Versions squash, retention, operation semantics and admission policies
+		SquashPolicy    storage.SquashPolicy
+		RetentionPolicy storage.RetentionPolicy
+		OperationPolicy storage.OperationPolicy
+		AdmissionPolicy AdmissionPolicy
+		// Max client clock lead over the server one (0 - unlimited)
+		MaxClockDrift time.Duration
+		// Max number of list update events buffered per push subscriber
+		PushBufferSize int
+	}
+
+	// SortedListService implements an RPC server service.
+	SortedListService struct {
+		// Number of operations queued (accessed atomically, kept first for 64-bit alignment)
+		queuedOps int64
+		// Config
+		batchPeriod      time.Duration
+		squashPolicy     storage.SquashPolicy
+		retentionPolicy  storage.RetentionPolicy
+		operationPolicy  storage.OperationPolicy
+		admissionPolicy  AdmissionPolicy
+		checkpointDir    string
+		checkpointPeriod time.Duration
+		// State
+		docHistory  *storage.DocumentHistory
+		opsCh       chan updateBatch
+		pushHub     *pushHub
+		lastAcks    map[model.ClientId]clientAck // the latest sequenced request result per client (used by the worker only)
+		rateLimiter *rateLimiter                 // per-client rate limiter (nil if disabled)
+		clock       *model.HLClock               // operations timestamps source (merged with client clocks)
+		//
+		stopCh chan interface{}
+	}
+
+	// updateBatch keeps UpdateList request storage operations queued for the worker.
+	updateBatch struct {
+		clientId model.ClientId
+		// Request sequence number (0 - not tracked)
+		sequence uint64
+		ops      []storage.StorageOperation
+		// Buffered channel the commit result is sent to
+		resultCh chan updateBatchResult
+	}
+
+	// updateBatchResult is the updateBatch commit result.
+	updateBatchResult struct {
+		// Version that includes the operations
+		version int
+		// Per-operation results
+		results []storage.OperationResult
+		// Batch was already applied (results are empty if the original ones are unknown)
+		duplicate bool
+		err       error
+	}
+
+	// clientAck is a sequenced updateBatch result.
+	clientAck struct {
+		sequence uint64
+		result   updateBatchResult
+		ackedAt  time.Time
+	}
+)
+
+// Validate validates the config.
+func (c Config) Validate() error {
+	if c.ChSize < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "ChSize")
+	}
+	if c.BatchPeriod <= 0 {
+		return fmt.Errorf("%s: must be GT 0", "BatchPeriod")
+	}
+	if c.CheckpointDir != "" && c.CheckpointPeriod <= 0 {
+		return fmt.Errorf("%s: must be GT 0", "CheckpointPeriod")
+	}
+	if err := c.SquashPolicy.Validate(); err != nil {
+		return fmt.Errorf("SquashPolicy: %w", err)
+	}
+	if err := c.RetentionPolicy.Validate(); err != nil {
+		return fmt.Errorf("RetentionPolicy: %w", err)
+	}
+	if err := c.AdmissionPolicy.Validate(); err != nil {
+		return fmt.Errorf("AdmissionPolicy: %w", err)
+	}
+	if c.MaxClockDrift < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "MaxClockDrift")
+	}
+	if c.PushBufferSize <= 0 {
+		return fmt.Errorf("%s: must be GT 0", "PushBufferSize")
+	}
+
+	return nil
 }
 
 // GetList returns a storage snapshot.
@@ -29,60 +138,183 @@ func (s *SortedListService) GetList(req model.GetListSnapshotRequest, res *model
 
 	version, list := s.docHistory.GetOutputSnapshot()
 	res.Version = version
+	res.ValueCodec = s.docHistory.ValueCodec().Name()
 	res.Data = list
+	res.Checksum, _ = s.docHistory.GetVersionChecksum(version)
+	res.ClientSequence = s.docHistory.GetClientSequence(req.ClientId)
+	res.Clock = s.clock.Last()
 
 	return nil
 }
 
 // GetListUpdates returns model.ListOperation objects for client to apply on a local snapshot in order to upgrade it.
+// Request blocks until a new version is committed if the client is at the latest version and WaitTimeout is set.
 func (s *SortedListService) GetListUpdates(req model.GetListUpdatesRequest, res *model.GetListUpdatesResponse) error {
+	if req.WaitTimeout < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "WaitTimeout")
+	}
+	if req.WaitTimeout > 0 {
+		waitTimeout := req.WaitTimeout
+		if waitTimeout > maxUpdatesWaitTimeout {
+			waitTimeout = maxUpdatesWaitTimeout
+		}
+		s.docHistory.WaitForVersionChange(req.Version, waitTimeout)
+	}
+
 	start := time.Now()
 
-	version, listOps := s.docHistory.GetOutputDiffWithLatest(req.Version)
+	version, listOps, err := s.docHistory.GetOutputDiffWithLatest(req.Version)
+	switch {
+	case err == nil:
+	case errors.Is(err, storage.ErrSnapshotRequired):
+		res.SnapshotRequired = true
+	case errors.Is(err, storage.ErrResyncRequired):
+		res.ResyncRequired = true
+	default:
+		return err
+	}
 	res.Version = version
 	res.Operations = listOps
+	if err == nil {
+		res.Checksum, _ = s.docHistory.GetVersionChecksum(version)
+	}
+	res.Clock = s.clock.Last()
 
 	go monitor.DiffRequestServed(time.Since(start))
 
 	return nil
 }
 
-// UpdateList receives the storage update operations and pushes them to the queue.
+// UpdateList receives the storage update operations, pushes them to the queue and waits for them to be committed.
+// Response contains the version that includes the operations and the per-operation results.
+// Operations are ordered by the client HLC timestamps (merged with the server clock), unstamped ones
+// and ones stamped too far in the future (beyond the max clock drift) get the server timestamp.
+// Request is rejected with model.BusyError if the queue is full or the client rate limit is exceeded,
+// with model.RequestTooLargeError if it has too many operations and with model.InvalidRequestError if it can't be accepted at all.
 func (s *SortedListService) UpdateList(req model.UpdateListRequest, res *model.UpdateListResponse) error {
-	now := time.Now().UTC()
-
-	// Input validation
-	storageOps := make([]storage.StorageOperation, 0, len(req.Operations))
-	for i, reqOp := range req.Operations {
-		switch reqOp.Type {
-		case model.InsertOperationType:
-			storageOp, err := storage.NewSetOperation(reqOp.Id, reqOp.Value, req.ClientId, now)
-			if err != nil {
-				return fmt.Errorf("updateOperation[%d] (%s): %w", i, reqOp.Type, err)
-			}
-			storageOps = append(storageOps, storageOp)
-		case model.UpdateOperationType:
-			storageOp, err := storage.NewSetOperation(reqOp.Id, reqOp.Value, req.ClientId, now)
-			if err != nil {
-				return fmt.Errorf("updateOperation[%d] (%s): %w", i, reqOp.Type, err)
-			}
-			storageOps = append(storageOps, storageOp)
-		case model.DeleteOperationType:
-			storageOp, err := storage.NewDeleteOperation(reqOp.Id, req.ClientId, now)
-			if err != nil {
-				return fmt.Errorf("updateOperation[%d] (%s): %w", i, reqOp.Type, err)
+	if maxOps := s.admissionPolicy.MaxRequestOps; maxOps > 0 && len(req.Operations) > maxOps {
+		return model.RequestTooLargeError{MaxOps: maxOps}
+	}
+
+	storageOps, err := s.newStorageOperations(req.ClientId, req.Operations)
+	if err != nil {
+		return err
+	}
+
+	// Sequenced requests are batched even without operations: the sequence number must be recorded
+	if len(storageOps) == 0 && req.Sequence == 0 {
+		res.Version = s.docHistory.GetLatestVersion()
+		res.Clock = s.clock.Last()
+		return nil
+	}
+
+	batch := updateBatch{
+		clientId: req.ClientId,
+		sequence: req.Sequence,
+		ops:      storageOps,
+		resultCh: make(chan updateBatchResult, 1),
+	}
+	if err := s.admit(req.ClientId, len(storageOps)); err != nil {
+		if _, busy := model.ParseBusyError(err); busy {
+			go monitor.RequestBusy()
+		}
+		return err
+	}
+	select {
+	case s.opsCh <- batch:
+	default:
+		s.release(req.ClientId, len(storageOps))
+		go monitor.RequestBusy()
+		return model.BusyError{RetryAfter: s.batchPeriod}
+	}
+
+	var result updateBatchResult
+	select {
+	case result = <-batch.resultCh:
+	case <-s.stopCh:
+		return errors.New("service stopped")
+	}
+	if result.err != nil {
+		return fmt.Errorf("commit: %w", result.err)
+	}
+
+	res.Version = result.version
+	res.Duplicate = result.duplicate
+	res.Clock = s.clock.Last()
+	res.Results = make([]model.OperationResult, 0, len(result.results))
+	for _, opResult := range result.results {
+		res.Results = append(res.Results, newOperationResult(opResult))
+	}
+
+	return nil
+}
+
+// newStorageOperations validates and converts request operations to storage operations.
+// Operations are stamped with the server clock if the timestamp is not set (or is too far ahead of it).
+func (s *SortedListService) newStorageOperations(clientId model.ClientId, reqOps []model.OperationRequest) ([]storage.StorageOperation, error) {
+	valueCodec := s.docHistory.ValueCodec()
+	storageOps := make([]storage.StorageOperation, 0, len(reqOps))
+	restampedCnt := 0
+	for i, reqOp := range reqOps {
+		if reqOp.Type != model.DeleteOperationType {
+			if err := valueCodec.Validate(reqOp.Value); err != nil {
+				return nil, model.InvalidRequestError{Reason: fmt.Sprintf("updateOperation[%d] (%s): value: %v", i, reqOp.Type, err)}
 			}
-			storageOps = append(storageOps, storageOp)
-		default:
-			return fmt.Errorf("unsupported updateOperation: %s", reqOp.Type)
 		}
+
+		timestamp := reqOp.Timestamp
+		if timestamp.IsZero() {
+			timestamp = s.clock.Now()
+		} else if _, err := s.clock.Update(timestamp); err != nil {
+			// Client clock is too far ahead: the operation is ordered as received now
+			timestamp = s.clock.Now()
+			restampedCnt++
+		}
+
+		storageOp, err := s.operationPolicy.NewOperation(reqOp, clientId, timestamp)
+		if err != nil {
+			return nil, model.InvalidRequestError{Reason: fmt.Sprintf("updateOperation[%d] (%s): %v", i, reqOp.Type, err)}
+		}
+		storageOps = append(storageOps, storageOp)
+	}
+	if restampedCnt > 0 {
+		log.Printf("SortedListService: client %d: %d operations stamped beyond the max clock drift got the server timestamp", clientId, restampedCnt)
+	}
+
+	return storageOps, nil
+}
+
+// admit reserves the queue space and the client rate limit tokens for operations.
+func (s *SortedListService) admit(clientId model.ClientId, opsCount int) error {
+	queuedOps := atomic.AddInt64(&s.queuedOps, int64(opsCount))
+	if maxOps := s.admissionPolicy.MaxQueueOps; maxOps > 0 && queuedOps > int64(maxOps) {
+		atomic.AddInt64(&s.queuedOps, -int64(opsCount))
+		return model.BusyError{RetryAfter: s.batchPeriod}
 	}
 
-	s.opsCh <- storageOps
+	if s.rateLimiter != nil {
+		retryAfter, err := s.rateLimiter.take(clientId, opsCount, time.Now())
+		if err != nil {
+			atomic.AddInt64(&s.queuedOps, -int64(opsCount))
+			return model.RequestTooLargeError{MaxOps: s.admissionPolicy.ClientBurst}
+		}
+		if retryAfter > 0 {
+			atomic.AddInt64(&s.queuedOps, -int64(opsCount))
+			return model.BusyError{RetryAfter: retryAfter}
+		}
+	}
 
 	return nil
 }
 
+// release returns the queue space and the client rate limit tokens reserved for operations that weren't queued.
+func (s *SortedListService) release(clientId model.ClientId, opsCount int) {
+	atomic.AddInt64(&s.queuedOps, -int64(opsCount))
+	if s.rateLimiter != nil {
+		s.rateLimiter.refund(clientId, opsCount)
+	}
+}
+
 // Start starts the service worker.
 func (s *SortedListService) Start() {
 	if s.stopCh != nil {
@@ -92,6 +324,9 @@ func (s *SortedListService) Start() {
 
 	monitor.Start()
 	go s.worker()
+	if s.checkpointDir != "" {
+		go s.checkpointWorker()
+	}
 }
 
 // Stop stops the service worker.
@@ -108,49 +343,264 @@ func (s *SortedListService) Stop() {
 func (s *SortedListService) worker() {
 	log.Println("SortedListService: start")
 
-	stOpsQueue := make([]storage.StorageOperation, 0)
+	batchQueue := make([]updateBatch, 0)
 
 	handleCh := time.Tick(s.batchPeriod)
+	pruneCh := time.Tick(clientStatePrunePeriod)
 	for {
 		select {
 		case <-s.stopCh:
 			// Service stop
 			log.Println("SortedListService: stop")
+			if err := s.docHistory.Close(); err != nil {
+				log.Printf("SortedListService: history close: %v", err)
+			}
 			return
-		case stOps := <-s.opsCh:
+		case batch := <-s.opsCh:
 			// Push storage operations to the queue
-			stOpsQueue = append(stOpsQueue, stOps...)
+			batchQueue = append(batchQueue, batch)
 		case <-handleCh:
 			// Start handling the queued operations
-			sort.Slice(stOpsQueue, func(i, j int) bool {
-				return stOpsQueue[i].GetTimestamp().Before(stOpsQueue[j].GetTimestamp())
-			})
+			s.commitBatches(batchQueue)
+			batchQueue = make([]updateBatch, 0)
 
-			s.docHistory.AddVersion(stOpsQueue...)
-			go monitor.OpsHandled(len(stOpsQueue))
+			// Compact the history
+			fromVersion, toVersion, squashed, err := s.docHistory.ApplySquashPolicy(s.squashPolicy, time.Now().UTC())
+			if err != nil {
+				log.Printf("SortedListService: squash policy: %v", err)
+			} else if squashed {
+				log.Printf("SortedListService: versions [v%d, v%d] squashed by policy", fromVersion, toVersion)
+			}
+
+			// Drop old versions
+			if oldestVersion, dropped := s.docHistory.ApplyRetentionPolicy(s.retentionPolicy, time.Now().UTC()); dropped > 0 {
+				log.Printf("SortedListService: %d versions dropped by retention policy (oldest served: v%d)", dropped, oldestVersion)
+			}
+		case <-pruneCh:
+			// Drop idle clients state
+			s.pruneClients(time.Now())
+		}
+	}
+}
+
+// commitBatches adds a new version with the queued operations (sorted by HLC timestamp) and sends the results back.
+// Sequenced batches already applied are dropped: they get the original result if it is known.
+func (s *SortedListService) commitBatches(batches []updateBatch) {
+	type queuedOp struct {
+		op       storage.StorageOperation
+		batchIdx int
+		opIdx    int
+	}
+
+	// Drop duplicates (a request might be retried while the original one is queued)
+	isDuplicate := make([]bool, len(batches))
+	sequences := make(map[model.ClientId]uint64)
+	for batchIdx, batch := range batches {
+		if batch.sequence == 0 {
+			continue
+		}
+
+		lastSequence, found := sequences[batch.clientId]
+		if !found {
+			lastSequence = s.docHistory.GetClientSequence(batch.clientId)
+		}
+		if batch.sequence <= lastSequence {
+			isDuplicate[batchIdx] = true
+			continue
+		}
+		sequences[batch.clientId] = batch.sequence
+	}
+
+	queue := make([]queuedOp, 0)
+	for batchIdx, batch := range batches {
+		if isDuplicate[batchIdx] {
+			continue
+		}
+		for opIdx, op := range batch.ops {
+			queue = append(queue, queuedOp{op: op, batchIdx: batchIdx, opIdx: opIdx})
+		}
+	}
+	// Stable sort keeps the arrival order for equal timestamps
+	sort.SliceStable(queue, func(i, j int) bool {
+		return queue[i].op.GetTimestamp().Before(queue[j].op.GetTimestamp())
+	})
+
+	stOps := make([]storage.StorageOperation, 0, len(queue))
+	for _, qOp := range queue {
+		stOps = append(stOps, qOp.op)
+	}
+
+	prevVersion := s.docHistory.GetLatestVersion()
+	version, opResults, err := s.docHistory.CommitVersion(stOps, sequences)
+	if err != nil {
+		log.Printf("SortedListService: add version (%d operations dropped): %v", len(stOps), err)
+	} else {
+		s.publishVersion(prevVersion)
+	}
+	go monitor.OpsHandled(len(stOps))
+
+	results := make([]updateBatchResult, len(batches))
+	for batchIdx, batch := range batches {
+		results[batchIdx] = updateBatchResult{
+			version: version,
+			results: make([]storage.OperationResult, len(batch.ops)),
+			err:     err,
+		}
+	}
+	if err == nil {
+		for i, qOp := range queue {
+			results[qOp.batchIdx].results[qOp.opIdx] = opResults[i]
+		}
+		for batchIdx, batch := range batches {
+			if batch.sequence > 0 && !isDuplicate[batchIdx] {
+				s.lastAcks[batch.clientId] = clientAck{sequence: batch.sequence, result: results[batchIdx], ackedAt: time.Now()}
+			}
+		}
+	}
+	for batchIdx, batch := range batches {
+		if !isDuplicate[batchIdx] {
+			continue
+		}
 
-			stOpsQueue = make([]storage.StorageOperation, 0)
+		results[batchIdx] = updateBatchResult{version: version}
+		if ack, found := s.lastAcks[batch.clientId]; found && ack.sequence == batch.sequence {
+			results[batchIdx] = ack.result
+		}
+		results[batchIdx].duplicate = true
+	}
+
+	batchedOps := 0
+	for batchIdx, batch := range batches {
+		batch.resultCh <- results[batchIdx]
+		batchedOps += len(batch.ops)
+	}
+	atomic.AddInt64(&s.queuedOps, -int64(batchedOps))
+}
+
+// pruneClients drops acks and rate limiter buckets of idle clients (maps would grow with every client ID otherwise).
+func (s *SortedListService) pruneClients(now time.Time) {
+	for clientId, ack := range s.lastAcks {
+		if now.Sub(ack.ackedAt) > clientAckTTL {
+			delete(s.lastAcks, clientId)
+		}
+	}
+	if s.rateLimiter != nil {
+		s.rateLimiter.prune(now)
+	}
+}
+
+// newOperationResult converts the storage operation result to the response one.
+func newOperationResult(opResult storage.OperationResult) model.OperationResult {
+	switch {
+	case opResult.Err == nil && opResult.Applied:
+		return model.OperationResult{Status: model.AppliedOperationStatus}
+	case opResult.Err == nil:
+		return model.OperationResult{Status: model.IgnoredOperationStatus}
+	}
+
+	res := model.OperationResult{Status: model.RejectedOperationStatus}
+	switch {
+	case errors.Is(opResult.Err, storage.ErrItemExists):
+		res.ErrorCode = model.ItemExistsErrorCode
+	case errors.Is(opResult.Err, storage.ErrItemNotFound):
+		res.ErrorCode = model.ItemNotFoundErrorCode
+	case errors.Is(opResult.Err, storage.ErrItemDeleted):
+		res.ErrorCode = model.ItemDeletedErrorCode
+	case errors.Is(opResult.Err, storage.ErrConflict):
+		res.ErrorCode = model.ConflictErrorCode
+	default:
+		res.ErrorCode = model.InternalErrorCode
+	}
+
+	return res
+}
+
+// publishResync notifies the subscribers that the history was rewritten: updates must be requested using the GetListUpdates RPC
+// (clients with a version rebuilt or dropped get model.GetListUpdatesResponse.ResyncRequired).
+func (s *SortedListService) publishResync() {
+	s.pushHub.Publish(model.ListUpdateEvent{
+		Version:        s.docHistory.GetLatestVersion(),
+		ResyncRequired: true,
+	})
+}
+
+// publishVersion pushes the new version operations to subscribers.
+func (s *SortedListService) publishVersion(prevVersion int) {
+	version, listOps, err := s.docHistory.GetOutputDiffWithLatest(prevVersion)
+	if err != nil {
+		log.Printf("SortedListService: publish v%d: %v", version, err)
+		return
+	}
+	if version == prevVersion {
+		return
+	}
+	checksum, _ := s.docHistory.GetVersionChecksum(version)
+
+	s.pushHub.Publish(model.ListUpdateEvent{
+		FromVersion: prevVersion,
+		Version:     version,
+		Operations:  listOps,
+		Checksum:    checksum,
+	})
+}
+
+// checkpointWorker periodically writes the latest storage state checkpoint.
+func (s *SortedListService) checkpointWorker() {
+	ticker := time.NewTicker(s.checkpointPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			startedAt := time.Now()
+			version, written, err := s.docHistory.WriteCheckpoint(s.checkpointDir)
+			if err != nil {
+				log.Printf("SortedListService: checkpoint v%d: %v", version, err)
+				continue
+			}
+			if written {
+				log.Printf("SortedListService: checkpoint v%d written (%v)", version, time.Since(startedAt))
+			}
 		}
 	}
 }
 
 // NewSortedListService creates a new SortedListService object.
-func NewSortedListService(chSize int, batchPeriod time.Duration, filePath string) (*SortedListService, error) {
-	if chSize < 0 {
-		return nil, fmt.Errorf("%s: must be GTE 0", "chSize")
+func NewSortedListService(cfg Config) (*SortedListService, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
-	if batchPeriod <= 0 {
-		return nil, fmt.Errorf("%s: must be GT 0", "batchPeriod")
+
+	clock, err := model.NewHLClock(cfg.MaxClockDrift)
+	if err != nil {
+		return nil, fmt.Errorf("model.NewHLClock: %w", err)
 	}
 
-	docHistory, err := storage.NewDocHistoryFromFile(filePath)
+	docHistory, err := storage.NewDocHistoryFromFile(cfg.FilePath, cfg.WALPath, cfg.CheckpointDir)
 	if err != nil {
 		return nil, fmt.Errorf("storage.NewDocHistoryFromFile: %w", err)
 	}
 
+	// Versions dropped before the restart are restored from WAL: they are dropped again before the service is started
+	if oldestVersion, dropped := docHistory.ApplyRetentionPolicy(cfg.RetentionPolicy, time.Now().UTC()); dropped > 0 {
+		log.Printf("SortedListService: %d restored versions dropped by retention policy (oldest served: v%d)", dropped, oldestVersion)
+	}
+
 	return &SortedListService{
-		docHistory:  docHistory,
-		opsCh:       make(chan []storage.StorageOperation, chSize),
-		batchPeriod: batchPeriod,
+		docHistory:       docHistory,
+		opsCh:            make(chan updateBatch, cfg.ChSize),
+		pushHub:          newPushHub(cfg.PushBufferSize),
+		lastAcks:         make(map[model.ClientId]clientAck),
+		batchPeriod:      cfg.BatchPeriod,
+		squashPolicy:     cfg.SquashPolicy,
+		retentionPolicy:  cfg.RetentionPolicy,
+		operationPolicy:  cfg.OperationPolicy,
+		admissionPolicy:  cfg.AdmissionPolicy,
+		rateLimiter:      newRateLimiter(cfg.AdmissionPolicy.ClientRate, cfg.AdmissionPolicy.ClientBurst),
+		clock:            clock,
+		checkpointDir:    cfg.CheckpointDir,
+		checkpointPeriod: cfg.CheckpointPeriod,
 	}, nil
 }
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+	"github.com/itiky/collaborate-storage/storage"
+)
+
+var testCodec = model.MustGetValueCodec(model.Int32ValueCodecName)
+
+// newTestService creates a SortedListService object for the generated base file (the worker is not started).
+// Config defaults are used for unset fields.
+func newTestService(t *testing.T, cfg Config) *SortedListService {
+	dir, err := ioutil.TempDir("", "server")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	cfg.FilePath = filepath.Join(dir, "base.dat")
+	require.NoError(t, storage.GenAndSaveInitialStorage(cfg.FilePath, 100, testCodec))
+	if cfg.BatchPeriod == 0 {
+		cfg.BatchPeriod = 10 * time.Millisecond
+	}
+	if cfg.PushBufferSize == 0 {
+		cfg.PushBufferSize = 10
+	}
+
+	s, err := NewSortedListService(cfg)
+	require.NoError(t, err)
+
+	return s
+}
+
+// Test drops sequenced batches already applied: a retry gets the original results if they are known.
+func Test_SortedListService_CommitBatches(t *testing.T) {
+	s := newTestService(t, Config{})
+
+	now := model.HLCFromTime(time.Now())
+	idA, idB, idC, idD := uuid.New().String(), uuid.New().String(), uuid.New().String(), uuid.New().String()
+	newBatch := func(clientId model.ClientId, sequence uint64, ids ...string) updateBatch {
+		batch := updateBatch{
+			clientId: clientId,
+			sequence: sequence,
+			resultCh: make(chan updateBatchResult, 1),
+		}
+		for _, id := range ids {
+			op, err := storage.NewInsertOperation(id, testCodec.Random(), clientId, now)
+			require.NoError(t, err)
+			batch.ops = append(batch.ops, op)
+		}
+
+		return batch
+	}
+	commit := func(batches ...updateBatch) []updateBatchResult {
+		s.commitBatches(batches)
+		results := make([]updateBatchResult, 0, len(batches))
+		for _, batch := range batches {
+			results = append(results, <-batch.resultCh)
+		}
+
+		return results
+	}
+
+	// Retry while the original one is queued: the original results are known
+	results := commit(newBatch(1, 1, idA, idB), newBatch(1, 1, idA, idB), newBatch(2, 1, idC))
+	require.NoError(t, results[0].err)
+	require.False(t, results[0].duplicate)
+	require.Equal(t, []storage.OperationResult{{Applied: true}, {Applied: true}}, results[0].results)
+	require.True(t, results[1].duplicate)
+	require.Equal(t, results[0].version, results[1].version)
+	require.Equal(t, results[0].results, results[1].results)
+	require.False(t, results[2].duplicate)
+	require.Equal(t, uint64(1), s.docHistory.GetClientSequence(1))
+	require.Equal(t, uint64(1), s.docHistory.GetClientSequence(2))
+	version := results[0].version
+
+	// Retry of the last acknowledged request
+	results = commit(newBatch(1, 1, idA, idB))
+	require.True(t, results[0].duplicate)
+	require.Equal(t, version, results[0].version)
+	require.Equal(t, []storage.OperationResult{{Applied: true}, {Applied: true}}, results[0].results)
+	require.Equal(t, version, s.docHistory.GetLatestVersion())
+
+	// Duplicate with the original results unknown (pruned or older than the last acknowledged one)
+	results = commit(newBatch(2, 2, idD))
+	require.False(t, results[0].duplicate)
+	delete(s.lastAcks, 1)
+	results = commit(newBatch(1, 1, idA, idB), newBatch(2, 1, idC))
+	for _, result := range results {
+		require.NoError(t, result.err)
+		require.True(t, result.duplicate)
+		require.Equal(t, version+1, result.version)
+		require.Empty(t, result.results)
+	}
+
+	// Batch without operations: the sequence number is recorded
+	results = commit(newBatch(1, 2))
+	require.False(t, results[0].duplicate)
+	require.Equal(t, version+1, results[0].version)
+	require.Equal(t, uint64(2), s.docHistory.GetClientSequence(1))
+	results = commit(newBatch(1, 2))
+	require.True(t, results[0].duplicate)
+}
+
+// Test queues sequenced requests without operations, so the sequence number is recorded.
+func Test_SortedListService_UpdateListNoOps(t *testing.T) {
+	s := newTestService(t, Config{ChSize: 10})
+
+	// Not sequenced: the latest version is returned right away
+	res := model.UpdateListResponse{}
+	require.NoError(t, s.UpdateList(model.UpdateListRequest{ClientId: 1}, &res))
+	require.Equal(t, s.docHistory.GetLatestVersion(), res.Version)
+	require.Empty(t, s.opsCh)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.UpdateList(model.UpdateListRequest{ClientId: 1, Sequence: 3}, &res)
+	}()
+	s.commitBatches([]updateBatch{<-s.opsCh})
+	require.NoError(t, <-errCh)
+	require.False(t, res.Duplicate)
+	require.Equal(t, uint64(3), s.docHistory.GetClientSequence(1))
+
+	snapshotRes := model.GetListSnapshotResponse{}
+	require.NoError(t, s.GetList(model.GetListSnapshotRequest{ClientId: 1}, &snapshotRes))
+	require.Equal(t, uint64(3), snapshotRes.ClientSequence)
+}
+
+// commitTestVersion commits a new version inserting random items.
+func commitTestVersion(t *testing.T, s *SortedListService, n int) int {
+	batch := updateBatch{resultCh: make(chan updateBatchResult, 1)}
+	for i := 0; i < n; i++ {
+		op, err := storage.NewInsertOperation(uuid.New().String(), testCodec.Random(), 0, s.clock.Now())
+		require.NoError(t, err)
+		batch.ops = append(batch.ops, op)
+	}
+	s.commitBatches([]updateBatch{batch})
+
+	result := <-batch.resultCh
+	require.NoError(t, result.err)
+
+	return result.version
+}
+
+// Test long polls for updates: request waits for a new version up to the timeout (capped by the server).
+func Test_SortedListService_GetListUpdatesWait(t *testing.T) {
+	s := newTestService(t, Config{})
+	v1 := commitTestVersion(t, s, 2)
+
+	getUpdates := func(req model.GetListUpdatesRequest) (model.GetListUpdatesResponse, time.Duration) {
+		res := model.GetListUpdatesResponse{}
+		start := time.Now()
+		require.NoError(t, s.GetListUpdates(req, &res))
+		return res, time.Since(start)
+	}
+
+	// Negative timeout
+	require.Error(t, s.GetListUpdates(model.GetListUpdatesRequest{Version: v1, WaitTimeout: -time.Second}, &model.GetListUpdatesResponse{}))
+
+	// No wait: the latest version is returned right away
+	res, dur := getUpdates(model.GetListUpdatesRequest{Version: v1})
+	require.Equal(t, v1, res.Version)
+	require.Empty(t, res.Operations)
+	require.Less(t, int64(dur), int64(time.Second))
+
+	// Client is behind: no wait
+	res, dur = getUpdates(model.GetListUpdatesRequest{Version: 0, WaitTimeout: time.Minute})
+	require.Equal(t, v1, res.Version)
+	require.Len(t, res.Operations, 2)
+	require.Less(t, int64(dur), int64(time.Second))
+
+	// Wait is woken up by a commit
+	errCh := make(chan error, 1)
+	res = model.GetListUpdatesResponse{}
+	go func() {
+		errCh <- s.GetListUpdates(model.GetListUpdatesRequest{Version: v1, WaitTimeout: time.Minute}, &res)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, errCh)
+	v2 := commitTestVersion(t, s, 3)
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("long poll is not woken up by the commit")
+	}
+	require.Equal(t, v2, res.Version)
+	require.Len(t, res.Operations, 3)
+	checksum, _ := s.docHistory.GetVersionChecksum(v2)
+	require.Equal(t, checksum, res.Checksum)
+
+	// Wait timeout is capped
+	defer func(prevTimeout time.Duration) {
+		maxUpdatesWaitTimeout = prevTimeout
+	}(maxUpdatesWaitTimeout)
+	maxUpdatesWaitTimeout = 50 * time.Millisecond
+
+	res, dur = getUpdates(model.GetListUpdatesRequest{Version: v2, WaitTimeout: time.Hour})
+	require.Equal(t, v2, res.Version)
+	require.Empty(t, res.Operations)
+	require.GreaterOrEqual(t, int64(dur), int64(maxUpdatesWaitTimeout))
+	require.Less(t, int64(dur), int64(5*time.Second))
+}
+
+// Test drops versions restored from WAL by the retention policy before the service is started.
+func Test_SortedListService_RetentionRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		BatchPeriod:     10 * time.Millisecond,
+		FilePath:        filepath.Join(dir, "base.dat"),
+		WALPath:         filepath.Join(dir, "history.wal"),
+		RetentionPolicy: storage.RetentionPolicy{KeepVersions: 2},
+		PushBufferSize:  10,
+	}
+	require.NoError(t, storage.GenAndSaveInitialStorage(cfg.FilePath, 100, testCodec))
+
+	s, err := NewSortedListService(cfg)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		commitTestVersion(t, s, 2)
+	}
+	oldestVersion, dropped := s.docHistory.ApplyRetentionPolicy(cfg.RetentionPolicy, time.Now().UTC())
+	require.Greater(t, dropped, 0)
+	latestVersion := s.docHistory.GetLatestVersion()
+	require.NoError(t, s.docHistory.Close())
+
+	checkOldestVersion := func(s *SortedListService, oldestVersion int) {
+		require.Equal(t, latestVersion, s.docHistory.GetLatestVersion())
+
+		_, _, err := s.docHistory.GetOutputDiffWithLatest(oldestVersion)
+		require.NoError(t, err)
+		if oldestVersion > 0 {
+			_, _, err = s.docHistory.GetOutputDiffWithLatest(oldestVersion - 1)
+			require.True(t, errors.Is(err, storage.ErrSnapshotRequired), "v%d", oldestVersion-1)
+		}
+	}
+
+	// Restored with the policy applied
+	restored, err := NewSortedListService(cfg)
+	require.NoError(t, err)
+	checkOldestVersion(restored, oldestVersion)
+	require.NoError(t, restored.docHistory.Close())
+
+	// Dropped versions are restored from WAL without the policy
+	cfg.RetentionPolicy = storage.RetentionPolicy{}
+	restored, err = NewSortedListService(cfg)
+	require.NoError(t, err)
+	checkOldestVersion(restored, 0)
+	require.NoError(t, restored.docHistory.Close())
+}
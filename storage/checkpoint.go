@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itiky/collaborate-storage/internal/fileutil"
+	"github.com/itiky/collaborate-storage/model"
+)
+
+const (
+	checkpointFilePrefix     = "checkpoint_v"
+	checkpointFileSegmentSep = "_w"
+	checkpointFileExt        = ".dat"
+	// Number of the newest checkpoints kept (older ones are used as a fallback for the newest one)
+	checkpointsKeep = 3
+)
+
+type (
+	// checkpointFile is the on-disk DocumentHistory latest state (a single fileutil record file).
+	checkpointFile struct {
+		// Base file checksum and value codec the state was built for
+		BaseChecksum uint32
+		ValueCodec   string
+		// State version
+		Version     int
+		NextVersion int
+		// WAL segment following the state and the number of its records applied to the state
+		WALSegment int
+		WALRecords int
+		// Checkpoint creation time
+		CreatedAt time.Time
+		// All storage items (including soft-deleted ones): sorted not deleted items go first
+		Items []Item
+		// The highest update request sequence number applied per client
+		ClientSequences map[model.ClientId]uint64
+	}
+
+	// checkpointFileInfo describes a checkpoint file by its name: checkpoint_v<version>_w<WAL segment>.dat.
+	checkpointFileInfo struct {
+		Path       string
+		Version    int
+		WALSegment int
+	}
+)
+
+// WriteCheckpoint writes the latest storage state to the checkpoint directory.
+// A new WAL segment is started under the lock, the state is copied afterwards (the version can't be rewritten until the checkpoint is done)
+// and written to a temporary file which is atomically renamed.
+// Old checkpoints and WAL segments preceding the oldest checkpoint kept are removed.
+// Returns the checkpoint version and false if the version checkpoint already exists.
+func (h *DocumentHistory) WriteCheckpoint(dirPath string) (int, bool, error) {
+	cp, ok, err := h.startCheckpoint()
+	if err != nil || !ok {
+		return cp.Version, false, err
+	}
+
+	cp.Items, err = h.exportVersionItems(cp.Version)
+	if err == nil {
+		err = writeCheckpointFile(dirPath, cp)
+	}
+
+	cpPath := getCheckpointFilePath(dirPath, cp.Version, cp.WALSegment)
+	h.Lock()
+	h.checkpointingVersion = 0
+	if err == nil {
+		if cp.Version > h.frozenVersion {
+			h.frozenVersion = cp.Version
+		}
+		if cp.Version > h.checkpointVersion {
+			h.checkpointVersion = cp.Version
+		}
+		h.addSnapshotSource(newCheckpointSnapshotSource(cpPath, cp.BaseChecksum, cp.Version))
+	}
+	h.Unlock()
+	if err != nil {
+		return cp.Version, false, err
+	}
+
+	// Remove old checkpoints (and the same version ones followed by older segments)
+	cpInfos, err := listCheckpointFiles(dirPath)
+	if err != nil {
+		return cp.Version, true, err
+	}
+	keptInfos := make([]checkpointFileInfo, 0, checkpointsKeep)
+	for _, cpInfo := range cpInfos {
+		if len(keptInfos) < checkpointsKeep && (len(keptInfos) == 0 || keptInfos[len(keptInfos)-1].Version != cpInfo.Version) {
+			keptInfos = append(keptInfos, cpInfo)
+			continue
+		}
+		if err := os.Remove(cpInfo.Path); err != nil {
+			return cp.Version, true, fmt.Errorf("removing old checkpoint (%s): %w", cpInfo.Path, err)
+		}
+	}
+
+	// Remove WAL segments not needed to restore from the checkpoints kept (the base file fallback needs all of them until then)
+	if len(keptInfos) == checkpointsKeep {
+		oldestSegment := cp.WALSegment
+		for _, cpInfo := range keptInfos {
+			if cpInfo.WALSegment < oldestSegment {
+				oldestSegment = cpInfo.WALSegment
+			}
+		}
+
+		h.Lock()
+		if h.wal != nil {
+			err = h.wal.removeSegmentsBefore(oldestSegment)
+		}
+		h.Unlock()
+		if err != nil {
+			return cp.Version, true, fmt.Errorf("WAL: %w", err)
+		}
+	}
+
+	return cp.Version, true, nil
+}
+
+// startCheckpoint starts a new WAL segment and returns the latest version checkpoint without items
+// (false if the version checkpoint was already written).
+// The version and older ones can't be rewritten until the checkpointingVersion is reset.
+func (h *DocumentHistory) startCheckpoint() (checkpointFile, bool, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	cp := checkpointFile{
+		BaseChecksum: h.baseChecksum,
+		ValueCodec:   h.storage.ValueCodec().Name(),
+		Version:      h.latestVersion,
+		NextVersion:  h.nextVersion,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if h.latestVersion == h.checkpointVersion {
+		return cp, false, nil
+	}
+	if h.checkpointingVersion != 0 {
+		return cp, false, fmt.Errorf("checkpoint v%d: in progress", h.checkpointingVersion)
+	}
+	if h.wal != nil {
+		rec := walRecord{
+			Type:         walRecordTypeHeader,
+			BaseChecksum: h.baseChecksum,
+			ValueCodec:   h.storage.ValueCodec().Name(),
+		}
+		if err := h.wal.rotate(rec); err != nil {
+			return cp, false, fmt.Errorf("WAL rotate: %w", err)
+		}
+		cp.WALSegment, cp.WALRecords = h.wal.Segment(), h.wal.Records()
+	}
+	h.checkpointingVersion = cp.Version
+
+	cp.ClientSequences = make(map[model.ClientId]uint64, len(h.clientSequences))
+	for clientId, sequence := range h.clientSequences {
+		cp.ClientSequences[clientId] = sequence
+	}
+
+	return cp, true, nil
+}
+
+// exportVersionItems copies the version storage items.
+// The latest version items are copied under the read lock, an older version state is built using BuildStorage.
+func (h *DocumentHistory) exportVersionItems(version int) ([]Item, error) {
+	h.RLock()
+	if version == h.latestVersion {
+		defer h.RUnlock()
+		return h.storage.exportItems(), nil
+	}
+	h.RUnlock()
+
+	storage, err := h.BuildStorage(version)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.exportItems(), nil
+}
+
+// writeCheckpointFile writes and syncs the checkpoint file using a temporary file and the atomic rename.
+func writeCheckpointFile(dirPath string, cp checkpointFile) error {
+	return fileutil.WriteRecordFile(getCheckpointFilePath(dirPath, cp.Version, cp.WALSegment), cp)
+}
+
+// readCheckpointFile reads and validates the checkpoint file.
+func readCheckpointFile(filePath string) (checkpointFile, error) {
+	cp := checkpointFile{}
+	if err := fileutil.ReadRecordFile(filePath, &cp); err != nil {
+		return checkpointFile{}, err
+	}
+
+	return cp, nil
+}
+
+// listCheckpointFiles returns checkpoint files sorted by version (the newest first).
+// Files with unparsable names are skipped.
+func listCheckpointFiles(dirPath string) ([]checkpointFileInfo, error) {
+	fileInfos, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading dir (%s): %w", dirPath, err)
+	}
+
+	cpInfos := make([]checkpointFileInfo, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || !strings.HasPrefix(name, checkpointFilePrefix) || !strings.HasSuffix(name, checkpointFileExt) {
+			continue
+		}
+
+		nameParts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, checkpointFilePrefix), checkpointFileExt), checkpointFileSegmentSep)
+		if len(nameParts) != 2 {
+			continue
+		}
+		version, err := strconv.Atoi(nameParts[0])
+		if err != nil || version < 0 {
+			continue
+		}
+		segment, err := strconv.Atoi(nameParts[1])
+		if err != nil || segment < 0 {
+			continue
+		}
+
+		cpInfos = append(cpInfos, checkpointFileInfo{
+			Path:       filepath.Join(dirPath, name),
+			Version:    version,
+			WALSegment: segment,
+		})
+	}
+	sort.Slice(cpInfos, func(i, j int) bool {
+		if cpInfos[i].Version != cpInfos[j].Version {
+			return cpInfos[i].Version > cpInfos[j].Version
+		}
+		return cpInfos[i].WALSegment > cpInfos[j].WALSegment
+	})
+
+	return cpInfos, nil
+}
+
+// getCheckpointFilePath returns the version checkpoint file path.
+func getCheckpointFilePath(dirPath string, version, walSegment int) string {
+	return filepath.Join(dirPath, checkpointFilePrefix+strconv.Itoa(version)+checkpointFileSegmentSep+strconv.Itoa(walSegment)+checkpointFileExt)
+}
+
+// readCheckpointStorage reads the checkpoint file and builds the Storage object checking the checkpoint matches the base file.
+func readCheckpointStorage(filePath string, baseChecksum uint32) (checkpointFile, *Storage, error) {
+	cp, err := readCheckpointFile(filePath)
+	if err != nil {
+		return checkpointFile{}, nil, err
+	}
+	if cp.BaseChecksum != baseChecksum {
+		return checkpointFile{}, nil, errors.New("base state checksum mismatch: checkpoint was written for a different base file")
+	}
+
+	codec, err := model.GetValueCodec(cp.ValueCodec)
+	if err != nil {
+		return checkpointFile{}, nil, err
+	}
+
+	return cp, newStorageFromObjs(codec, cp.Items), nil
+}
+
+// newCheckpointSnapshotSource creates a snapshotSource reading the checkpoint file.
+func newCheckpointSnapshotSource(filePath string, baseChecksum uint32, version int) snapshotSource {
+	return snapshotSource{
+		Version: version,
+		Name:    filePath,
+		Load: func() (*Storage, error) {
+			cp, storage, err := readCheckpointStorage(filePath, baseChecksum)
+			if err != nil {
+				return nil, err
+			}
+			if cp.Version != version {
+				return nil, fmt.Errorf("version %d: expected %d", cp.Version, version)
+			}
+
+			return storage, nil
+		},
+	}
+}
+
+// newDocHistoryFromCheckpoint builds the DocumentHistory object with a single version (the checkpoint one) from the checkpoint file.
+// Returns the WAL segment following the state and the number of its records applied to the state.
+func newDocHistoryFromCheckpoint(filePath string, baseChecksum uint32) (*DocumentHistory, int, int, error) {
+	cp, storage, err := readCheckpointStorage(filePath, baseChecksum)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if cp.NextVersion <= cp.Version {
+		return nil, 0, 0, fmt.Errorf("nextVersion %d: must be GT version %d", cp.NextVersion, cp.Version)
+	}
+
+	h := newDocumentHistory(storage)
+	h.documents[0].Version = cp.Version
+	h.documents[0].CreatedAt = cp.CreatedAt
+	h.latestVersion = cp.Version
+	h.nextVersion = cp.NextVersion
+	h.baseChecksum = baseChecksum
+	h.checkpointVersion = cp.Version
+	h.frozenVersion = cp.Version
+	h.setClientSequences(cp.ClientSequences)
+	h.snapshotSources = []snapshotSource{
+		newCheckpointSnapshotSource(filePath, baseChecksum, cp.Version),
+	}
+
+	log.Printf("Checkpoint loaded (%s): version %d, %d items", filePath, cp.Version, len(cp.Items))
+
+	return h, cp.WALSegment, cp.WALRecords, nil
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// Test writes checkpoints and restores the history from checkpoints and WAL segments (falling back to older checkpoints).
+func Test_Checkpoint_Restore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath, walPath, cpDir := filepath.Join(dir, "base.dat"), filepath.Join(dir, "history.wal"), filepath.Join(dir, "checkpoints")
+	require.NoError(t, os.Mkdir(cpDir, 0755))
+	require.NoError(t, GenAndSaveInitialStorage(filePath, 100, testCodec))
+
+	h, err := NewDocHistoryFromFile(filePath, walPath, cpDir)
+	require.NoError(t, err)
+
+	ids := make([]string, 0)
+	for _, item := range h.storage.Export() {
+		ids = append(ids, item.Id)
+	}
+
+	// Nothing to write for the base state
+	_, written, err := h.WriteCheckpoint(cpDir)
+	require.NoError(t, err)
+	require.False(t, written)
+
+	for i := 0; i < 3; i++ {
+		_, _, err := h.CommitVersion(newTestStorageOps(t, &ids, 20), map[model.ClientId]uint64{model.ClientId(i % 2): uint64(i + 1)})
+		require.NoError(t, err)
+	}
+	version, written, err := h.WriteCheckpoint(cpDir)
+	require.NoError(t, err)
+	require.True(t, written)
+	require.Equal(t, 3, version)
+
+	_, written, err = h.WriteCheckpoint(cpDir)
+	require.NoError(t, err)
+	require.False(t, written)
+
+	// Squash range overlaps the checkpoint
+	require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 20)...))
+	require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 20)...))
+	require.NoError(t, h.Squash(2, 4))
+	require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 20)...))
+	version, written, err = h.WriteCheckpoint(cpDir)
+	require.NoError(t, err)
+	require.True(t, written)
+	require.Equal(t, 6, version)
+	require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 20)...))
+
+	// Checkpoints rotate WAL: the first segment is kept until all the checkpoints are written
+	segments, err := h.wal.listSegments()
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2}, segments)
+
+	version, written, err = h.WriteCheckpoint(cpDir)
+	require.NoError(t, err)
+	require.True(t, written)
+	require.Equal(t, 7, version)
+	require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 20)...))
+
+	// Unparsable names are skipped
+	for _, name := range []string{"checkpoint_v8.dat", "checkpoint_v8_wx.dat", "checkpoint_v8_w1_w2.dat", "checkpoint_vx_w1.dat"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cpDir, name), nil, 0644))
+	}
+
+	cpInfos, err := listCheckpointFiles(cpDir)
+	require.NoError(t, err)
+	require.Equal(t, []checkpointFileInfo{
+		{Path: filepath.Join(cpDir, "checkpoint_v7_w3.dat"), Version: 7, WALSegment: 3},
+		{Path: filepath.Join(cpDir, "checkpoint_v6_w2.dat"), Version: 6, WALSegment: 2},
+		{Path: filepath.Join(cpDir, "checkpoint_v3_w1.dat"), Version: 3, WALSegment: 1},
+	}, cpInfos)
+	segments, err = h.wal.listSegments()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, segments)
+
+	// Checkpointed versions can't be rewritten
+	require.Error(t, h.RemoveVersion(7))
+	require.Error(t, h.ReplaceVersion(7, newTestStorageOps(t, &ids, 1)...))
+	require.NoError(t, h.Close())
+
+	checkRestored := func(expected *DocumentHistory, versions []int) *DocumentHistory {
+		restored, err := NewDocHistoryFromFile(filePath, walPath, cpDir)
+		require.NoError(t, err)
+		require.NoError(t, restored.Close())
+
+		require.Equal(t, versions, getTestVersions(restored))
+		require.Equal(t, expected.latestVersion, restored.latestVersion)
+		require.Equal(t, expected.nextVersion, restored.nextVersion)
+		require.Equal(t, expected.storage.Export(), restored.storage.Export())
+		require.Equal(t, expected.clientSequences, restored.clientSequences)
+
+		// Soft-deleted items and metadata
+		require.Len(t, restored.storage.idDataMatch, len(expected.storage.idDataMatch))
+		for id, expectedItem := range expected.storage.idDataMatch {
+			item, found := restored.storage.idDataMatch[id]
+			require.True(t, found, id)
+			require.Equal(t, expectedItem.IsDeleted, item.IsDeleted, id)
+			require.Equal(t, expectedItem.UpdatedBy, item.UpdatedBy, id)
+			require.Equal(t, expectedItem.UpdatedAt, item.UpdatedAt, id)
+		}
+
+		for _, version := range versions {
+			if !expected.IsVersionValid(version) {
+				continue
+			}
+			_, expectedOps, err := expected.GetOutputDiffWithLatest(version)
+			require.NoError(t, err)
+			_, listOps, err := restored.GetOutputDiffWithLatest(version)
+			require.NoError(t, err)
+			require.Equal(t, expectedOps, listOps, "v%d", version)
+		}
+
+		return restored
+	}
+	corruptFile := func(filePath string) []byte {
+		data, err := ioutil.ReadFile(filePath)
+		require.NoError(t, err)
+		corrupted := append([]byte(nil), data...)
+		corrupted[len(corrupted)/2] ^= 0xFF
+		require.NoError(t, ioutil.WriteFile(filePath, corrupted, 0644))
+		return data
+	}
+
+	// The newest checkpoint + WAL
+	checkRestored(h, []int{7, 8})
+
+	// Fallback to older checkpoints
+	cp7Data := corruptFile(cpInfos[0].Path)
+	checkRestored(h, []int{6, 7, 8})
+	cp6Data := corruptFile(cpInfos[1].Path)
+	checkRestored(h, []int{3, 4, 5, 6, 7, 8})
+
+	// The base file can't be used: WAL segments before the oldest checkpoint are removed
+	cp3Data := corruptFile(cpInfos[2].Path)
+	_, err = NewDocHistoryFromFile(filePath, walPath, cpDir)
+	require.Error(t, err)
+
+	// Versions after the checkpoint are rewritten
+	require.NoError(t, ioutil.WriteFile(cpInfos[0].Path, cp7Data, 0644))
+	require.NoError(t, ioutil.WriteFile(cpInfos[1].Path, cp6Data, 0644))
+	require.NoError(t, ioutil.WriteFile(cpInfos[2].Path, cp3Data, 0644))
+	restored, err := NewDocHistoryFromFile(filePath, walPath, cpDir)
+	require.NoError(t, err)
+	require.Error(t, restored.RemoveVersion(7))
+	require.NoError(t, restored.RemoveVersion(8))
+	require.NoError(t, restored.Close())
+	checkRestored(restored, []int{7})
+}
+
+// Test keeps versions rewritable if the checkpoint write fails.
+func Test_Checkpoint_WriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath, walPath, cpDir := filepath.Join(dir, "base.dat"), filepath.Join(dir, "history.wal"), filepath.Join(dir, "checkpoints")
+	require.NoError(t, os.Mkdir(cpDir, 0755))
+	require.NoError(t, GenAndSaveInitialStorage(filePath, 100, testCodec))
+
+	h, err := NewDocHistoryFromFile(filePath, walPath, cpDir)
+	require.NoError(t, err)
+
+	ids := make([]string, 0)
+	for _, item := range h.storage.Export() {
+		ids = append(ids, item.Id)
+	}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 20)...))
+	}
+
+	// Missing directory
+	_, written, err := h.WriteCheckpoint(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+	require.False(t, written)
+	require.Equal(t, 0, h.frozenVersion)
+	require.Equal(t, 0, h.checkpointingVersion)
+
+	// Versions are not frozen: the rewrite is logged to the new segment
+	require.NoError(t, h.RemoveVersion(3))
+	require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 20)...))
+
+	// The checkpointing version can't be rewritten
+	h.checkpointingVersion = h.latestVersion
+	require.Error(t, h.RemoveVersion(h.latestVersion))
+	h.checkpointingVersion = 0
+
+	// An older version state is built
+	items, err := h.exportVersionItems(2)
+	require.NoError(t, err)
+	storage, err := h.BuildStorage(2)
+	require.NoError(t, err)
+	require.ElementsMatch(t, storage.exportItems(), items)
+
+	version, written, err := h.WriteCheckpoint(cpDir)
+	require.NoError(t, err)
+	require.True(t, written)
+	require.Equal(t, h.latestVersion, version)
+	require.Equal(t, version, h.frozenVersion)
+	require.Error(t, h.RemoveVersion(version))
+	require.NoError(t, h.Close())
+
+	restored, err := NewDocHistoryFromFile(filePath, walPath, cpDir)
+	require.NoError(t, err)
+	require.Equal(t, h.latestVersion, restored.latestVersion)
+	require.Equal(t, h.storage.Export(), restored.storage.Export())
+	require.NoError(t, restored.Close())
+}
@@ -1,13 +1,28 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/itiky/collaborate-storage/model"
 )
 
+// ErrResyncRequired is returned when a client snapshot version can't be upgraded with a diff.
+// Client must download the latest snapshot.
+var ErrResyncRequired = errors.New("resync required")
+
+// ErrSnapshotRequired is returned when a client snapshot version is older than the history retention window.
+// Client must download the latest snapshot.
+var ErrSnapshotRequired = errors.New("snapshot required")
+
 type (
 	// DocumentHistory keeps the document history alongside cache used to client requests.
+	// Version number is never reused: rewritten documents get new versions, so a version always identifies the same state.
+	// Versions missing in the history (removed or rewritten) are not served anymore.
 	DocumentHistory struct {
 		sync.RWMutex
 		// List of document versions
@@ -16,72 +31,210 @@ type (
 		storage *Storage
 		// The current document version
 		latestVersion int
+		// The next document version
+		nextVersion int
+		// Write-ahead log (optional)
+		wal *WAL
+		// Base file checksum (used to match WAL and checkpoints)
+		baseChecksum uint32
+		// The latest written checkpoint version
+		checkpointVersion int
+		// The latest written checkpoint version (WAL segment following it doesn't have older versions), it and older versions can't be rewritten
+		frozenVersion int
+		// The version a checkpoint is being written for (0 - none), it and older versions can't be rewritten until it is done
+		checkpointingVersion int
+		// Storage states used to build previous versions (sorted by version)
+		snapshotSources []snapshotSource
+		// Closed on the latest version change (replaced with a new one)
+		versionCh chan struct{}
+		// The highest update request sequence number applied per client (used to drop duplicates)
+		clientSequences map[model.ClientId]uint64
+	}
+
+	// snapshotSource loads a Storage state for the version (base file, checkpoint).
+	snapshotSource struct {
+		Version int
+		// Source description
+		Name string
+		Load func() (*Storage, error)
 	}
 
 	Document struct {
 		Version int
+		// Document commit time
+		CreatedAt time.Time
 		// Storage operations to apply on previous document version in order to upgrade it
 		InputOperations []StorageOperation
 		// Client model.StorageList operations to apply in order to upgrade it
 		OutputOperations []model.ListOperation
+		// Storage state checksum after InputOperations were applied (refer to Storage.Checksum)
+		Checksum uint64
+		// Item states before InputOperations were applied (used to rollback the storage state)
+		revisions []itemRevision
+		// InputOperations that changed the storage state (used to squash documents)
+		applied []bool
+		// Document state was loaded from a snapshot (can't be rolled back)
+		isSnapshot bool
 	}
 )
 
 // AddVersion adds a new Document version caching input/output operations.
-func (h *DocumentHistory) AddVersion(stOps ...StorageOperation) {
+// Version is written to WAL (if set) before it becomes visible.
+func (h *DocumentHistory) AddVersion(stOps ...StorageOperation) error {
+	_, _, err := h.CommitVersion(stOps, nil)
+
+	return err
+}
+
+// CommitVersion adds a new Document version (refer to AddVersion) and updates the client sequence numbers applied.
+// No version is added if there are no operations, client sequence numbers are still recorded.
+// Returns the version and the per-operation results: operation changed the storage state, had no effect or was rejected.
+func (h *DocumentHistory) CommitVersion(stOps []StorageOperation, clientSequences map[model.ClientId]uint64) (int, []OperationResult, error) {
+	h.Lock()
+	defer h.Unlock()
+
 	if len(stOps) == 0 {
-		return
+		return h.latestVersion, nil, h.commitClientSequences(clientSequences)
+	}
+
+	createdAt := time.Now().UTC()
+	rec := walRecord{
+		Type:            walRecordTypeAdd,
+		Version:         h.nextVersion,
+		CreatedAt:       createdAt,
+		Operations:      stOps,
+		ClientSequences: clientSequences,
+	}
+	if err := h.writeWAL(rec); err != nil {
+		return h.latestVersion, nil, err
+	}
+
+	h.setClientSequences(clientSequences)
+	results := h.appendDocument(stOps, createdAt)
+
+	return h.latestVersion, results, nil
+}
+
+// commitClientSequences writes the client sequence numbers advanced to WAL and updates them.
+func (h *DocumentHistory) commitClientSequences(clientSequences map[model.ClientId]uint64) error {
+	advanced := false
+	for clientId, sequence := range clientSequences {
+		if sequence > h.clientSequences[clientId] {
+			advanced = true
+			break
+		}
+	}
+	if !advanced {
+		return nil
+	}
+
+	rec := walRecord{
+		Type:            walRecordTypeSequences,
+		ClientSequences: clientSequences,
+	}
+	if err := h.writeWAL(rec); err != nil {
+		return err
 	}
+	h.setClientSequences(clientSequences)
+
+	return nil
+}
 
+// RemoveVersion removes an existing version.
+// All the later versions are rebuilt and get new version numbers, so clients with a version starting from
+// the removed one must redownload the latest version (ErrResyncRequired).
+func (h *DocumentHistory) RemoveVersion(version int) error {
 	h.Lock()
 	defer h.Unlock()
 
-	// Update the storage state
-	listOps := h.storage.ApplyOperations(stOps...)
+	docIdx, err := h.getRewriteDocIdx(version)
+	if err != nil {
+		return err
+	}
 
-	// Add a new document version
-	stOpsCopy := make([]StorageOperation, len(stOps))
-	copy(stOpsCopy, stOps)
-	newDoc := Document{
-		InputOperations:  stOpsCopy,
-		OutputOperations: listOps,
+	rec := walRecord{
+		Type:    walRecordTypeRemove,
+		Version: version,
+	}
+	if err := h.writeWAL(rec); err != nil {
+		return err
 	}
 
-	historyLen := len(h.documents)
-	if historyLen > 0 {
-		newDoc.Version = h.documents[historyLen-1].Version + 1
+	h.rewrite(docIdx, nil, true, time.Time{})
+
+	return nil
+}
+
+// ReplaceVersion replaces an existing version input operations.
+// The version and all the later ones are rebuilt and get new version numbers, so clients with a version starting
+// from the replaced one must redownload the latest version (ErrResyncRequired).
+func (h *DocumentHistory) ReplaceVersion(version int, stOps ...StorageOperation) error {
+	h.Lock()
+	defer h.Unlock()
+
+	docIdx, err := h.getRewriteDocIdx(version)
+	if err != nil {
+		return err
 	}
 
-	h.documents = append(h.documents, newDoc)
+	createdAt := time.Now().UTC()
+	rec := walRecord{
+		Type:       walRecordTypeReplace,
+		Version:    version,
+		CreatedAt:  createdAt,
+		Operations: stOps,
+	}
+	if err := h.writeWAL(rec); err != nil {
+		return err
+	}
 
-	// Update the version
-	h.latestVersion = len(h.documents) - 1
+	h.rewrite(docIdx, stOps, false, createdAt)
+
+	return nil
 }
 
-// RemoveVersion removes an existing version.
-// All the client must be notified to redownload the latest version (as it might change).
-// TODO: that requires rebuilding the cache for [version:] documents
-func (h *DocumentHistory) RemoveVersion(version int) {
-	panic("not implemented")
+// Close closes the history WAL (if set).
+func (h *DocumentHistory) Close() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.wal == nil {
+		return nil
+	}
+
+	return h.wal.Close()
 }
 
 // GetOutputDiffWithLatest returns snapshot version and model.ListOperation objects
 // for client to apply on a local snapshot in order to upgrade it to the latest one.
-func (h *DocumentHistory) GetOutputDiffWithLatest(version int) (int, []model.ListOperation) {
+// Documents output operations are coalesced if that reduces the number of operations.
+// Returns ErrSnapshotRequired if version is older than the oldest one served, ErrResyncRequired if version is not served anymore.
+func (h *DocumentHistory) GetOutputDiffWithLatest(version int) (int, []model.ListOperation, error) {
 	h.RLock()
 	defer h.RUnlock()
 
-	startVersion := version + 1
-	if !h.IsVersionValid(startVersion) {
-		return version, nil
+	if version < h.documents[0].Version {
+		return h.latestVersion, nil, fmt.Errorf("version %d: older than v%d: %w", version, h.documents[0].Version, ErrSnapshotRequired)
+	}
+
+	docIdx, found := h.findDocument(version)
+	if !found {
+		return h.latestVersion, nil, fmt.Errorf("version %d: %w", version, ErrResyncRequired)
 	}
 
 	diffOps := make([]model.ListOperation, 0)
-	for i := startVersion; i <= h.latestVersion; i++ {
+	for i := docIdx + 1; i < len(h.documents); i++ {
 		diffOps = append(diffOps, h.documents[i].OutputOperations...)
 	}
 
-	return h.latestVersion, diffOps
+	// Lagging clients (more than one version behind) get the coalesced diff (if it is shorter)
+	if lagging := len(h.documents)-1-docIdx > 1; (lagging && len(diffOps) > 1) || len(diffOps) > coalesceSingleVersionMinOps {
+		if coalescedOps := h.coalesceOutputDiff(docIdx, len(h.documents)-1); len(coalescedOps) < len(diffOps) {
+			diffOps = coalescedOps
+		}
+	}
+
+	return h.latestVersion, diffOps, nil
 }
 
 // GetOutputSnapshot returns latest snapshot version and data.
@@ -94,30 +247,403 @@ func (h *DocumentHistory) GetOutputSnapshot() (int, model.StorageList) {
 }
 
 // BuildStorage builds a Storage snapshot for the specified version.
-// Makes possible to build a snapshot for all previous document versions.
-func (h *DocumentHistory) BuildStorage(version int) *Storage {
-	if !h.IsVersionValid(version) {
-		return nil
+// Makes possible to build a snapshot for all previous document versions:
+// the nearest preceding snapshot state (base file, checkpoint) is loaded and rolled forward using documents input operations.
+// If there is no such state (older versions were dropped), the latest state is rolled back.
+func (h *DocumentHistory) BuildStorage(version int) (*Storage, error) {
+	h.RLock()
+
+	docIdx, found := h.findDocument(version)
+	if !found {
+		h.RUnlock()
+		return nil, fmt.Errorf("version %d: not found", version)
+	}
+
+	// The latest version: copy the current state
+	if version == h.latestVersion {
+		defer h.RUnlock()
+		return newStorageFromObjs(h.storage.ValueCodec(), h.storage.exportItems()), nil
+	}
+
+	// Snapshot sources (the nearest first) and documents to roll forward (copied as sources are slow to load)
+	sources := make([]snapshotSource, 0, len(h.snapshotSources))
+	for i := len(h.snapshotSources) - 1; i >= 0; i-- {
+		if src := h.snapshotSources[i]; src.Version <= version && h.IsVersionValid(src.Version) {
+			sources = append(sources, src)
+		}
+	}
+	if len(sources) == 0 {
+		defer h.RUnlock()
+		return h.buildStorageByRollback(docIdx), nil
 	}
+	docs := make([]Document, docIdx+1)
+	copy(docs, h.documents[:docIdx+1])
 
-	storage := NewStorage()
-	for i := 0; i <= version; i++ {
-		docOps := h.documents[i].InputOperations
-		storage.ApplyOperations(docOps...)
+	h.RUnlock()
+
+	for _, src := range sources {
+		storage, err := src.Load()
+		if err != nil {
+			log.Printf("DocumentHistory: v%d snapshot source (%s) skipped: %v", src.Version, src.Name, err)
+			continue
+		}
+
+		srcDocIdx := sort.Search(len(docs), func(i int) bool {
+			return docs[i].Version >= src.Version
+		})
+		for i := srcDocIdx + 1; i < len(docs); i++ {
+			storage.ApplyOperations(docs[i].InputOperations...)
+		}
+
+		return storage, nil
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+
+	docIdx, found = h.findDocument(version)
+	if !found {
+		return nil, fmt.Errorf("version %d: not found", version)
+	}
+
+	return h.buildStorageByRollback(docIdx), nil
+}
+
+// buildStorageByRollback copies the latest storage state and rolls it back to the document.
+func (h *DocumentHistory) buildStorageByRollback(docIdx int) *Storage {
+	storage := newStorageFromObjs(h.storage.ValueCodec(), h.storage.exportItems())
+	for i := len(h.documents) - 1; i > docIdx; i-- {
+		storage.rollback(h.documents[i].revisions)
 	}
 
 	return storage
 }
 
+// WaitForVersionChange blocks until the latest version differs from the version or the timeout expires.
+// Returns the latest version.
+func (h *DocumentHistory) WaitForVersionChange(version int, timeout time.Duration) int {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		h.RLock()
+		latestVersion, versionCh := h.latestVersion, h.versionCh
+		h.RUnlock()
+
+		if latestVersion != version {
+			return latestVersion
+		}
+
+		select {
+		case <-versionCh:
+		case <-timer.C:
+			return latestVersion
+		}
+	}
+}
+
+// GetClientSequence returns the highest update request sequence number applied for the client (0 if none).
+func (h *DocumentHistory) GetClientSequence(clientId model.ClientId) uint64 {
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.clientSequences[clientId]
+}
+
+// GetVersionChecksum returns the version storage state checksum (false if the version is not served).
+func (h *DocumentHistory) GetVersionChecksum(version int) (uint64, bool) {
+	h.RLock()
+	defer h.RUnlock()
+
+	docIdx, found := h.findDocument(version)
+	if !found {
+		return 0, false
+	}
+
+	return h.documents[docIdx].Checksum, true
+}
+
+// GetLatestVersion returns the latest document version.
+func (h *DocumentHistory) GetLatestVersion() int {
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.latestVersion
+}
+
+// ValueCodec returns the codec used to compare storage values.
+func (h *DocumentHistory) ValueCodec() model.ValueCodec {
+	return h.storage.ValueCodec()
+}
+
 // IsVersionValid checks if document version exists.
 func (h *DocumentHistory) IsVersionValid(version int) bool {
-	return version < len(h.documents)
+	_, found := h.findDocument(version)
+
+	return found
+}
+
+// appendDocument applies storage operations and adds a new Document version.
+// Returns the per-operation results.
+func (h *DocumentHistory) appendDocument(stOps []StorageOperation, createdAt time.Time) []OperationResult {
+	// Update the storage state
+	revisions := make([]itemRevision, 0, len(stOps))
+	results := make([]OperationResult, len(stOps))
+	listOps := h.storage.applyOperations(stOps, &revisions, results)
+	applied := make([]bool, len(stOps))
+	for i, result := range results {
+		applied[i] = result.Applied
+	}
+
+	// Add a new document version
+	stOpsCopy := make([]StorageOperation, len(stOps))
+	copy(stOpsCopy, stOps)
+	newDoc := Document{
+		Version:          h.nextVersion,
+		CreatedAt:        createdAt,
+		InputOperations:  stOpsCopy,
+		OutputOperations: listOps,
+		Checksum:         h.storage.Checksum(),
+		revisions:        revisions,
+		applied:          applied,
+	}
+	h.documents = append(h.documents, newDoc)
+
+	// Update the version
+	h.latestVersion = newDoc.Version
+	h.nextVersion++
+	h.notifyVersionChange()
+
+	return results
+}
+
+// setClientSequences updates the highest client sequence numbers applied.
+func (h *DocumentHistory) setClientSequences(clientSequences map[model.ClientId]uint64) {
+	for clientId, sequence := range clientSequences {
+		if sequence > h.clientSequences[clientId] {
+			h.clientSequences[clientId] = sequence
+		}
+	}
+}
+
+// notifyVersionChange wakes up the latest version change waiters.
+func (h *DocumentHistory) notifyVersionChange() {
+	close(h.versionCh)
+	h.versionCh = make(chan struct{})
+}
+
+// getRewriteDocIdx returns the document index for version to be rewritten.
+func (h *DocumentHistory) getRewriteDocIdx(version int) (int, error) {
+	docIdx, found := h.findDocument(version)
+	if !found {
+		return -1, fmt.Errorf("version %d: not found", version)
+	}
+	// Checkpoint state and the following WAL segment would not match the rewritten history
+	frozenVersion := h.frozenVersion
+	if h.checkpointingVersion > frozenVersion {
+		frozenVersion = h.checkpointingVersion
+	}
+	if version <= frozenVersion {
+		return -1, fmt.Errorf("version %d: included into the checkpoint v%d", version, frozenVersion)
+	}
+	for i := docIdx; i < len(h.documents); i++ {
+		if h.documents[i].isSnapshot {
+			return -1, fmt.Errorf("version %d: snapshot version can't be rewritten", h.documents[i].Version)
+		}
+	}
+
+	return docIdx, nil
+}
+
+// rewrite rolls the storage state back to the document preceding the specified one and rebuilds all the later documents.
+// The document is removed or its input operations are replaced.
+func (h *DocumentHistory) rewrite(docIdx int, stOps []StorageOperation, remove bool, createdAt time.Time) {
+	// Rollback the storage state
+	for i := len(h.documents) - 1; i >= docIdx; i-- {
+		h.storage.rollback(h.documents[i].revisions)
+	}
+
+	laterDocs := make([]Document, len(h.documents)-docIdx-1)
+	copy(laterDocs, h.documents[docIdx+1:])
+	h.documents = h.documents[:docIdx]
+
+	// Rebuild versions
+	if !remove {
+		h.appendDocument(stOps, createdAt)
+	}
+	for _, doc := range laterDocs {
+		h.appendDocument(doc.InputOperations, doc.CreatedAt)
+	}
+
+	h.latestVersion = h.documents[len(h.documents)-1].Version
+	h.notifyVersionChange()
+}
+
+// writeWAL writes the change record to WAL (if set).
+func (h *DocumentHistory) writeWAL(rec walRecord) error {
+	if h.wal == nil {
+		return nil
+	}
+
+	if err := h.wal.Append(rec); err != nil {
+		return fmt.Errorf("WAL append: %w", err)
+	}
+
+	return nil
+}
+
+// applyWALRecord applies the change record read from WAL.
+func (h *DocumentHistory) applyWALRecord(rec walRecord) error {
+	switch rec.Type {
+	case walRecordTypeHeader:
+		if rec.BaseChecksum != h.baseChecksum {
+			return fmt.Errorf("base state checksum mismatch: WAL was written for a different base file")
+		}
+		if rec.ValueCodec != h.storage.ValueCodec().Name() {
+			return fmt.Errorf("value codec mismatch: %s / %s", rec.ValueCodec, h.storage.ValueCodec().Name())
+		}
+	case walRecordTypeAdd:
+		if rec.Version != h.nextVersion {
+			return fmt.Errorf("version %d: expected %d", rec.Version, h.nextVersion)
+		}
+		h.setClientSequences(rec.ClientSequences)
+		h.appendDocument(rec.Operations, rec.CreatedAt)
+	case walRecordTypeSequences:
+		h.setClientSequences(rec.ClientSequences)
+	case walRecordTypeRemove:
+		docIdx, err := h.getRewriteDocIdx(rec.Version)
+		if err != nil {
+			return err
+		}
+		h.rewrite(docIdx, nil, true, time.Time{})
+	case walRecordTypeReplace:
+		docIdx, err := h.getRewriteDocIdx(rec.Version)
+		if err != nil {
+			return err
+		}
+		h.rewrite(docIdx, rec.Operations, false, rec.CreatedAt)
+	case walRecordTypeSquash:
+		// Versions up to the loaded checkpoint are already folded into its state
+		if snapshotVersion := h.documents[0].Version; rec.Version <= snapshotVersion {
+			if rec.ToVersion <= snapshotVersion || len(h.documents) < 2 || h.documents[1].Version >= rec.ToVersion {
+				break
+			}
+			rec.Version = h.documents[1].Version
+		}
+
+		fromIdx, toIdx, err := h.getSquashDocIdxs(rec.Version, rec.ToVersion)
+		if err != nil {
+			return err
+		}
+		h.squash(fromIdx, toIdx)
+	default:
+		return fmt.Errorf("unknown record type")
+	}
+
+	return nil
+}
+
+// attachWAL replays the WAL records (starting from the segment) on top of the current state and attaches it for new changes.
+// The first skipRecords segment records are already applied to the state (loaded from a checkpoint), only headers are checked.
+func (h *DocumentHistory) attachWAL(wal *WAL, fromSegment, skipRecords int) error {
+	h.Lock()
+	defer h.Unlock()
+
+	fromSegmentRecords := 0
+	err := wal.replay(fromSegment, func(segment, recIdx int, rec walRecord) error {
+		if segment != fromSegment {
+			return h.applyWALRecord(rec)
+		}
+
+		fromSegmentRecords++
+		if recIdx < skipRecords && rec.Type != walRecordTypeHeader {
+			return nil
+		}
+
+		return h.applyWALRecord(rec)
+	})
+	if err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+	if fromSegmentRecords < skipRecords {
+		return fmt.Errorf("WAL segment %d has %d records, %d are expected", fromSegment, fromSegmentRecords, skipRecords)
+	}
+
+	if wal.Records() == 0 {
+		rec := walRecord{
+			Type:         walRecordTypeHeader,
+			BaseChecksum: h.baseChecksum,
+			ValueCodec:   h.storage.ValueCodec().Name(),
+		}
+		if err := wal.Append(rec); err != nil {
+			return fmt.Errorf("header append: %w", err)
+		}
+	}
+	h.wal = wal
+
+	return nil
+}
+
+// addSnapshotSource adds the snapshot source replacing the same version one.
+// Sources for versions not served anymore are dropped.
+func (h *DocumentHistory) addSnapshotSource(src snapshotSource) {
+	sources := make([]snapshotSource, 0, len(h.snapshotSources)+1)
+	for _, curSrc := range h.snapshotSources {
+		if curSrc.Version != src.Version && h.IsVersionValid(curSrc.Version) {
+			sources = append(sources, curSrc)
+		}
+	}
+	sources = append(sources, src)
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Version < sources[j].Version
+	})
+
+	h.snapshotSources = sources
+}
+
+// findDocument returns the document index by version.
+func (h *DocumentHistory) findDocument(version int) (int, bool) {
+	docIdx := sort.Search(len(h.documents), func(i int) bool {
+		return h.documents[i].Version >= version
+	})
+	if docIdx == len(h.documents) || h.documents[docIdx].Version != version {
+		return -1, false
+	}
+
+	return docIdx, true
+}
+
+// NewDocumentHistory creates a new DocumentHistory object with an empty storage snapshot (v0).
+func NewDocumentHistory(codec model.ValueCodec) *DocumentHistory {
+	h := newDocumentHistory(NewStorage(codec))
+	h.snapshotSources = []snapshotSource{
+		{
+			Version: 0,
+			Name:    "empty",
+			Load: func() (*Storage, error) {
+				return NewStorage(codec), nil
+			},
+		},
+	}
+
+	return h
 }
 
-// NewDocumentHistory creates a new empty DocumentHistory object.
-func NewDocumentHistory() *DocumentHistory {
+// newDocumentHistory creates a new DocumentHistory object with the storage snapshot (v0).
+func newDocumentHistory(storage *Storage) *DocumentHistory {
 	return &DocumentHistory{
-		documents: make([]Document, 0),
-		storage:   NewStorage(),
+		documents: []Document{
+			{
+				Version:    0,
+				CreatedAt:  time.Now().UTC(),
+				Checksum:   storage.Checksum(),
+				isSnapshot: true,
+			},
+		},
+		storage:         storage,
+		latestVersion:   0,
+		nextVersion:     1,
+		versionCh:       make(chan struct{}),
+		clientSequences: make(map[model.ClientId]uint64),
 	}
 }
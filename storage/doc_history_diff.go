@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// A single version diff is coalesced only if it has more operations than this (coalescing costs more than sending a short diff).
+const coalesceSingleVersionMinOps = 1000
+
+// coalesceOutputDiff builds the minimal model.ListOperation sequence upgrading the fromIdx document version list to the toIdx one.
+// Only the net item changes are included (items inserted and deleted afterwards are dropped, multiple updates are merged):
+// deletes of changed items existed at the fromIdx version (the descending index order) followed by
+// inserts of changed items existing at the toIdx version (the ascending index order).
+// Item states at a document version are taken from the later documents revisions (the latest state if not changed afterwards).
+func (h *DocumentHistory) coalesceOutputDiff(fromIdx, toIdx int) []model.ListOperation {
+	// Item states at the fromIdx version (the first revision per item within the range)
+	prevItems := h.getFirstRevisions(fromIdx+1, toIdx)
+	// Item states at the toIdx version for items changed after it
+	laterItems := h.getFirstRevisions(toIdx+1, len(h.documents)-1)
+
+	// The toIdx version list differs from the latest one by items changed after it:
+	// an item rank = latest items less than it - later changed latest items less than it + later changed toIdx items less than it
+	laterLatest := make([]*Item, 0, len(laterItems))
+	laterTo := make([]*Item, 0, len(laterItems))
+	for itemIdStr, toItem := range laterItems {
+		if curItem := getLiveItem(h.storage.idDataMatch[itemIdStr]); curItem != nil {
+			laterLatest = append(laterLatest, curItem)
+		}
+		if toItem = getLiveItem(toItem); toItem != nil {
+			laterTo = append(laterTo, toItem)
+		}
+	}
+	h.sortItems(laterLatest)
+	h.sortItems(laterTo)
+	rank := func(item *Item) int {
+		return h.storage.index.Rank(item) - h.countItemsLess(laterLatest, item) + h.countItemsLess(laterTo, item)
+	}
+
+	// Changed items: prev (existed at the fromIdx version) and cur (exist at the toIdx version)
+	prevChanged := make([]*Item, 0, len(prevItems))
+	curChanged := make([]*Item, 0, len(prevItems))
+	for itemIdStr, prevItem := range prevItems {
+		prevItem = getLiveItem(prevItem)
+		curItem, found := laterItems[itemIdStr]
+		if !found {
+			curItem = h.storage.idDataMatch[itemIdStr]
+		}
+		curItem = getLiveItem(curItem)
+
+		if prevItem != nil && curItem != nil && bytes.Equal(prevItem.Value, curItem.Value) {
+			continue
+		}
+		if prevItem != nil {
+			prevChanged = append(prevChanged, prevItem)
+		}
+		if curItem != nil {
+			curChanged = append(curChanged, curItem)
+		}
+	}
+	h.sortItems(prevChanged)
+	h.sortItems(curChanged)
+
+	listOps := make([]model.ListOperation, len(prevChanged), len(prevChanged)+len(curChanged))
+
+	// Deletes: the fromIdx version list differs from the toIdx one by changed items only,
+	// so an item index = latest items less than it - changed latest items less than it + changed prev items less than it
+	curLessCnt := 0
+	for i, prevItem := range prevChanged {
+		for curLessCnt < len(curChanged) && h.storage.itemLess(curChanged[curLessCnt], prevItem) {
+			curLessCnt++
+		}
+
+		listOps[len(prevChanged)-1-i] = model.ListOperation{
+			Type:  model.DeleteOperationType,
+			Id:    prevItem.Id.String(),
+			Index: rank(prevItem) - curLessCnt + i,
+		}
+	}
+
+	// Inserts: unchanged items are left, so inserting in the ascending order gives the toIdx version indexes
+	for _, curItem := range curChanged {
+		listOps = append(listOps, model.ListOperation{
+			Type:  model.InsertOperationType,
+			Id:    curItem.Id.String(),
+			Index: rank(curItem),
+			Value: curItem.Value,
+		})
+	}
+
+	return listOps
+}
+
+// getFirstRevisions returns item states before [fromIdx, toIdx] documents (the first revision per item ID).
+func (h *DocumentHistory) getFirstRevisions(fromIdx, toIdx int) map[string]*Item {
+	items := make(map[string]*Item)
+	for i := fromIdx; i <= toIdx; i++ {
+		for _, rev := range h.documents[i].revisions {
+			itemIdStr := rev.Id.String()
+			if _, found := items[itemIdStr]; !found {
+				items[itemIdStr] = rev.Item
+			}
+		}
+	}
+
+	return items
+}
+
+// sortItems sorts items using the storage sort order.
+func (h *DocumentHistory) sortItems(items []*Item) {
+	sort.Slice(items, func(i, j int) bool {
+		return h.storage.itemLess(items[i], items[j])
+	})
+}
+
+// countItemsLess returns the number of sorted items less than the item.
+func (h *DocumentHistory) countItemsLess(items []*Item, item *Item) int {
+	return sort.Search(len(items), func(i int) bool {
+		return !h.storage.itemLess(items[i], item)
+	})
+}
+
+// getLiveItem returns nil for a missing or deleted item.
+func getLiveItem(item *Item) *Item {
+	if item != nil && item.IsDeleted {
+		return nil
+	}
+
+	return item
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// Approximate memory used by a single operation / revision excluding the value
+	docInputOpSizeEstimate  = 96
+	docOutputOpSizeEstimate = 112
+	docRevisionSizeEstimate = 112
+)
+
+type (
+	// RetentionPolicy defines which old Document versions are dropped from the history.
+	// Zero values disable the corresponding rule.
+	RetentionPolicy struct {
+		// Versions older than latestVersion - KeepVersions are dropped
+		KeepVersions int
+		// Versions created earlier than now - MaxAge are dropped
+		MaxAge time.Duration
+		// The oldest versions are dropped until the history estimated memory usage is below the limit [bytes]
+		MaxMemory int64
+	}
+)
+
+// IsEnabled checks if any policy rule is set.
+func (p RetentionPolicy) IsEnabled() bool {
+	return p.KeepVersions > 0 || p.MaxAge > 0 || p.MaxMemory > 0
+}
+
+// Validate validates the policy.
+func (p RetentionPolicy) Validate() error {
+	if p.KeepVersions < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "KeepVersions")
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "MaxAge")
+	}
+	if p.MaxMemory < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "MaxMemory")
+	}
+
+	return nil
+}
+
+// ApplyRetentionPolicy drops the versions matching the policy.
+// The newest expired version becomes the oldest one served (diffs are built starting from it),
+// clients with older versions must redownload the latest version (ErrSnapshotRequired).
+// Dropping is not written to WAL: versions restored from it are served until the policy is applied again (on service start).
+// Returns the oldest version served and the number of versions dropped.
+func (h *DocumentHistory) ApplyRetentionPolicy(policy RetentionPolicy, now time.Time) (int, int) {
+	h.Lock()
+	defer h.Unlock()
+
+	if !policy.IsEnabled() {
+		return h.documents[0].Version, 0
+	}
+
+	// Documents are checked from the newest to the oldest one (the latest one is always kept):
+	// rules are monotonic, so all the documents older than the first expired one are expired too
+	latestIdx := len(h.documents) - 1
+	baseIdx := 0
+	memoryUsed := h.documents[latestIdx].sizeEstimate()
+	for docIdx := latestIdx - 1; docIdx > 0; docIdx-- {
+		doc := h.documents[docIdx]
+		memoryUsed += doc.sizeEstimate()
+
+		isExpired := false
+		if policy.KeepVersions > 0 && doc.Version < h.latestVersion-policy.KeepVersions {
+			isExpired = true
+		}
+		if policy.MaxAge > 0 && now.Sub(doc.CreatedAt) > policy.MaxAge {
+			isExpired = true
+		}
+		if policy.MaxMemory > 0 && memoryUsed > policy.MaxMemory {
+			isExpired = true
+		}
+		if isExpired {
+			baseIdx = docIdx
+			break
+		}
+	}
+
+	// Documents before the new base one are dropped
+	droppedCnt := baseIdx
+	if droppedCnt == 0 {
+		return h.documents[0].Version, 0
+	}
+
+	// The base document operations are not needed anymore: diffs are built using the later ones
+	documents := make([]Document, len(h.documents)-baseIdx)
+	copy(documents, h.documents[baseIdx:])
+	documents[0].InputOperations = nil
+	documents[0].OutputOperations = nil
+	documents[0].revisions = nil
+	documents[0].isSnapshot = true
+	h.documents = documents
+
+	sources := make([]snapshotSource, 0, len(h.snapshotSources))
+	for _, src := range h.snapshotSources {
+		if h.IsVersionValid(src.Version) {
+			sources = append(sources, src)
+		}
+	}
+	h.snapshotSources = sources
+
+	return h.documents[0].Version, droppedCnt
+}
+
+// sizeEstimate returns an approximate Document memory usage [bytes].
+func (d Document) sizeEstimate() int64 {
+	size := int64(len(d.InputOperations)*docInputOpSizeEstimate + len(d.OutputOperations)*docOutputOpSizeEstimate + len(d.revisions)*docRevisionSizeEstimate)
+	for _, op := range d.InputOperations {
+		if setOp, ok := op.(SetOperation); ok {
+			size += int64(len(setOp.Value))
+		}
+	}
+	for _, op := range d.OutputOperations {
+		size += int64(len(op.Value))
+	}
+	for _, rev := range d.revisions {
+		if rev.Item != nil {
+			size += int64(len(rev.Item.Value))
+		}
+	}
+
+	return size
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+type (
+	// SquashPolicy defines which Document versions are squashed automatically.
+	// Zero values disable the corresponding rule.
+	SquashPolicy struct {
+		// Versions older than latestVersion - KeepVersions are squashed
+		KeepVersions int
+		// Versions created earlier than now - MaxAge are squashed
+		MaxAge time.Duration
+	}
+)
+
+// IsEnabled checks if any policy rule is set.
+func (p SquashPolicy) IsEnabled() bool {
+	return p.KeepVersions > 0 || p.MaxAge > 0
+}
+
+// Validate validates the policy.
+func (p SquashPolicy) Validate() error {
+	if p.KeepVersions < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "KeepVersions")
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("%s: must be GTE 0", "MaxAge")
+	}
+
+	return nil
+}
+
+// Squash merges [fromVersion, toVersion] Document versions into one with the toVersion version.
+// Input operations are folded (intermediate writes per item ID are dropped, modes and conflict policies are kept),
+// output operations are coalesced (if that reduces the number of operations).
+// Clients with a version within [fromVersion, toVersion) must redownload the latest version (ErrResyncRequired).
+func (h *DocumentHistory) Squash(fromVersion, toVersion int) error {
+	h.Lock()
+	defer h.Unlock()
+
+	fromIdx, toIdx, err := h.getSquashDocIdxs(fromVersion, toVersion)
+	if err != nil {
+		return err
+	}
+
+	return h.writeWALAndSquash(fromIdx, toIdx)
+}
+
+// ApplySquashPolicy squashes all the versions matching the policy (except the latest one) into one.
+// Returns the squashed versions range (if any).
+func (h *DocumentHistory) ApplySquashPolicy(policy SquashPolicy, now time.Time) (int, int, bool, error) {
+	if !policy.IsEnabled() {
+		return 0, 0, false, nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	// Squash range starts right after the latest snapshot
+	fromIdx := 0
+	for i := len(h.documents) - 1; i >= 0; i-- {
+		if h.documents[i].isSnapshot {
+			fromIdx = i + 1
+			break
+		}
+	}
+
+	toIdx := -1
+	for i := fromIdx; i < len(h.documents)-1; i++ {
+		doc := h.documents[i]
+
+		isOld := false
+		if policy.KeepVersions > 0 && doc.Version <= h.latestVersion-policy.KeepVersions {
+			isOld = true
+		}
+		if policy.MaxAge > 0 && now.Sub(doc.CreatedAt) > policy.MaxAge {
+			isOld = true
+		}
+		if !isOld {
+			break
+		}
+		toIdx = i
+	}
+
+	if toIdx <= fromIdx {
+		return 0, 0, false, nil
+	}
+
+	fromVersion, toVersion := h.documents[fromIdx].Version, h.documents[toIdx].Version
+	if err := h.writeWALAndSquash(fromIdx, toIdx); err != nil {
+		return 0, 0, false, err
+	}
+
+	return fromVersion, toVersion, true, nil
+}
+
+// getSquashDocIdxs returns the documents range indexes for versions to be squashed.
+func (h *DocumentHistory) getSquashDocIdxs(fromVersion, toVersion int) (int, int, error) {
+	fromIdx, found := h.findDocument(fromVersion)
+	if !found {
+		return -1, -1, fmt.Errorf("fromVersion %d: not found", fromVersion)
+	}
+	toIdx, found := h.findDocument(toVersion)
+	if !found {
+		return -1, -1, fmt.Errorf("toVersion %d: not found", toVersion)
+	}
+	if fromIdx >= toIdx {
+		return -1, -1, fmt.Errorf("fromVersion %d: must be LT toVersion %d", fromVersion, toVersion)
+	}
+	for i := fromIdx; i <= toIdx; i++ {
+		if h.documents[i].isSnapshot {
+			return -1, -1, fmt.Errorf("version %d: snapshot version can't be squashed", h.documents[i].Version)
+		}
+	}
+
+	return fromIdx, toIdx, nil
+}
+
+// writeWALAndSquash writes the squash record to WAL (if set) and merges [fromIdx, toIdx] documents.
+func (h *DocumentHistory) writeWALAndSquash(fromIdx, toIdx int) error {
+	rec := walRecord{
+		Type:      walRecordTypeSquash,
+		Version:   h.documents[fromIdx].Version,
+		ToVersion: h.documents[toIdx].Version,
+	}
+	if err := h.writeWAL(rec); err != nil {
+		return err
+	}
+
+	h.squash(fromIdx, toIdx)
+
+	return nil
+}
+
+// squash merges [fromIdx, toIdx] documents.
+func (h *DocumentHistory) squash(fromIdx, toIdx int) {
+	docs := h.documents[fromIdx : toIdx+1]
+	mergedDoc := Document{
+		Version:         docs[len(docs)-1].Version,
+		CreatedAt:       docs[len(docs)-1].CreatedAt,
+		InputOperations: squashStorageOperations(h.storage.ValueCodec(), docs),
+		Checksum:        docs[len(docs)-1].Checksum,
+	}
+	mergedDoc.applied = make([]bool, len(mergedDoc.InputOperations))
+	for i := range mergedDoc.applied {
+		mergedDoc.applied[i] = true
+	}
+	for _, doc := range docs {
+		mergedDoc.OutputOperations = append(mergedDoc.OutputOperations, doc.OutputOperations...)
+		mergedDoc.revisions = append(mergedDoc.revisions, doc.revisions...)
+	}
+	if coalescedOps := h.coalesceOutputDiff(fromIdx-1, toIdx); len(coalescedOps) < len(mergedDoc.OutputOperations) {
+		mergedDoc.OutputOperations = coalescedOps
+	}
+
+	laterDocs := h.documents[toIdx+1:]
+	documents := make([]Document, 0, fromIdx+1+len(laterDocs))
+	documents = append(documents, h.documents[:fromIdx]...)
+	documents = append(documents, mergedDoc)
+	documents = append(documents, laterDocs...)
+	h.documents = documents
+}
+
+// squashStorageOperations folds documents input operations keeping the minimal per item subsequence
+// that leads to the same item state (tombstones included) with the original modes and conflict policies.
+// An operation is dropped if the next one applied to the state before it gives the same result
+// (an update overwrites the previous upsert, an insert + delete keeps both to leave the tombstone).
+// Rejected operations and operations with no effect are dropped.
+func squashStorageOperations(codec model.ValueCodec, docs []Document) []StorageOperation {
+	type itemState struct {
+		// Indexes of operations kept (in order)
+		opIdxs []int
+		// Item states before every operation kept (replayed), nil - item doesn't exist
+		before []*Item
+		// Item state after the last operation kept
+		cur *Item
+	}
+
+	// Items state before the first document
+	items := make(map[string]*itemState)
+	for _, doc := range docs {
+		for _, rev := range doc.revisions {
+			itemIdStr := rev.Id.String()
+			if _, found := items[itemIdStr]; !found {
+				items[itemIdStr] = &itemState{cur: rev.Item}
+			}
+		}
+	}
+
+	ops := make([]StorageOperation, 0)
+	for _, doc := range docs {
+		for i, op := range doc.InputOperations {
+			if doc.applied[i] {
+				ops = append(ops, op)
+			}
+		}
+	}
+
+	keep := make([]bool, len(ops))
+	for opIdx, op := range ops {
+		state, found := items[op.GetId().String()]
+		if !found {
+			continue
+		}
+
+		after, err := applyToItemState(codec, state.cur, op)
+		if err != nil {
+			// Should not happen: the state matches the original one
+			panic(fmt.Errorf("squash: replaying operation %d: %w", opIdx, err))
+		}
+
+		// Drop the previous operations kept while the operation gives the same result without them
+		before := state.cur
+		for n := len(state.opIdxs); n > 0; n-- {
+			result, err := applyToItemState(codec, state.before[n-1], op)
+			if err != nil || !itemStatesEqual(result, after) {
+				break
+			}
+			keep[state.opIdxs[n-1]] = false
+			before = state.before[n-1]
+			state.opIdxs, state.before = state.opIdxs[:n-1], state.before[:n-1]
+		}
+
+		keep[opIdx] = true
+		state.opIdxs, state.before, state.cur = append(state.opIdxs, opIdx), append(state.before, before), after
+	}
+
+	squashedOps := make([]StorageOperation, 0, len(items))
+	for opIdx, op := range ops {
+		if keep[opIdx] {
+			squashedOps = append(squashedOps, op)
+		}
+	}
+
+	return squashedOps
+}
+
+// applyToItemState applies the operation to the item state (nil - item doesn't exist) and returns the new one.
+func applyToItemState(codec model.ValueCodec, item *Item, op StorageOperation) (*Item, error) {
+	s := NewStorage(codec)
+	s.rollback([]itemRevision{{Id: op.GetId(), Item: item}})
+	if _, err := op.Apply(s); err != nil {
+		return nil, err
+	}
+
+	return s.revision(op.GetId()).Item, nil
+}
+
+// itemStatesEqual compares item states (nil - item doesn't exist).
+func itemStatesEqual(a, b *Item) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Id == b.Id && bytes.Equal(a.Value, b.Value) && a.IsDeleted == b.IsDeleted &&
+		a.UpdatedBy == b.UpdatedBy && a.UpdatedAt == b.UpdatedAt
+}
@@ -0,0 +1,681 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// Test removes / replaces versions and checks the rebuilt state and clients diffs.
+func Test_DocumentHistory_Rewrite(t *testing.T) {
+	ids := make([]string, 0)
+	batches := [][]StorageOperation{
+		newTestStorageOps(t, &ids, 20),
+		newTestStorageOps(t, &ids, 20),
+		newTestStorageOps(t, &ids, 20),
+		newTestStorageOps(t, &ids, 20),
+	}
+
+	h := NewDocumentHistory(testCodec)
+	clientLists := make(map[int]model.StorageList)
+	clientLists[0] = nil
+	for _, batch := range batches {
+		h.AddVersion(batch...)
+		clientLists[h.latestVersion] = getTestClientList(t, h, 0, nil)
+	}
+	require.Equal(t, 4, h.latestVersion)
+
+	checkHistory := func(expectedBatches [][]StorageOperation, validVersions, resyncVersions []int) {
+		expected := NewDocumentHistory(testCodec)
+		for _, batch := range expectedBatches {
+			expected.AddVersion(batch...)
+		}
+		require.Equal(t, expected.storage.Export(), h.storage.Export())
+
+		for _, version := range validVersions {
+			list := getTestClientList(t, h, version, clientLists[version])
+			require.Equal(t, h.storage.Export(), list, "client v%d", version)
+		}
+
+		_, listOps, err := h.GetOutputDiffWithLatest(h.latestVersion)
+		require.NoError(t, err)
+		require.Empty(t, listOps)
+		clientLists[h.latestVersion] = h.storage.Export()
+		for _, version := range resyncVersions {
+			_, _, err := h.GetOutputDiffWithLatest(version)
+			require.True(t, errors.Is(err, ErrResyncRequired), "client v%d", version)
+		}
+	}
+
+	// Remove v2: v3, v4 are rebuilt as v5, v6
+	require.NoError(t, h.RemoveVersion(2))
+	require.Equal(t, 6, h.latestVersion)
+	checkHistory([][]StorageOperation{batches[0], batches[2], batches[3]}, []int{0, 1}, []int{2, 3, 4})
+
+	// Replace v5: v5, v6 are rebuilt as v7, v8 (new ids only, as v6 operations are reapplied on top)
+	newBatch := newTestStorageOps(t, &[]string{}, 20)
+	require.NoError(t, h.ReplaceVersion(5, newBatch...))
+	require.Equal(t, 8, h.latestVersion)
+	checkHistory([][]StorageOperation{batches[0], newBatch, batches[3]}, []int{0, 1}, []int{5, 6})
+
+	// Remove the latest version
+	require.NoError(t, h.RemoveVersion(8))
+	require.Equal(t, 7, h.latestVersion)
+	checkHistory([][]StorageOperation{batches[0], newBatch}, []int{0, 1}, []int{8})
+
+	// Versions are not reused
+	h.AddVersion(batches[3]...)
+	require.Equal(t, 9, h.latestVersion)
+	checkHistory([][]StorageOperation{batches[0], newBatch, batches[3]}, []int{0, 1, 7}, []int{8})
+
+	// Invalid versions
+	require.Error(t, h.RemoveVersion(0))
+	require.Error(t, h.RemoveVersion(2))
+	require.Error(t, h.ReplaceVersion(100))
+}
+
+// Test squashes versions and checks folded operations and clients diffs.
+func Test_DocumentHistory_Squash(t *testing.T) {
+	now := model.HLCFromTime(time.Now())
+	newSetOp := func(id string) StorageOperation {
+		op, err := NewSetOperation(id, testCodec.Random(), 0, now)
+		require.NoError(t, err)
+		return op
+	}
+	newDeleteOp := func(id string) StorageOperation {
+		op, err := NewDeleteOperation(id, 0, now)
+		require.NoError(t, err)
+		return op
+	}
+
+	ids := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		ids = append(ids, uuid.New().String())
+	}
+
+	h := NewDocumentHistory(testCodec)
+	clientLists := make(map[int]model.StorageList)
+	addVersion := func(ops ...StorageOperation) {
+		h.AddVersion(ops...)
+		clientLists[h.latestVersion] = h.storage.Export()
+	}
+
+	addVersion(newSetOp(ids[0]), newSetOp(ids[1])) // v1
+	v1Items := h.storage.exportItems()
+	h.addSnapshotSource(snapshotSource{Version: 1, Name: "v1", Load: func() (*Storage, error) {
+		return newStorageFromObjs(testCodec, v1Items), nil
+	}})
+	addVersion(newSetOp(ids[2]), newSetOp(ids[0]), newDeleteOp(ids[1])) // v2
+	addVersion(newDeleteOp(ids[2]), newSetOp(ids[3]), newSetOp(ids[0])) // v3
+	addVersion(newDeleteOp(ids[1]), newSetOp(ids[3]), newSetOp(ids[4])) // v4
+	liveItems := h.storage.exportItems()
+	addVersion(newSetOp(ids[4])) // v5
+	expectedList := h.storage.Export()
+
+	concatOpsCnt := 0
+	for _, doc := range h.documents[2:5] {
+		concatOpsCnt += len(doc.OutputOperations)
+	}
+
+	require.NoError(t, h.Squash(2, 4))
+	require.Equal(t, 5, h.latestVersion)
+	require.Equal(t, []int{0, 1, 4, 5}, getTestVersions(h))
+	require.Equal(t, expectedList, h.storage.Export())
+
+	// Folded input operations: id0 (last update), id1 (delete), id3 (last update), id4 (insert), id2 (insert + delete tombstone)
+	squashedDoc := h.documents[2]
+	squashedIds := make([]string, 0)
+	for _, op := range squashedDoc.InputOperations {
+		squashedIds = append(squashedIds, op.GetId().String())
+	}
+	require.ElementsMatch(t, []string{ids[0], ids[1], ids[2], ids[2], ids[3], ids[4]}, squashedIds)
+
+	// Squashed version rolled forward from the v1 snapshot matches the live state (tombstones included)
+	built, err := h.BuildStorage(4)
+	require.NoError(t, err)
+	require.ElementsMatch(t, liveItems, built.exportItems())
+
+	// Coalesced output operations upgrade v1 to v4
+	require.Less(t, len(squashedDoc.OutputOperations), concatOpsCnt)
+	squashedList, err := model.ApplyListOperations(testCodec, append(model.StorageList(nil), clientLists[1]...), squashedDoc.OutputOperations...)
+	require.NoError(t, err)
+	require.Equal(t, clientLists[4], squashedList)
+
+	// Replay of folded input operations
+	replayed := NewDocumentHistory(testCodec)
+	replayed.AddVersion(h.documents[1].InputOperations...)
+	replayed.AddVersion(squashedDoc.InputOperations...)
+	replayed.AddVersion(h.documents[3].InputOperations...)
+	require.Equal(t, expectedList, replayed.storage.Export())
+	require.ElementsMatch(t, h.storage.exportItems(), replayed.storage.exportItems())
+
+	// Clients diffs
+	for _, version := range []int{0, 1, 4} {
+		list := getTestClientList(t, h, version, clientLists[version])
+		require.Equal(t, expectedList, list, "client v%d", version)
+	}
+	for _, version := range []int{2, 3} {
+		_, _, err := h.GetOutputDiffWithLatest(version)
+		require.True(t, errors.Is(err, ErrResyncRequired), "client v%d", version)
+	}
+
+	// Squashed version rewrite
+	require.NoError(t, h.RemoveVersion(5))
+	require.NoError(t, h.RemoveVersion(4))
+	require.Equal(t, clientLists[1], h.storage.Export())
+
+	// Invalid ranges
+	require.Error(t, h.Squash(0, 1))
+	require.Error(t, h.Squash(1, 1))
+	require.Error(t, h.Squash(1, 2))
+}
+
+// Test squashes operations with modes and conflict policies keeping them (and tombstones).
+func Test_DocumentHistory_SquashModes(t *testing.T) {
+	clock, err := model.NewHLClock(0)
+	require.NoError(t, err)
+	newOp := func(newFn func(string, model.StorageValue, model.ClientId, model.HLC) (SetOperation, error), id string, conflict ConflictPolicy) StorageOperation {
+		op, err := newFn(id, testCodec.Random(), 1, clock.Now())
+		require.NoError(t, err)
+		op.Conflict = conflict
+		return op
+	}
+	newDeleteOp := func(id string, mustExist bool) StorageOperation {
+		op, err := NewDeleteOperation(id, 1, clock.Now())
+		require.NoError(t, err)
+		op.MustExist = mustExist
+		return op
+	}
+
+	ids := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		ids = append(ids, uuid.New().String())
+	}
+
+	h := NewDocumentHistory(testCodec)
+	h.AddVersion(newOp(NewInsertOperation, ids[0], DeleteWinsConflictPolicy), newOp(NewInsertOperation, ids[1], DeleteWinsConflictPolicy)) // v1
+	v1Items := h.storage.exportItems()
+	h.addSnapshotSource(snapshotSource{Version: 1, Name: "v1", Load: func() (*Storage, error) {
+		return newStorageFromObjs(testCodec, v1Items), nil
+	}})
+
+	v2 := []StorageOperation{
+		newOp(NewInsertOperation, ids[2], DeleteWinsConflictPolicy), // insert + update: both kept (update requires the item)
+		newOp(NewUpdateOperation, ids[0], DeleteWinsConflictPolicy), // update + update: the last one kept
+		newDeleteOp(ids[1], true),                                   // delete + resurrecting upsert: the upsert kept
+		newOp(NewInsertOperation, ids[3], DeleteWinsConflictPolicy), // insert + delete: both kept (tombstone)
+	}
+	v3 := []StorageOperation{
+		newOp(NewUpdateOperation, ids[2], DeleteWinsConflictPolicy),
+		newOp(NewUpdateOperation, ids[0], TimestampConflictPolicy),
+		newOp(NewSetOperation, ids[1], UpdateResurrectsConflictPolicy),
+		newDeleteOp(ids[3], true),
+		newDeleteOp(ids[4], false), // no effect: dropped
+	}
+	h.AddVersion(v2...)
+	h.AddVersion(v3...)
+	liveItems := h.storage.exportItems()
+	h.AddVersion(newOp(NewSetOperation, ids[4], DeleteWinsConflictPolicy)) // v4
+
+	require.NoError(t, h.Squash(2, 3))
+	require.Equal(t, []int{0, 1, 3, 4}, getTestVersions(h))
+
+	v2Ops := h.documents[2].InputOperations
+	require.Equal(t, []StorageOperation{v2[0], v2[3], v3[0], v3[1], v3[2], v3[3]}, v2Ops)
+
+	built, err := h.BuildStorage(3)
+	require.NoError(t, err)
+	require.ElementsMatch(t, liveItems, built.exportItems())
+
+	built, err = h.BuildStorage(4)
+	require.NoError(t, err)
+	require.ElementsMatch(t, h.storage.exportItems(), built.exportItems())
+}
+
+// Test squashes versions using the policy.
+func Test_DocumentHistory_SquashPolicy(t *testing.T) {
+	ids := make([]string, 0)
+	h := NewDocumentHistory(testCodec)
+	for i := 0; i < 10; i++ {
+		h.AddVersion(newTestStorageOps(t, &ids, 10)...)
+	}
+	expectedList := h.storage.Export()
+
+	// Disabled
+	_, _, squashed, err := h.ApplySquashPolicy(SquashPolicy{}, time.Now())
+	require.NoError(t, err)
+	require.False(t, squashed)
+
+	// By versions
+	fromVersion, toVersion, squashed, err := h.ApplySquashPolicy(SquashPolicy{KeepVersions: 3}, time.Now())
+	require.NoError(t, err)
+	require.True(t, squashed)
+	require.Equal(t, 1, fromVersion)
+	require.Equal(t, 7, toVersion)
+	require.Equal(t, []int{0, 7, 8, 9, 10}, getTestVersions(h))
+	require.Equal(t, expectedList, h.storage.Export())
+
+	// Nothing to squash
+	_, _, squashed, err = h.ApplySquashPolicy(SquashPolicy{KeepVersions: 3}, time.Now())
+	require.NoError(t, err)
+	require.False(t, squashed)
+
+	// By age: everything except the latest version
+	fromVersion, toVersion, squashed, err = h.ApplySquashPolicy(SquashPolicy{MaxAge: time.Minute}, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.True(t, squashed)
+	require.Equal(t, 7, fromVersion)
+	require.Equal(t, 9, toVersion)
+	require.Equal(t, []int{0, 9, 10}, getTestVersions(h))
+	require.Equal(t, expectedList, getTestClientList(t, h, 0, nil))
+}
+
+// Test builds previous versions storage from the base file and checkpoints.
+func Test_DocumentHistory_BuildStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build_storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "base.dat")
+	require.NoError(t, GenAndSaveInitialStorage(filePath, 100, testCodec))
+
+	h, err := NewDocHistoryFromFile(filePath, "", dir)
+	require.NoError(t, err)
+
+	ids := make([]string, 0)
+	lists := map[int]model.StorageList{0: h.storage.Export()}
+	for _, item := range lists[0] {
+		ids = append(ids, item.Id)
+	}
+	addVersion := func() {
+		require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 20)...))
+		lists[h.latestVersion] = h.storage.Export()
+	}
+	checkVersions := func() {
+		for _, version := range getTestVersions(h) {
+			st, err := h.BuildStorage(version)
+			require.NoError(t, err)
+			require.Equal(t, lists[version], st.Export(), "v%d", version)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		addVersion()
+	}
+	_, written, err := h.WriteCheckpoint(dir)
+	require.NoError(t, err)
+	require.True(t, written)
+	for i := 0; i < 3; i++ {
+		addVersion()
+	}
+	require.NoError(t, h.Squash(1, 2))
+	require.Equal(t, []int{0, 2, 3, 4, 5, 6}, getTestVersions(h))
+	checkVersions()
+
+	// The latest version copy is not affected by later changes
+	st, err := h.BuildStorage(h.latestVersion)
+	require.NoError(t, err)
+	addVersion()
+	require.Equal(t, lists[6], st.Export())
+
+	// Fallback to the base file
+	require.NoError(t, os.Remove(getCheckpointFilePath(dir, 3, 0)))
+	checkVersions()
+
+	// Squashed version
+	_, err = h.BuildStorage(1)
+	require.Error(t, err)
+
+	// History loaded from the checkpoint
+	_, written, err = h.WriteCheckpoint(dir)
+	require.NoError(t, err)
+	require.True(t, written)
+	h, err = NewDocHistoryFromFile(filePath, "", dir)
+	require.NoError(t, err)
+	addVersion()
+	checkVersions()
+	_, err = h.BuildStorage(0)
+	require.Error(t, err)
+}
+
+// Test drops old versions using the retention policy.
+func Test_DocumentHistory_Retention(t *testing.T) {
+	ids := make([]string, 0)
+	h := NewDocumentHistory(testCodec)
+	lists := map[int]model.StorageList{0: nil}
+	addVersion := func() {
+		require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 10)...))
+		lists[h.latestVersion] = h.storage.Export()
+	}
+	checkVersions := func(servedVersions []int) {
+		require.Equal(t, servedVersions, getTestVersions(h))
+		for _, version := range servedVersions {
+			require.Equal(t, lists[h.latestVersion], getTestClientList(t, h, version, lists[version]), "client v%d", version)
+
+			st, err := h.BuildStorage(version)
+			require.NoError(t, err)
+			require.Equal(t, lists[version], st.Export(), "v%d", version)
+		}
+		for version := 0; version < servedVersions[0]; version++ {
+			_, _, err := h.GetOutputDiffWithLatest(version)
+			require.True(t, errors.Is(err, ErrSnapshotRequired), "client v%d", version)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		addVersion()
+	}
+
+	// Disabled
+	oldestVersion, dropped := h.ApplyRetentionPolicy(RetentionPolicy{}, time.Now())
+	require.Equal(t, 0, oldestVersion)
+	require.Equal(t, 0, dropped)
+
+	// By versions
+	oldestVersion, dropped = h.ApplyRetentionPolicy(RetentionPolicy{KeepVersions: 3}, time.Now())
+	require.Equal(t, 6, oldestVersion)
+	require.Equal(t, 6, dropped)
+	checkVersions([]int{6, 7, 8, 9, 10})
+
+	_, dropped = h.ApplyRetentionPolicy(RetentionPolicy{KeepVersions: 3}, time.Now())
+	require.Equal(t, 0, dropped)
+
+	// The oldest served version can't be rewritten
+	require.Error(t, h.RemoveVersion(6))
+	require.NoError(t, h.RemoveVersion(10))
+	addVersion()
+	checkVersions([]int{6, 7, 8, 9, 11})
+
+	// By memory: the latest version only
+	oldestVersion, dropped = h.ApplyRetentionPolicy(RetentionPolicy{MaxMemory: h.documents[len(h.documents)-1].sizeEstimate()}, time.Now())
+	require.Equal(t, 9, oldestVersion)
+	require.Equal(t, 3, dropped)
+	checkVersions([]int{9, 11})
+
+	// By age
+	addVersion()
+	oldestVersion, dropped = h.ApplyRetentionPolicy(RetentionPolicy{MaxAge: time.Minute}, time.Now().Add(time.Hour))
+	require.Equal(t, 11, oldestVersion)
+	require.Equal(t, 1, dropped)
+	checkVersions([]int{11, 12})
+}
+
+// Test coalesces diffs for lagging clients (values with duplicates are used to check the total order).
+func Test_DocumentHistory_CoalescedDiff(t *testing.T) {
+	now := model.HLCFromTime(time.Now())
+	newSetOp := func(id string) StorageOperation {
+		op, err := NewSetOperation(id, model.NewInt32Value(int32(rand.Intn(10))), 0, now)
+		require.NoError(t, err)
+		return op
+	}
+	newDeleteOp := func(id string) StorageOperation {
+		op, err := NewDeleteOperation(id, 0, now)
+		require.NoError(t, err)
+		return op
+	}
+
+	h := NewDocumentHistory(testCodec)
+	lists := map[int]model.StorageList{0: nil}
+	ids := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		ids = append(ids, uuid.New().String())
+	}
+
+	// Initial items
+	ops := make([]StorageOperation, 0)
+	for _, id := range ids {
+		ops = append(ops, newSetOp(id))
+	}
+	require.NoError(t, h.AddVersion(ops...))
+	lists[h.latestVersion] = h.storage.Export()
+
+	// Hot items updates, inserts followed by deletes, deletes
+	for i := 0; i < 20; i++ {
+		ops := []StorageOperation{newSetOp(ids[0]), newSetOp(ids[1])}
+
+		tmpId := uuid.New().String()
+		ops = append(ops, newSetOp(tmpId), newSetOp(tmpId), newDeleteOp(tmpId))
+		if i%5 == 0 {
+			ops = append(ops, newDeleteOp(ids[len(ids)-1]))
+			ids = ids[:len(ids)-1]
+		}
+		if i%3 == 0 {
+			newId := uuid.New().String()
+			ops = append(ops, newSetOp(newId))
+			ids = append(ids, newId)
+		}
+
+		require.NoError(t, h.AddVersion(ops...))
+		lists[h.latestVersion] = h.storage.Export()
+	}
+
+	for version, list := range lists {
+		require.Equal(t, h.storage.Export(), getTestClientList(t, h, version, list), "client v%d", version)
+	}
+
+	// v1: 2 hot items (delete + insert), 4 deleted items, 7 new items
+	_, listOps, err := h.GetOutputDiffWithLatest(1)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(listOps), 2*2+4+7)
+
+	// Latest version: no changes
+	_, listOps, err = h.GetOutputDiffWithLatest(h.latestVersion)
+	require.NoError(t, err)
+	require.Empty(t, listOps)
+
+	// One version behind: the version output operations are sent as is (temporary item insert / update / delete included)
+	_, listOps, err = h.GetOutputDiffWithLatest(h.latestVersion - 1)
+	require.NoError(t, err)
+	require.Equal(t, h.documents[len(h.documents)-1].OutputOperations, listOps)
+
+	// One version behind with a large diff: coalesced
+	ops = make([]StorageOperation, 0)
+	for i := 0; i <= coalesceSingleVersionMinOps; i++ {
+		ops = append(ops, newSetOp(ids[0]))
+	}
+	require.NoError(t, h.AddVersion(ops...))
+	_, listOps, err = h.GetOutputDiffWithLatest(h.latestVersion - 1)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(listOps), 2)
+	require.Equal(t, h.storage.Export(), getTestClientList(t, h, h.latestVersion-1, lists[h.latestVersion-1]))
+}
+
+// Test checks the committed version and the per-operation results (insert / update / delete existence requirements).
+func Test_DocumentHistory_CommitVersion(t *testing.T) {
+	now := model.HLCFromTime(time.Now())
+	id1, id2, id3 := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	newOp := func(op StorageOperation, err error) StorageOperation {
+		require.NoError(t, err)
+		return op
+	}
+
+	h := NewDocumentHistory(testCodec)
+
+	// No operations: no new version
+	version, results, err := h.CommitVersion(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+	require.Empty(t, results)
+
+	strictDeleteOp := func(id string) StorageOperation {
+		op := newOp(NewDeleteOperation(id, 0, now)).(DeleteOperation)
+		op.MustExist = true
+		return op
+	}
+	version, results, err = h.CommitVersion([]StorageOperation{
+		newOp(NewInsertOperation(id1, testCodec.Random(), 0, now)),
+		newOp(NewInsertOperation(id1, testCodec.Random(), 0, now)),
+		newOp(NewUpdateOperation(id2, testCodec.Random(), 0, now)),
+		newOp(NewSetOperation(id2, testCodec.Random(), 0, now)),
+		strictDeleteOp(id3),
+		newOp(NewDeleteOperation(id3, 0, now)),
+		strictDeleteOp(id1),
+		strictDeleteOp(id1),
+		newOp(NewUpdateOperation(id1, testCodec.Random(), 0, now)),
+	}, map[model.ClientId]uint64{1: 5})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), h.GetClientSequence(1))
+	require.Equal(t, uint64(0), h.GetClientSequence(2))
+	require.Equal(t, 1, version)
+	require.Equal(t, []OperationResult{
+		{Applied: true},
+		{Err: ErrItemExists},
+		{Err: ErrItemNotFound},
+		{Applied: true},
+		{Err: ErrItemNotFound},
+		{},
+		{Applied: true},
+		{Err: ErrItemDeleted},
+		{Err: ErrItemDeleted},
+	}, results)
+	require.Len(t, h.documents[1].OutputOperations, 3)
+
+	// No operations: sequence numbers are still recorded
+	version, results, err = h.CommitVersion(nil, map[model.ClientId]uint64{1: 4, 2: 3})
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+	require.Empty(t, results)
+	require.Equal(t, uint64(5), h.GetClientSequence(1))
+	require.Equal(t, uint64(3), h.GetClientSequence(2))
+
+	// Squashed operations don't depend on the squashed intermediate state
+	value := testCodec.Random()
+	require.NoError(t, h.AddVersion(newOp(NewInsertOperation(id3, testCodec.Random(), 0, now))))
+	require.NoError(t, h.AddVersion(newOp(NewUpdateOperation(id3, value, 0, now))))
+	require.NoError(t, h.Squash(2, 3))
+	require.NoError(t, h.RemoveVersion(1))
+	require.Equal(t, model.StorageList{{Id: id3, Value: value}}, h.storage.Export())
+
+	// Restored item rollback
+	resurrectOp := newOp(NewUpdateOperation(id3, value, 0, now)).(SetOperation)
+	resurrectOp.Conflict = UpdateResurrectsConflictPolicy
+	require.NoError(t, h.AddVersion(newOp(NewDeleteOperation(id3, 0, now))))
+	require.NoError(t, h.AddVersion(resurrectOp))
+	require.Equal(t, model.StorageList{{Id: id3, Value: value}}, h.storage.Export())
+	require.NoError(t, h.RemoveVersion(h.latestVersion))
+	require.Empty(t, h.storage.Export())
+	require.True(t, h.storage.idDataMatch[id3].IsDeleted)
+}
+
+// Test waits for the latest version change.
+func Test_DocumentHistory_WaitForVersionChange(t *testing.T) {
+	ids := make([]string, 0)
+	h := NewDocumentHistory(testCodec)
+
+	// Timeout
+	start := time.Now()
+	require.Equal(t, 0, h.WaitForVersionChange(0, 50*time.Millisecond))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// Already changed
+	require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 10)...))
+	require.Equal(t, 1, h.WaitForVersionChange(0, time.Minute))
+
+	// New version
+	ops := newTestStorageOps(t, &ids, 10)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		h.AddVersion(ops...)
+	}()
+	require.Equal(t, 2, h.WaitForVersionChange(1, time.Minute))
+
+	// Rewrite
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		h.RemoveVersion(2)
+	}()
+	require.Equal(t, 1, h.WaitForVersionChange(2, time.Minute))
+}
+
+// Test checks the versions checksums match the storage state (incremental updates, rewrite and squash).
+func Test_DocumentHistory_Checksum(t *testing.T) {
+	ids := make([]string, 0)
+	h := NewDocumentHistory(testCodec)
+	for i := 0; i < 6; i++ {
+		require.NoError(t, h.AddVersion(newTestStorageOps(t, &ids, 20)...))
+	}
+	require.NoError(t, h.RemoveVersion(3))
+	require.NoError(t, h.Squash(1, 2))
+
+	checksum, found := h.GetVersionChecksum(h.latestVersion)
+	require.True(t, found)
+	require.Equal(t, h.storage.Export().Checksum(), checksum)
+	require.Equal(t, h.storage.Export().Checksum(), h.storage.Checksum())
+
+	for _, version := range getTestVersions(h) {
+		st, err := h.BuildStorage(version)
+		require.NoError(t, err)
+
+		checksum, found := h.GetVersionChecksum(version)
+		require.True(t, found, "v%d", version)
+		require.Equal(t, st.Export().Checksum(), checksum, "v%d", version)
+	}
+
+	// Removed version is not served
+	_, found = h.GetVersionChecksum(3)
+	require.False(t, found)
+
+	// Checksum is order-sensitive
+	list := h.storage.Export()
+	require.True(t, len(list) > 1)
+	list[0], list[1] = list[1], list[0]
+	require.NotEqual(t, h.storage.Checksum(), list.Checksum())
+}
+
+// getTestVersions returns all the history versions.
+func getTestVersions(h *DocumentHistory) []int {
+	versions := make([]int, 0, len(h.documents))
+	for _, doc := range h.documents {
+		versions = append(versions, doc.Version)
+	}
+
+	return versions
+}
+
+// newTestStorageOps generates random insert / update / delete operations for the ids pool (deleted ids are removed from the pool).
+// Pool keeps at least two ids (the list is never empty).
+func newTestStorageOps(t *testing.T, ids *[]string, n int) []StorageOperation {
+	now := model.HLCFromTime(time.Now())
+
+	ops := make([]StorageOperation, 0, n)
+	for i := 0; i < n; i++ {
+		switch {
+		case len(*ids) <= 2 || rand.Intn(3) == 0:
+			id := uuid.New().String()
+			op, err := NewSetOperation(id, testCodec.Random(), 0, now)
+			require.NoError(t, err)
+			ops, *ids = append(ops, op), append(*ids, id)
+		case rand.Intn(2) == 0:
+			op, err := NewSetOperation((*ids)[rand.Intn(len(*ids))], testCodec.Random(), 0, now)
+			require.NoError(t, err)
+			ops = append(ops, op)
+		default:
+			idx := rand.Intn(len(*ids))
+			op, err := NewDeleteOperation((*ids)[idx], 0, now)
+			require.NoError(t, err)
+			ops = append(ops, op)
+			*ids = append((*ids)[:idx], (*ids)[idx+1:]...)
+		}
+	}
+
+	return ops
+}
+
+// getTestClientList upgrades the client list to the latest version.
+func getTestClientList(t *testing.T, h *DocumentHistory, version int, list model.StorageList) model.StorageList {
+	_, listOps, err := h.GetOutputDiffWithLatest(version)
+	require.NoError(t, err)
+
+	list, err = model.ApplyListOperations(testCodec, append(model.StorageList(nil), list...), listOps...)
+	require.NoError(t, err)
+
+	return list
+}
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"sort"
 	"time"
 
@@ -15,18 +15,44 @@ import (
 	"github.com/itiky/collaborate-storage/model"
 )
 
+type (
+	// storageFile is the storage items file format.
+	storageFile struct {
+		// model.ValueCodec name used to compare values
+		ValueCodec string
+		// Sorted storage items
+		Items []Item
+	}
+
+	// legacyStorageItem is the Item format of files generated before model.StorageValue became an opaque payload.
+	legacyStorageItem struct {
+		Id        uuid.UUID
+		Value     int32
+		IsDeleted bool
+		UpdatedBy model.ClientId
+		UpdatedAt time.Time
+	}
+)
+
 // GenAndSaveInitialStorage generates random storage objects and saves it to file system.
-func GenAndSaveInitialStorage(filePath string, storageSize int) error {
+func GenAndSaveInitialStorage(filePath string, storageSize int, codec model.ValueCodec) error {
 	if storageSize <= 0 {
 		return fmt.Errorf("%s: must be GT 0", "storageSize")
 	}
+	if codec == nil {
+		return fmt.Errorf("%s: nil", "codec")
+	}
 
 	log.Printf("Creating and sorting objects...")
-	objs := newStorageMockObjs(storageSize, time.Now())
+	objs := newStorageMockObjs(codec, storageSize, time.Now())
 
 	log.Printf("GOB marshal...")
 	objsRaw := new(bytes.Buffer)
-	if err := gob.NewEncoder(objsRaw).Encode(objs); err != nil {
+	file := storageFile{
+		ValueCodec: codec.Name(),
+		Items:      objs,
+	}
+	if err := gob.NewEncoder(objsRaw).Encode(file); err != nil {
 		return fmt.Errorf("GOB marshal: %w", err)
 	}
 
@@ -41,73 +67,206 @@ func GenAndSaveInitialStorage(filePath string, storageSize int) error {
 }
 
 // NewDocHistoryFromFile builds the DocumentHistory object with a single version (v0) from the file.
-func NewDocHistoryFromFile(filePath string) (*DocumentHistory, error) {
+// If checkpointDir is set, the newest valid checkpoint state is loaded instead (falling back to older ones and the file).
+// If walPath is set, versions following the loaded state are restored from the write-ahead log and all the later changes are logged.
+func NewDocHistoryFromFile(filePath, walPath, checkpointDir string) (*DocumentHistory, error) {
 	log.Printf("Reading file...")
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("reading file (%s): %w", filePath, err)
 	}
+	baseChecksum := crc32.ChecksumIEEE(data)
 
-	log.Printf("GOB unmarshal...")
-	objs := make([]Item, 0)
-	buf := bytes.NewBuffer(data)
-	if err := gob.NewDecoder(buf).Decode(&objs); err != nil {
-		return nil, fmt.Errorf("GOB unmarshal: %w", err)
+	var wal *WAL
+	if walPath != "" {
+		wal, err = OpenWAL(walPath)
+		if err != nil {
+			return nil, fmt.Errorf("WAL: %w", err)
+		}
+	}
+
+	// Checkpoints (the newest first)
+	if checkpointDir != "" {
+		cpInfos, err := listCheckpointFiles(checkpointDir)
+		if err != nil {
+			closeWAL(wal)
+			return nil, fmt.Errorf("checkpoints: %w", err)
+		}
+
+		for _, cpInfo := range cpInfos {
+			cpPath := cpInfo.Path
+			log.Printf("Checkpoint loading (%s)...", cpPath)
+			docHistory, walSegment, walRecords, err := newDocHistoryFromCheckpoint(cpPath, baseChecksum)
+			if err != nil {
+				log.Printf("Checkpoint skipped (%s): %v", cpPath, err)
+				continue
+			}
+
+			if wal != nil {
+				log.Printf("WAL replay (from segment %d record %d)...", walSegment, walRecords)
+				if err := docHistory.attachWAL(wal, walSegment, walRecords); err != nil {
+					log.Printf("Checkpoint skipped (%s): WAL (%s): %v", cpPath, walPath, err)
+					continue
+				}
+				log.Printf("WAL replayed: %d records, latest version: %d", wal.Records(), docHistory.latestVersion)
+			}
+
+			log.Printf("Storage created: %d items", len(docHistory.storage.idDataMatch))
+
+			return docHistory, nil
+		}
 	}
 
 	log.Printf("Storage creation...")
-	storage := newStorageFromObjs(objs)
+	storage, err := newStorageFromFileData(data)
+	if err != nil {
+		closeWAL(wal)
+		return nil, err
+	}
 
 	log.Printf("DocHistory creation...")
-	docHistory := NewDocumentHistory()
-	docHistory.storage = storage
-	docHistory.documents = append(docHistory.documents, Document{
-		Version:          0,
-		InputOperations:  nil,
-		OutputOperations: nil,
-	})
+	docHistory := newDocumentHistory(storage)
+	docHistory.baseChecksum = baseChecksum
+	docHistory.snapshotSources = []snapshotSource{
+		newFileSnapshotSource(filePath, baseChecksum),
+	}
+
+	if wal != nil {
+		log.Printf("WAL replay...")
+		if err := docHistory.attachWAL(wal, 0, 0); err != nil {
+			closeWAL(wal)
+			return nil, fmt.Errorf("WAL (%s): %w", walPath, err)
+		}
+		log.Printf("WAL replayed: %d records, latest version: %d", wal.Records(), docHistory.latestVersion)
+	}
 
 	log.Printf("Storage created: %d items", len(docHistory.storage.idDataMatch))
 
 	return docHistory, nil
 }
 
+// newStorageFromFileData builds the Storage object from the storage file data.
+func newStorageFromFileData(data []byte) (*Storage, error) {
+	file, err := decodeStorageFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("GOB unmarshal: %w", err)
+	}
+
+	codec, err := model.GetValueCodec(file.ValueCodec)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStorageFromObjs(codec, file.Items), nil
+}
+
+// newFileSnapshotSource creates a snapshotSource rereading the base storage file (v0).
+func newFileSnapshotSource(filePath string, baseChecksum uint32) snapshotSource {
+	return snapshotSource{
+		Version: 0,
+		Name:    filePath,
+		Load: func() (*Storage, error) {
+			data, err := ioutil.ReadFile(filePath)
+			if err != nil {
+				return nil, fmt.Errorf("reading file (%s): %w", filePath, err)
+			}
+			if crc32.ChecksumIEEE(data) != baseChecksum {
+				return nil, fmt.Errorf("file (%s): checksum mismatch (file was changed)", filePath)
+			}
+
+			return newStorageFromFileData(data)
+		},
+	}
+}
+
+// closeWAL closes the optional WAL on a DocumentHistory creation failure.
+func closeWAL(wal *WAL) {
+	if wal == nil {
+		return
+	}
+	if err := wal.Close(); err != nil {
+		log.Printf("WAL close: %v", err)
+	}
+}
+
+// decodeStorageFile decodes storageFile falling back to the legacy format (int32 values without a header).
+func decodeStorageFile(data []byte) (storageFile, error) {
+	file := storageFile{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&file)
+	if err == nil {
+		return file, nil
+	}
+
+	legacyObjs := make([]legacyStorageItem, 0)
+	if legacyErr := gob.NewDecoder(bytes.NewReader(data)).Decode(&legacyObjs); legacyErr != nil {
+		return storageFile{}, err
+	}
+
+	file.ValueCodec = model.Int32ValueCodecName
+	file.Items = make([]Item, 0, len(legacyObjs))
+	for _, obj := range legacyObjs {
+		file.Items = append(file.Items, Item{
+			Id:        obj.Id,
+			Value:     model.NewInt32Value(obj.Value),
+			IsDeleted: obj.IsDeleted,
+			UpdatedBy: obj.UpdatedBy,
+			UpdatedAt: model.HLCFromTime(obj.UpdatedAt),
+		})
+	}
+
+	return file, nil
+}
+
 // newStorageMockObjs builds mocks storage objects.
-func newStorageMockObjs(n int, now time.Time) []Item {
+func newStorageMockObjs(codec model.ValueCodec, n int, now time.Time) []Item {
 	objs := make([]Item, 0, n)
 	for i := 0; i < n; i++ {
-		objs = append(objs, newStorageMockObj(now))
+		objs = append(objs, newStorageMockObj(codec, now))
 	}
 
+	s := NewStorage(codec)
 	sort.Slice(objs, func(i, j int) bool {
-		return objs[i].Value < objs[j].Value
+		return s.itemLess(&objs[i], &objs[j])
 	})
 
 	return objs
 }
 
 // newStorageMockObj builds mocks storage object.
-func newStorageMockObj(now time.Time) Item {
+func newStorageMockObj(codec model.ValueCodec, now time.Time) Item {
 	return Item{
 		Id:        uuid.New(),
-		Value:     model.StorageValue(rand.Int31()),
+		Value:     codec.Random(),
 		IsDeleted: false,
 		UpdatedBy: 0,
-		UpdatedAt: now,
+		UpdatedAt: model.HLCFromTime(now),
 	}
 }
 
-// newStorageFromObjs builds the Storage object from storage items.
-func newStorageFromObjs(objs []Item) *Storage {
-	s := NewStorage()
+// newStorageFromObjs builds the Storage object from storage items (soft-deleted items are not indexed).
+func newStorageFromObjs(codec model.ValueCodec, objs []Item) *Storage {
+	s := NewStorage(codec)
 
-	s.list = make([]*Item, 0, len(objs))
+	list := make([]*Item, 0, len(objs))
 	for idx := 0; idx < len(objs); idx++ {
 		item := &objs[idx]
 		itemIdStr := item.Id.String()
 		s.idDataMatch[itemIdStr] = item
-		s.list = append(s.list, item)
+		if !item.IsDeleted {
+			list = append(list, item)
+		}
+	}
+
+	// Files generated before the total order was introduced are only sorted by value
+	isSorted := sort.SliceIsSorted(list, func(i, j int) bool {
+		return s.itemLess(list[i], list[j])
+	})
+	if !isSorted {
+		sort.Slice(list, func(i, j int) bool {
+			return s.itemLess(list[i], list[j])
+		})
 	}
+	s.index = newSortedIndexFromItems(s.itemLess, list)
 
 	return s
 }
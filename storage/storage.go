@@ -1,10 +1,9 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
-	"sort"
 	"strings"
-	"time"
 
 	"github.com/google/uuid"
 
@@ -15,7 +14,8 @@ type (
 	// Storage keeps Item elements alongside the sorted list view.
 	// Storage implements the "soft delete" methodology.
 	Storage struct {
-		list        []*Item
+		codec       model.ValueCodec
+		index       *sortedIndex
 		idDataMatch map[string]*Item
 	}
 )
@@ -23,81 +23,200 @@ type (
 // String implements stringer interface.
 func (s *Storage) String() string {
 	str := strings.Builder{}
-	for i, item := range s.list {
-		str.WriteString(fmt.Sprintf("- [%d] %d (%s)\n", i, item.Value, item.Id))
-	}
+	i := 0
+	s.index.Ascend(func(item *Item) bool {
+		str.WriteString(fmt.Sprintf("- [%d] %s (%s)\n", i, s.codec.Format(item.Value), item.Id))
+		i++
+		return true
+	})
 
 	return str.String()
 }
 
+// ValueCodec returns the codec used to compare item values.
+func (s *Storage) ValueCodec() model.ValueCodec {
+	return s.codec
+}
+
+// Checksum returns the sorted list order-sensitive checksum (model.StorageList checksum of the Export result).
+// Checksum is maintained incrementally by the sorted list index.
+func (s *Storage) Checksum() uint64 {
+	return s.index.Checksum()
+}
+
 // Export builds a model.StorageList slice (snapshot).
 func (s *Storage) Export() model.StorageList {
-	list := make(model.StorageList, 0, len(s.list))
-	for _, item := range s.list {
+	list := make(model.StorageList, 0, s.index.Len())
+	s.index.Ascend(func(item *Item) bool {
 		list = append(list, model.ListItem{
 			Id:    item.Id.String(),
 			Value: item.Value,
 		})
-	}
+		return true
+	})
 
 	return list
 }
 
+// exportItems copies all the Items (including soft-deleted ones): sorted not deleted Items go first.
+func (s *Storage) exportItems() []Item {
+	items := make([]Item, 0, len(s.idDataMatch))
+	s.index.Ascend(func(item *Item) bool {
+		items = append(items, *item)
+		return true
+	})
+	for _, item := range s.idDataMatch {
+		if item.IsDeleted {
+			items = append(items, *item)
+		}
+	}
+
+	return items
+}
+
 // ApplyOperations updates storage state with StorageOperation list and returns list operations performed.
 func (s *Storage) ApplyOperations(ops ...StorageOperation) []model.ListOperation {
+	return s.applyOperations(ops, nil, nil)
+}
+
+// applyOperations updates storage state with StorageOperation list and returns list operations performed.
+// If revisions is not nil, Item states before every performed operation are appended to it (used for rollback).
+// If results is not nil (must have the ops length), it is filled with the per-operation results.
+func (s *Storage) applyOperations(ops []StorageOperation, revisions *[]itemRevision, results []OperationResult) []model.ListOperation {
 	listOps := make([]model.ListOperation, 0, len(ops))
 
-	for _, op := range ops {
+	for opIdx, op := range ops {
 		if op == nil {
 			continue
 		}
 
-		if listOp := op.Apply(s); listOp != nil {
+		var rev itemRevision
+		if revisions != nil {
+			rev = s.revision(op.GetId())
+		}
+
+		listOp, err := op.Apply(s)
+		if results != nil {
+			results[opIdx] = OperationResult{Applied: listOp != nil, Err: err}
+		}
+		if listOp != nil {
 			listOps = append(listOps, *listOp)
+			if revisions != nil {
+				*revisions = append(*revisions, rev)
+			}
 		}
 	}
 
 	return listOps
 }
 
+// revision returns the current Item state.
+func (s *Storage) revision(itemId uuid.UUID) itemRevision {
+	rev := itemRevision{
+		Id: itemId,
+	}
+	if item, found := s.idDataMatch[itemId.String()]; found {
+		itemCopy := *item
+		rev.Item = &itemCopy
+	}
+
+	return rev
+}
+
+// rollback restores Item states using revisions (in the reverse order).
+func (s *Storage) rollback(revisions []itemRevision) {
+	for i := len(revisions) - 1; i >= 0; i-- {
+		rev := revisions[i]
+		itemIdStr := rev.Id.String()
+
+		item, found := s.idDataMatch[itemIdStr]
+		if found && !item.IsDeleted {
+			s.cutItem(item)
+		}
+
+		if rev.Item == nil {
+			delete(s.idDataMatch, itemIdStr)
+			continue
+		}
+
+		if !found {
+			item = &Item{}
+			s.idDataMatch[itemIdStr] = item
+		}
+		*item = *rev.Item
+		if !item.IsDeleted {
+			s.index.Insert(item)
+		}
+	}
+}
+
 // set creates a new / updates an existing Item while updating the sorted list index state.
-func (s *Storage) set(itemId uuid.UUID, itemValue model.StorageValue, clientId model.ClientId, timestamp time.Time) *model.ListOperation {
+// Operation is rejected if the Item existence doesn't match the mode.
+// A deleted Item is restored or the operation is rejected depending on the conflict policy (a deleted Item ID can't be inserted).
+// Updating an Item updated later is rejected for the TimestampConflictPolicy.
+func (s *Storage) set(itemId uuid.UUID, itemValue model.StorageValue, mode SetMode, conflict ConflictPolicy, clientId model.ClientId, timestamp model.HLC) (*model.ListOperation, error) {
 	itemIdStr := itemId.String()
 
 	item, found := s.idDataMatch[itemIdStr]
+	switch {
+	case !found && mode == SetModeUpdate:
+		return nil, ErrItemNotFound
+	case found && item.IsDeleted:
+		restore := false
+		switch conflict {
+		case UpdateResurrectsConflictPolicy:
+			restore = mode != SetModeInsert
+		case TimestampConflictPolicy:
+			restore = mode != SetModeInsert && timestamp.After(item.UpdatedAt)
+		}
+		if !restore {
+			return nil, ErrItemDeleted
+		}
+
+		// Restore
+		item.IsDeleted = false
+		item.Value = itemValue
+		item.UpdatedBy, item.UpdatedAt = clientId, timestamp
+		itemIdxToInsert := s.index.Insert(item)
+
+		return &model.ListOperation{
+			Type:  model.InsertOperationType,
+			Id:    itemIdStr,
+			Index: itemIdxToInsert,
+			Value: itemValue,
+		}, nil
+	case found && mode == SetModeInsert:
+		return nil, ErrItemExists
+	case found && conflict == TimestampConflictPolicy && item.UpdatedAt.After(timestamp):
+		return nil, ErrConflict
+	}
+
 	if !found {
 		// Add a new Item
 		item = NewStorageItem(itemId, itemValue, clientId, timestamp)
 		s.idDataMatch[itemIdStr] = item
 
 		// Insert
-		itemIdxToInsert := s.findItemIdxLTTarget(item)
-		s.list = append(s.list, nil)
-		copy(s.list[itemIdxToInsert+1:], s.list[itemIdxToInsert:])
-		s.list[itemIdxToInsert] = item
+		itemIdxToInsert := s.index.Insert(item)
 
 		return &model.ListOperation{
 			Type:  model.InsertOperationType,
 			Id:    itemId.String(),
 			Index: itemIdxToInsert,
 			Value: itemValue,
-		}
+		}, nil
 	}
 
 	// Update an existing item (that might break the sorting, so we have to cut/insert)
 	// Cut
-	itemIdxToCut := s.findItemIdx(item)
-	s.list = append(s.list[:itemIdxToCut], s.list[itemIdxToCut+1:]...)
+	itemIdxToCut := s.cutItem(item)
 
 	// Update
 	item.Value = itemValue
 	item.UpdatedBy, item.UpdatedAt = clientId, timestamp
 
 	// Insert
-	itemIdxToInsert := s.findItemIdxLTTarget(item)
-	s.list = append(s.list, nil)
-	copy(s.list[itemIdxToInsert+1:], s.list[itemIdxToInsert:])
-	s.list[itemIdxToInsert] = item
+	itemIdxToInsert := s.index.Insert(item)
 
 	return &model.ListOperation{
 		Type:     model.UpdateOperationType,
@@ -105,16 +224,25 @@ func (s *Storage) set(itemId uuid.UUID, itemValue model.StorageValue, clientId m
 		Index:    itemIdxToCut,
 		NewIndex: itemIdxToInsert,
 		Value:    itemValue,
-	}
+	}, nil
 }
 
 // delete deletes an existing Item while updating the sorted list index state.
-func (s *Storage) delete(itemId uuid.UUID, clientId model.ClientId, timestamp time.Time) *model.ListOperation {
+// Deleting an unknown / deleted Item has no effect (rejected if mustExist is set).
+// Deleting an Item updated later is rejected for the TimestampConflictPolicy.
+func (s *Storage) delete(itemId uuid.UUID, mustExist bool, conflict ConflictPolicy, clientId model.ClientId, timestamp model.HLC) (*model.ListOperation, error) {
 	itemIdStr := itemId.String()
 
 	item, found := s.idDataMatch[itemIdStr]
-	if !found || item.IsDeleted {
-		return nil
+	switch {
+	case !found && mustExist:
+		return nil, ErrItemNotFound
+	case found && item.IsDeleted && mustExist:
+		return nil, ErrItemDeleted
+	case !found || item.IsDeleted:
+		return nil, nil
+	case conflict == TimestampConflictPolicy && item.UpdatedAt.After(timestamp):
+		return nil, ErrConflict
 	}
 
 	// Mark as deleted
@@ -122,44 +250,43 @@ func (s *Storage) delete(itemId uuid.UUID, clientId model.ClientId, timestamp ti
 	item.UpdatedBy, item.UpdatedAt = clientId, timestamp
 
 	// Cut
-	itemIdx := s.findItemIdx(item)
-	s.list = append(s.list[:itemIdx], s.list[itemIdx+1:]...)
+	itemIdx := s.cutItem(item)
 
 	return &model.ListOperation{
 		Type:  model.DeleteOperationType,
 		Id:    itemIdStr,
 		Index: itemIdx,
-	}
+	}, nil
 }
 
-// findItemIdxLTTarget used by set/delete funcs: returns the the leftmost item index in the sorted list.
-func (s *Storage) findItemIdxLTTarget(item *Item) int {
-	return sort.Search(len(s.list), func(i int) bool {
-		return s.list[i].Value >= item.Value
-	})
-}
-
-// findItemIdx used by set/delete funcs: returns the specified item index.
+// cutItem used by set/delete funcs: removes the item from the sorted list and returns its index.
 // Panics on failure (should not happen).
-func (s *Storage) findItemIdx(item *Item) int {
-	itemIdxPrev := s.findItemIdxLTTarget(item)
-	if itemIdxPrev == len(s.list) {
-		panic("item not found: LT target")
+func (s *Storage) cutItem(item *Item) int {
+	itemIdx := s.index.Delete(item)
+	if itemIdx < 0 {
+		panic("item not found: by id")
 	}
 
-	for i := itemIdxPrev; i < len(s.list); i++ {
-		if s.list[i].Id == item.Id {
-			return i
-		}
+	return itemIdx
+}
+
+// itemLess defines the sorted list total order: by value (using the codec), then by ID.
+// UUID bytes order matches the canonical string order, so it is equal to the model.CompareListItems one.
+func (s *Storage) itemLess(a, b *Item) bool {
+	if res := s.codec.Compare(a.Value, b.Value); res != 0 {
+		return res < 0
 	}
-	panic("item not found: by id")
 
-	return -1
+	return bytes.Compare(a.Id[:], b.Id[:]) < 0
 }
 
 // NewStorage creates a new Storage object.
-func NewStorage() *Storage {
-	return &Storage{
+func NewStorage(codec model.ValueCodec) *Storage {
+	s := &Storage{
+		codec:       codec,
 		idDataMatch: make(map[string]*Item),
 	}
+	s.index = newSortedIndex(s.itemLess)
+
+	return s
 }
@@ -0,0 +1,309 @@
+package storage
+
+import "github.com/itiky/collaborate-storage/model"
+
+type (
+	// sortedIndex is an order-statistic AVL tree keeping Storage items sorted.
+	// Every node keeps its subtree size, so insert, delete and "index of item" lookups are O(log n).
+	// Every node also keeps its subtree model.ListHash, so the list checksum is updated incrementally.
+	sortedIndex struct {
+		root *indexNode
+		less func(a, b *Item) bool
+	}
+
+	indexNode struct {
+		item     *Item
+		itemHash model.ListHash // item hash (item is not changed while indexed)
+		hash     model.ListHash // subtree hash
+		left     *indexNode
+		right    *indexNode
+		size     int32
+		height   int8
+	}
+)
+
+// Len returns the number of indexed items.
+func (x *sortedIndex) Len() int {
+	return int(x.root.getSize())
+}
+
+// Checksum returns the sorted list order-sensitive checksum (equal to the client model.StorageList one).
+func (x *sortedIndex) Checksum() uint64 {
+	return x.root.getHash().Sum
+}
+
+// At returns an item by its sorted list index (nil if out of range).
+func (x *sortedIndex) At(idx int) *Item {
+	if idx < 0 || idx >= x.Len() {
+		return nil
+	}
+
+	n := x.root
+	for n != nil {
+		leftSize := int(n.left.getSize())
+		switch {
+		case idx < leftSize:
+			n = n.left
+		case idx > leftSize:
+			idx -= leftSize + 1
+			n = n.right
+		default:
+			return n.item
+		}
+	}
+
+	return nil
+}
+
+// IndexOf returns the item sorted list index (-1 if not found).
+func (x *sortedIndex) IndexOf(item *Item) int {
+	idx := 0
+	n := x.root
+	for n != nil {
+		switch {
+		case x.less(item, n.item):
+			n = n.left
+		case x.less(n.item, item):
+			idx += int(n.left.getSize()) + 1
+			n = n.right
+		default:
+			return idx + int(n.left.getSize())
+		}
+	}
+
+	return -1
+}
+
+// Rank returns the number of indexed items less than the item (the item doesn't have to be indexed).
+func (x *sortedIndex) Rank(item *Item) int {
+	rank := 0
+	n := x.root
+	for n != nil {
+		if x.less(n.item, item) {
+			rank += int(n.left.getSize()) + 1
+			n = n.right
+			continue
+		}
+		n = n.left
+	}
+
+	return rank
+}
+
+// Insert adds a new item and returns its sorted list index.
+func (x *sortedIndex) Insert(item *Item) int {
+	idx := 0
+	x.root = x.insert(x.root, item, &idx)
+
+	return idx
+}
+
+// Delete removes an item and returns its sorted list index before the removal (-1 if not found).
+func (x *sortedIndex) Delete(item *Item) int {
+	idx := x.IndexOf(item)
+	if idx < 0 {
+		return -1
+	}
+	x.root = x.delete(x.root, item)
+
+	return idx
+}
+
+// Ascend iterates over items in the sorted order until the handler returns false.
+func (x *sortedIndex) Ascend(handler func(item *Item) bool) {
+	stack := make([]*indexNode, 0, int(x.root.getHeight())+1)
+	n := x.root
+	for n != nil || len(stack) > 0 {
+		for n != nil {
+			stack = append(stack, n)
+			n = n.left
+		}
+
+		n = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !handler(n.item) {
+			return
+		}
+		n = n.right
+	}
+}
+
+// insert inserts the item into the subtree accumulating its index and returns a new subtree root.
+func (x *sortedIndex) insert(n *indexNode, item *Item, idx *int) *indexNode {
+	if n == nil {
+		return newIndexNode(item)
+	}
+
+	if x.less(item, n.item) {
+		n.left = x.insert(n.left, item, idx)
+	} else {
+		*idx += int(n.left.getSize()) + 1
+		n.right = x.insert(n.right, item, idx)
+	}
+
+	return n.rebalance()
+}
+
+// delete removes the item from the subtree and returns a new subtree root.
+func (x *sortedIndex) delete(n *indexNode, item *Item) *indexNode {
+	if n == nil {
+		return nil
+	}
+
+	switch {
+	case x.less(item, n.item):
+		n.left = x.delete(n.left, item)
+	case x.less(n.item, item):
+		n.right = x.delete(n.right, item)
+	default:
+		if n.left == nil {
+			return n.right
+		}
+		if n.right == nil {
+			return n.left
+		}
+
+		var minNode *indexNode
+		n.right, minNode = n.right.cutMin()
+		minNode.left, minNode.right = n.left, n.right
+		n = minNode
+	}
+
+	return n.rebalance()
+}
+
+// newSortedIndex creates an empty sortedIndex object.
+func newSortedIndex(less func(a, b *Item) bool) *sortedIndex {
+	return &sortedIndex{
+		less: less,
+	}
+}
+
+// newSortedIndexFromItems creates a balanced sortedIndex object from already sorted items.
+func newSortedIndexFromItems(less func(a, b *Item) bool, items []*Item) *sortedIndex {
+	var build func(items []*Item) *indexNode
+	build = func(items []*Item) *indexNode {
+		if len(items) == 0 {
+			return nil
+		}
+
+		mid := len(items) / 2
+		n := newIndexNode(items[mid])
+		n.left = build(items[:mid])
+		n.right = build(items[mid+1:])
+		n.update()
+
+		return n
+	}
+
+	return &sortedIndex{
+		root: build(items),
+		less: less,
+	}
+}
+
+// newIndexNode creates a new leaf node.
+func newIndexNode(item *Item) *indexNode {
+	itemHash := model.NewListItemHash(item.Id.String(), item.Value)
+
+	return &indexNode{
+		item:     item,
+		itemHash: itemHash,
+		hash:     itemHash,
+		size:     1,
+		height:   1,
+	}
+}
+
+// getSize returns the subtree size (nil-safe).
+func (n *indexNode) getSize() int32 {
+	if n == nil {
+		return 0
+	}
+
+	return n.size
+}
+
+// getHeight returns the subtree height (nil-safe).
+func (n *indexNode) getHeight() int8 {
+	if n == nil {
+		return 0
+	}
+
+	return n.height
+}
+
+// getHash returns the subtree hash (nil-safe).
+func (n *indexNode) getHash() model.ListHash {
+	if n == nil {
+		return model.EmptyListHash
+	}
+
+	return n.hash
+}
+
+// update recalculates the node size, height and hash using its children.
+func (n *indexNode) update() {
+	n.size = n.left.getSize() + n.right.getSize() + 1
+	n.hash = n.left.getHash().Concat(n.itemHash).Concat(n.right.getHash())
+
+	n.height = n.left.getHeight()
+	if rightHeight := n.right.getHeight(); rightHeight > n.height {
+		n.height = rightHeight
+	}
+	n.height++
+}
+
+// rebalance restores the AVL invariant for the node and returns a new subtree root.
+func (n *indexNode) rebalance() *indexNode {
+	n.update()
+
+	switch balance := n.left.getHeight() - n.right.getHeight(); {
+	case balance > 1:
+		if n.left.left.getHeight() < n.left.right.getHeight() {
+			n.left = n.left.rotateLeft()
+		}
+		return n.rotateRight()
+	case balance < -1:
+		if n.right.right.getHeight() < n.right.left.getHeight() {
+			n.right = n.right.rotateRight()
+		}
+		return n.rotateLeft()
+	}
+
+	return n
+}
+
+// rotateLeft performs the left subtree rotation.
+func (n *indexNode) rotateLeft() *indexNode {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	n.update()
+	r.update()
+
+	return r
+}
+
+// rotateRight performs the right subtree rotation.
+func (n *indexNode) rotateRight() *indexNode {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	n.update()
+	l.update()
+
+	return l
+}
+
+// cutMin removes the leftmost node from the subtree and returns a new subtree root alongside the removed node.
+func (n *indexNode) cutMin() (*indexNode, *indexNode) {
+	if n.left == nil {
+		return n.right, n
+	}
+
+	var minNode *indexNode
+	n.left, minNode = n.left.cutMin()
+
+	return n.rebalance(), minNode
+}
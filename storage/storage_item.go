@@ -3,7 +3,6 @@ package storage
 import (
 	"encoding/json"
 	"fmt"
-	"time"
 
 	"github.com/google/uuid"
 
@@ -17,7 +16,14 @@ type (
 		Value     model.StorageValue
 		IsDeleted bool
 		UpdatedBy model.ClientId
-		UpdatedAt time.Time
+		UpdatedAt model.HLC
+	}
+
+	// itemRevision keeps an Item state before an operation was applied (used to rollback a Document).
+	itemRevision struct {
+		Id uuid.UUID
+		// Nil if Item didn't exist
+		Item *Item
 	}
 )
 
@@ -32,7 +38,7 @@ func (i Item) String() string {
 }
 
 // NewStorageItem creates a new Item object (no validation as it is used internaly).
-func NewStorageItem(itemId uuid.UUID, itemValue model.StorageValue, clientId model.ClientId, timestamp time.Time) *Item {
+func NewStorageItem(itemId uuid.UUID, itemValue model.StorageValue, clientId model.ClientId, timestamp model.HLC) *Item {
 	return &Item{
 		Id:        itemId,
 		Value:     itemValue,
@@ -1,23 +1,60 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
-	"time"
 
 	"github.com/google/uuid"
 
 	"github.com/itiky/collaborate-storage/model"
 )
 
+// Operation rejection reasons.
+var (
+	// Insert of an existing item
+	ErrItemExists = errors.New("item exists")
+	// Update / delete of an unknown item
+	ErrItemNotFound = errors.New("item not found")
+	// Insert / update / delete of a deleted item
+	ErrItemDeleted = errors.New("item deleted")
+	// Update / delete of an item updated later (TimestampConflictPolicy)
+	ErrConflict = errors.New("item updated later")
+)
+
+const (
+	// Item is created or updated
+	SetModeUpsert SetMode = iota
+	// Item must not exist
+	SetModeInsert
+	// Item must exist and must not be deleted
+	SetModeUpdate
+)
+
+const (
+	// Update of a deleted item is rejected
+	DeleteWinsConflictPolicy ConflictPolicy = iota
+	// Update of a deleted item restores it
+	UpdateResurrectsConflictPolicy
+	// The latest write (by HLC timestamp) wins: update of a deleted item restores it if the update is newer than the delete,
+	// update / delete of an item is rejected if the item was updated later
+	TimestampConflictPolicy
+)
+
 type (
+	// SetMode defines SetOperation item existence requirements checked on apply.
+	SetMode int
+
+	// ConflictPolicy defines how an update / delete conflict is resolved on apply.
+	ConflictPolicy int
+
 	// StorageOperation is an operation performed on Storage to update its state.
 	StorageOperation interface {
-		// Update the storage state
-		Apply(s *Storage) *model.ListOperation
+		// Update the storage state (returns nil if the operation had no effect, error if it was rejected)
+		Apply(s *Storage) (*model.ListOperation, error)
 		// Only used for tests
 		GetId() uuid.UUID
-		// Only used for tests
-		GetTimestamp() time.Time
+		// Operation HLC timestamp (operations are applied in the timestamp order)
+		GetTimestamp() model.HLC
 	}
 
 	// SetOperation implements StorageOperation interface for create/update operation.
@@ -26,20 +63,48 @@ type (
 		Value     model.StorageValue
 		IsDeleted bool
 		UpdatedBy model.ClientId
-		UpdatedAt time.Time
+		UpdatedAt model.HLC
+		Mode      SetMode
+		// Deleted item update conflict resolution
+		Conflict ConflictPolicy
 	}
 
 	// DeleteOperation implements StorageOperation interface for delete operation.
 	DeleteOperation struct {
 		Id        uuid.UUID
 		DeletedBy model.ClientId
-		DeletedAt time.Time
+		DeletedAt model.HLC
+		// Operation is rejected if the item doesn't exist (ignored otherwise)
+		MustExist bool
+		// Updated item delete conflict resolution
+		Conflict ConflictPolicy
+	}
+
+	// OperationPolicy defines which update request existence requirements are relaxed.
+	// Zero value enforces all of them: insert requires a new item, update requires a live item, delete requires an existing one.
+	OperationPolicy struct {
+		// Insert of an existing item updates it (upsert)
+		InsertUpsert bool
+		// Update of an unknown item creates it (upsert)
+		UpdateUpsert bool
+		// Delete of an unknown / deleted item is ignored
+		DeleteIgnoreMissing bool
+		// Update / delete conflict resolution
+		Conflict ConflictPolicy
+	}
+
+	// OperationResult is a StorageOperation apply result.
+	OperationResult struct {
+		// Operation changed the storage state
+		Applied bool
+		// Rejection reason (nil if the operation was applied or had no effect)
+		Err error
 	}
 )
 
 // Apply implements StorageOperation interface.
-func (o SetOperation) Apply(s *Storage) *model.ListOperation {
-	return s.set(o.Id, o.Value, o.UpdatedBy, o.UpdatedAt)
+func (o SetOperation) Apply(s *Storage) (*model.ListOperation, error) {
+	return s.set(o.Id, o.Value, o.Mode, o.Conflict, o.UpdatedBy, o.UpdatedAt)
 }
 
 // GetId implements StorageOperation interface.
@@ -48,13 +113,13 @@ func (o SetOperation) GetId() uuid.UUID {
 }
 
 // GetTimestamp implements StorageOperation interface.
-func (o SetOperation) GetTimestamp() time.Time {
+func (o SetOperation) GetTimestamp() model.HLC {
 	return o.UpdatedAt
 }
 
 // Apply implements StorageOperation interface.
-func (o DeleteOperation) Apply(s *Storage) *model.ListOperation {
-	return s.delete(o.Id, o.DeletedBy, o.DeletedAt)
+func (o DeleteOperation) Apply(s *Storage) (*model.ListOperation, error) {
+	return s.delete(o.Id, o.MustExist, o.Conflict, o.DeletedBy, o.DeletedAt)
 }
 
 // GetId implements StorageOperation interface.
@@ -63,12 +128,69 @@ func (o DeleteOperation) GetId() uuid.UUID {
 }
 
 // GetTimestamp implements StorageOperation interface.
-func (o DeleteOperation) GetTimestamp() time.Time {
+func (o DeleteOperation) GetTimestamp() model.HLC {
 	return o.DeletedAt
 }
 
-// NewSetOperation creates a valid StorageOperation object.
-func NewSetOperation(itemId string, itemValue model.StorageValue, clientId model.ClientId, timestamp time.Time) (SetOperation, error) {
+// NewOperation creates a valid StorageOperation object for the update request operation applying the policy.
+func (p OperationPolicy) NewOperation(reqOp model.OperationRequest, clientId model.ClientId, timestamp model.HLC) (StorageOperation, error) {
+	var op SetOperation
+	var err error
+	switch reqOp.Type {
+	case model.InsertOperationType:
+		if p.InsertUpsert {
+			op, err = NewSetOperation(reqOp.Id, reqOp.Value, clientId, timestamp)
+		} else {
+			op, err = NewInsertOperation(reqOp.Id, reqOp.Value, clientId, timestamp)
+		}
+	case model.UpdateOperationType:
+		if p.UpdateUpsert {
+			op, err = NewSetOperation(reqOp.Id, reqOp.Value, clientId, timestamp)
+		} else {
+			op, err = NewUpdateOperation(reqOp.Id, reqOp.Value, clientId, timestamp)
+		}
+	case model.UpsertOperationType:
+		op, err = NewSetOperation(reqOp.Id, reqOp.Value, clientId, timestamp)
+	case model.DeleteOperationType:
+		deleteOp, err := NewDeleteOperation(reqOp.Id, clientId, timestamp)
+		deleteOp.MustExist = !p.DeleteIgnoreMissing
+		deleteOp.Conflict = p.Conflict
+		return deleteOp, err
+	default:
+		return nil, fmt.Errorf("unsupported operation type: %s", reqOp.Type)
+	}
+	op.Conflict = p.Conflict
+
+	return op, err
+}
+
+// String implements stringer interface.
+func (p ConflictPolicy) String() string {
+	switch p {
+	case DeleteWinsConflictPolicy:
+		return "delete-wins"
+	case UpdateResurrectsConflictPolicy:
+		return "update-resurrects"
+	case TimestampConflictPolicy:
+		return "timestamp"
+	}
+
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+// ParseConflictPolicy returns ConflictPolicy by its name.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for _, p := range []ConflictPolicy{DeleteWinsConflictPolicy, UpdateResurrectsConflictPolicy, TimestampConflictPolicy} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+
+	return DeleteWinsConflictPolicy, fmt.Errorf("conflict policy %q: unknown", name)
+}
+
+// NewSetOperation creates a valid StorageOperation object (upsert).
+func NewSetOperation(itemId string, itemValue model.StorageValue, clientId model.ClientId, timestamp model.HLC) (SetOperation, error) {
 	id, err := uuid.Parse(itemId)
 	if err != nil {
 		return SetOperation{}, fmt.Errorf("%s: invalid: %w", "itemId", err)
@@ -85,8 +207,24 @@ func NewSetOperation(itemId string, itemValue model.StorageValue, clientId model
 	}, nil
 }
 
+// NewInsertOperation creates a valid StorageOperation object rejected if the item exists.
+func NewInsertOperation(itemId string, itemValue model.StorageValue, clientId model.ClientId, timestamp model.HLC) (SetOperation, error) {
+	op, err := NewSetOperation(itemId, itemValue, clientId, timestamp)
+	op.Mode = SetModeInsert
+
+	return op, err
+}
+
+// NewUpdateOperation creates a valid StorageOperation object rejected if the item doesn't exist.
+func NewUpdateOperation(itemId string, itemValue model.StorageValue, clientId model.ClientId, timestamp model.HLC) (SetOperation, error) {
+	op, err := NewSetOperation(itemId, itemValue, clientId, timestamp)
+	op.Mode = SetModeUpdate
+
+	return op, err
+}
+
 // NewDeleteOperation creates a valid StorageOperation object.
-func NewDeleteOperation(itemId string, clientId model.ClientId, timestamp time.Time) (DeleteOperation, error) {
+func NewDeleteOperation(itemId string, clientId model.ClientId, timestamp model.HLC) (DeleteOperation, error) {
 	id, err := uuid.Parse(itemId)
 	if err != nil {
 		return DeleteOperation{}, fmt.Errorf("%s: invalid: %w", "itemId", err)
@@ -1,9 +1,15 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
@@ -15,19 +21,23 @@ import (
 
 const BenchStorageSize = 1000000
 
+var testCodec = model.MustGetValueCodec(model.Int32ValueCodecName)
+
 // Test adds/removes item to/from the storage and checks data integrity.
 func Test_Storage_Sorting(t *testing.T) {
-	storage := NewStorage()
+	storage := NewStorage(testCodec)
 
 	isSorted := func(comment string) {
 		t.Logf("%s:\n%s", comment, storage.String())
 
-		require.GreaterOrEqual(t, len(storage.idDataMatch), len(storage.list), "list/dataMap length mismatch")
+		require.GreaterOrEqual(t, len(storage.idDataMatch), storage.index.Len(), "list/dataMap length mismatch")
 
-		prevValue := model.StorageValue(math.MinInt32)
-		for _, item := range storage.list {
-			require.LessOrEqual(t, prevValue, item.Value, "item.Value check")
+		prevValue := model.NewInt32Value(math.MinInt32)
+		list := storage.Export()
+		for i, item := range storageItems(storage) {
+			require.LessOrEqual(t, testCodec.Compare(prevValue, item.Value), 0, "item.Value check")
 			require.False(t, item.IsDeleted, "item isDeleted")
+			require.True(t, list.IsOrdered(testCodec, i), "item order check")
 
 			prevValue = item.Value
 		}
@@ -35,47 +45,47 @@ func Test_Storage_Sorting(t *testing.T) {
 
 	// add a few items
 	{
-		newValue := model.StorageValue(5)
-		storage.set(uuid.New(), newValue, 0, time.Time{})
-		isSorted(fmt.Sprintf("Adding %d", newValue))
+		newValue := model.NewInt32Value(5)
+		storage.set(uuid.New(), newValue, SetModeUpsert, DeleteWinsConflictPolicy, 0, model.HLC{})
+		isSorted(fmt.Sprintf("Adding %s", testCodec.Format(newValue)))
 
-		newValue = model.StorageValue(1)
-		storage.set(uuid.New(), newValue, 0, time.Time{})
-		isSorted(fmt.Sprintf("Adding %d", newValue))
+		newValue = model.NewInt32Value(1)
+		storage.set(uuid.New(), newValue, SetModeUpsert, DeleteWinsConflictPolicy, 0, model.HLC{})
+		isSorted(fmt.Sprintf("Adding %s", testCodec.Format(newValue)))
 
-		newValue = model.StorageValue(10)
-		storage.set(uuid.New(), newValue, 0, time.Time{})
-		isSorted(fmt.Sprintf("Adding %d", newValue))
+		newValue = model.NewInt32Value(10)
+		storage.set(uuid.New(), newValue, SetModeUpsert, DeleteWinsConflictPolicy, 0, model.HLC{})
+		isSorted(fmt.Sprintf("Adding %s", testCodec.Format(newValue)))
 
-		newValue = model.StorageValue(8)
-		storage.set(uuid.New(), newValue, 0, time.Time{})
-		isSorted(fmt.Sprintf("Adding %d", newValue))
+		newValue = model.NewInt32Value(8)
+		storage.set(uuid.New(), newValue, SetModeUpsert, DeleteWinsConflictPolicy, 0, model.HLC{})
+		isSorted(fmt.Sprintf("Adding %s", testCodec.Format(newValue)))
 
-		newValue = model.StorageValue(-1)
-		storage.set(uuid.New(), newValue, 0, time.Time{})
-		isSorted(fmt.Sprintf("Adding %d", newValue))
+		newValue = model.NewInt32Value(-1)
+		storage.set(uuid.New(), newValue, SetModeUpsert, DeleteWinsConflictPolicy, 0, model.HLC{})
+		isSorted(fmt.Sprintf("Adding %s", testCodec.Format(newValue)))
 	}
 
 	// remove a few items
 	{
 		idx := 0
-		storage.delete(storage.list[idx].Id, 0, time.Time{})
+		storage.delete(storage.index.At(idx).Id, false, DeleteWinsConflictPolicy, 0, model.HLC{})
 		isSorted(fmt.Sprintf("Removing [%d]", idx))
 
 		idx = 3
-		storage.delete(storage.list[idx].Id, 0, time.Time{})
+		storage.delete(storage.index.At(idx).Id, false, DeleteWinsConflictPolicy, 0, model.HLC{})
 		isSorted(fmt.Sprintf("Removing [%d]", idx))
 
 		idx = 1
-		storage.delete(storage.list[idx].Id, 0, time.Time{})
+		storage.delete(storage.index.At(idx).Id, false, DeleteWinsConflictPolicy, 0, model.HLC{})
 		isSorted(fmt.Sprintf("Removing [%d]", idx))
 
 		idx = 1
-		storage.delete(storage.list[idx].Id, 0, time.Time{})
+		storage.delete(storage.index.At(idx).Id, false, DeleteWinsConflictPolicy, 0, model.HLC{})
 		isSorted(fmt.Sprintf("Removing [%d]", idx))
 
 		idx = 0
-		storage.delete(storage.list[idx].Id, 0, time.Time{})
+		storage.delete(storage.index.At(idx).Id, false, DeleteWinsConflictPolicy, 0, model.HLC{})
 		isSorted(fmt.Sprintf("Removing [%d]", idx))
 
 		require.Len(t, storage.idDataMatch, 5)
@@ -87,18 +97,18 @@ func Test_Storage_Sorting(t *testing.T) {
 
 // Test applies StorageOperation and checks that returned model.ListOperation objects can build an equal model.StorageList.
 func Test_Storage_ModelList(t *testing.T) {
-	storage := NewStorage()
+	storage := NewStorage(testCodec)
 	var modelList model.StorageList
-	now := time.Now()
+	now := model.HLCFromTime(time.Now())
 
 	newInsertOp := func() SetOperation {
-		op, err := NewSetOperation(uuid.New().String(), model.StorageValue(rand.Int31()), 0, now)
+		op, err := NewSetOperation(uuid.New().String(), testCodec.Random(), 0, now)
 		require.NoError(t, err)
 		return op
 	}
 
 	newUpdateOp := func(id string) SetOperation {
-		op, err := NewSetOperation(id, model.StorageValue(rand.Int31()), 0, now)
+		op, err := NewSetOperation(id, testCodec.Random(), 0, now)
 		require.NoError(t, err)
 		return op
 	}
@@ -116,7 +126,7 @@ func Test_Storage_ModelList(t *testing.T) {
 
 		require.Len(t, modelList, len(storageList), "len mismatch")
 		for i := 0; i < len(modelList); i++ {
-			storageItem := storage.list[i]
+			storageItem := storageList[i]
 			modelItem := modelList[i]
 			require.Equal(t, storageItem.Id.String(), modelItem.Id, "item[%d].Id", i)
 			require.Equal(t, storageItem.Value, modelItem.Value, "item[%d].Value", i)
@@ -133,9 +143,9 @@ func Test_Storage_ModelList(t *testing.T) {
 	}
 	{
 		listOps := storage.ApplyOperations(storageOps1...)
-		list, err := model.ApplyListOperations(modelList, listOps...)
+		list, err := model.ApplyListOperations(testCodec, modelList, listOps...)
 		require.NoError(t, err)
-		checkLists("storageOps1", storage.list, list)
+		checkLists("storageOps1", storageItems(storage), list)
 		modelList = list
 	}
 
@@ -147,9 +157,9 @@ func Test_Storage_ModelList(t *testing.T) {
 	}
 	{
 		listOps := storage.ApplyOperations(storageOps2...)
-		list, err := model.ApplyListOperations(modelList, listOps...)
+		list, err := model.ApplyListOperations(testCodec, modelList, listOps...)
 		require.NoError(t, err)
-		checkLists("storageOps2", storage.list, list)
+		checkLists("storageOps2", storageItems(storage), list)
 		modelList = list
 	}
 
@@ -160,9 +170,9 @@ func Test_Storage_ModelList(t *testing.T) {
 	}
 	{
 		listOps := storage.ApplyOperations(storageOps3...)
-		list, err := model.ApplyListOperations(modelList, listOps...)
+		list, err := model.ApplyListOperations(testCodec, modelList, listOps...)
 		require.NoError(t, err)
-		checkLists("storageOps3", storage.list, list)
+		checkLists("storageOps3", storageItems(storage), list)
 		modelList = list
 	}
 
@@ -173,45 +183,299 @@ func Test_Storage_ModelList(t *testing.T) {
 	}
 	{
 		listOps := storage.ApplyOperations(storageOps4...)
-		list, err := model.ApplyListOperations(modelList, listOps...)
+		list, err := model.ApplyListOperations(testCodec, modelList, listOps...)
 		require.NoError(t, err)
-		checkLists("storageOps4", storage.list, list)
+		checkLists("storageOps4", storageItems(storage), list)
 		modelList = list
 	}
 }
 
+// Test applies random operations and compares the produced model.ListOperation objects with the plain sorted slice implementation.
+func Test_Storage_IndexVsSlice(t *testing.T) {
+	storage := NewStorage(testCodec)
+	now := model.HLCFromTime(time.Now())
+
+	// Reference implementation: model.StorageList binary search
+	refList := make(model.StorageList, 0)
+	refInsert := func(item model.ListItem) int {
+		idx := refList.Search(testCodec, item)
+		refList = append(refList, model.ListItem{})
+		copy(refList[idx+1:], refList[idx:])
+		refList[idx] = item
+		return idx
+	}
+	refCut := func(item model.ListItem) int {
+		idx := refList.Search(testCodec, item)
+		refList = append(refList[:idx], refList[idx+1:]...)
+		return idx
+	}
+
+	// Small values range to get a lot of equal values
+	newValue := func() model.StorageValue {
+		return model.NewInt32Value(int32(rand.Intn(10)))
+	}
+
+	for n := 0; n < 2000; n++ {
+		switch {
+		case len(refList) == 0 || rand.Intn(3) == 0:
+			item := model.ListItem{Id: uuid.New().String(), Value: newValue()}
+			listOp, err := storage.set(uuid.MustParse(item.Id), item.Value, SetModeInsert, DeleteWinsConflictPolicy, 0, now)
+			require.NoError(t, err)
+			require.Equal(t, refInsert(item), listOp.Index, "op[%d]: insert index", n)
+		case rand.Intn(2) == 0:
+			item := refList[rand.Intn(len(refList))]
+			idxToCut := refCut(item)
+			item.Value = newValue()
+			idxToInsert := refInsert(item)
+			listOp, err := storage.set(uuid.MustParse(item.Id), item.Value, SetModeUpdate, DeleteWinsConflictPolicy, 0, now)
+			require.NoError(t, err)
+			require.Equal(t, idxToCut, listOp.Index, "op[%d]: update index", n)
+			require.Equal(t, idxToInsert, listOp.NewIndex, "op[%d]: update newIndex", n)
+		default:
+			item := refList[rand.Intn(len(refList))]
+			idxToCut := refCut(item)
+			listOp, err := storage.delete(uuid.MustParse(item.Id), true, DeleteWinsConflictPolicy, 0, now)
+			require.NoError(t, err)
+			require.Equal(t, idxToCut, listOp.Index, "op[%d]: delete index", n)
+		}
+
+		require.Equal(t, len(refList), storage.index.Len(), "op[%d]: length", n)
+	}
+
+	for i, item := range storageItems(storage) {
+		require.Equal(t, refList[i].Id, item.Id.String(), "item[%d].Id", i)
+		require.Equal(t, i, storage.index.IndexOf(item), "item[%d]: IndexOf", i)
+	}
+}
+
+// Test applies the same set of operations split into different batches and checks replicas are equal.
+func Test_Storage_Deterministic(t *testing.T) {
+	now := model.HLCFromTime(time.Now())
+
+	ops := make([]StorageOperation, 0)
+	ids := make([]string, 0)
+	for i := 0; i < 500; i++ {
+		id := uuid.New().String()
+		op, err := NewSetOperation(id, model.NewInt32Value(int32(rand.Intn(5))), 0, now)
+		require.NoError(t, err)
+		ops, ids = append(ops, op), append(ids, id)
+	}
+	for i := 0; i < 100; i++ {
+		op, err := NewDeleteOperation(ids[rand.Intn(len(ids))], 0, now)
+		require.NoError(t, err)
+		ops = append(ops, op)
+	}
+
+	// Replica 1: a single batch
+	storage1 := NewStorage(testCodec)
+	list1, err := model.ApplyListOperations(testCodec, nil, storage1.ApplyOperations(ops...)...)
+	require.NoError(t, err)
+
+	// Replica 2: inserts are shuffled and split into random batches
+	storage2 := NewStorage(testCodec)
+	var list2 model.StorageList
+	insertOps := make([]StorageOperation, 500)
+	copy(insertOps, ops[:500])
+	rand.Shuffle(len(insertOps), func(i, j int) {
+		insertOps[i], insertOps[j] = insertOps[j], insertOps[i]
+	})
+	for batchOps := append(insertOps, ops[500:]...); len(batchOps) > 0; {
+		batchLen := rand.Intn(len(batchOps)) + 1
+		list2, err = model.ApplyListOperations(testCodec, list2, storage2.ApplyOperations(batchOps[:batchLen]...)...)
+		require.NoError(t, err)
+		batchOps = batchOps[batchLen:]
+	}
+
+	require.Equal(t, storage1.Export(), storage2.Export())
+	require.Equal(t, list1, list2)
+	require.Equal(t, storage1.Export(), list1)
+}
+
+// Test resolves update / delete conflicts using different policies.
+func Test_Storage_ConflictPolicy(t *testing.T) {
+	t0 := model.HLCFromTime(time.Now())
+	t1, t2, t3 := t0, t0, t0
+	t1.Logical, t2.Logical, t3.Logical = 1, 2, 3
+
+	type testCase struct {
+		policy ConflictPolicy
+		// Update of an item deleted at t2
+		olderUpdateErr error
+		newerUpdateErr error
+		// Delete at t2 of an item updated at t3
+		olderDeleteErr error
+		// Update at t1 of an item updated at t3
+		olderLiveUpdateErr error
+	}
+	testCases := []testCase{
+		{policy: DeleteWinsConflictPolicy, olderUpdateErr: ErrItemDeleted, newerUpdateErr: ErrItemDeleted},
+		{policy: UpdateResurrectsConflictPolicy},
+		{policy: TimestampConflictPolicy, olderUpdateErr: ErrItemDeleted, olderDeleteErr: ErrConflict, olderLiveUpdateErr: ErrConflict},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			storage := NewStorage(testCodec)
+			var list model.StorageList
+			apply := func(op StorageOperation) error {
+				listOp, err := op.Apply(storage)
+				if listOp != nil {
+					list, err = model.ApplyListOperations(testCodec, list, *listOp)
+					require.NoError(t, err)
+				}
+				require.Equal(t, storage.Export(), list)
+				return err
+			}
+
+			id1, id2, id3 := uuid.New().String(), uuid.New().String(), uuid.New().String()
+			for _, id := range []string{id1, id2, id3} {
+				op, err := NewInsertOperation(id, testCodec.Random(), 0, t0)
+				require.NoError(t, err)
+				require.NoError(t, apply(op))
+			}
+
+			deleteOp, err := NewDeleteOperation(id1, 0, t2)
+			require.NoError(t, err)
+			deleteOp.MustExist, deleteOp.Conflict = true, tc.policy
+			require.NoError(t, apply(deleteOp))
+
+			// Update vs delete
+			for _, ts := range []model.HLC{t1, t3} {
+				updateOp, err := NewUpdateOperation(id1, testCodec.Random(), 0, ts)
+				require.NoError(t, err)
+				updateOp.Conflict = tc.policy
+
+				expectedErr := tc.olderUpdateErr
+				if ts == t3 {
+					expectedErr = tc.newerUpdateErr
+				}
+				require.Equal(t, expectedErr, apply(updateOp), "update at %v", ts)
+			}
+
+			// Insert can't restore a deleted item
+			insertOp, err := NewInsertOperation(id1, testCodec.Random(), 0, t3)
+			require.NoError(t, err)
+			insertOp.Conflict = tc.policy
+			expectedErr := ErrItemDeleted
+			if storage.index.Len() == 3 {
+				expectedErr = ErrItemExists
+			}
+			require.Equal(t, expectedErr, apply(insertOp))
+
+			// Delete vs update
+			updateOp, err := NewUpdateOperation(id2, testCodec.Random(), 0, t3)
+			require.NoError(t, err)
+			require.NoError(t, apply(updateOp))
+
+			deleteOp, err = NewDeleteOperation(id2, 0, t2)
+			require.NoError(t, err)
+			deleteOp.MustExist, deleteOp.Conflict = true, tc.policy
+			require.Equal(t, tc.olderDeleteErr, apply(deleteOp))
+
+			// Update vs update
+			updateOp, err = NewUpdateOperation(id3, testCodec.Random(), 0, t3)
+			require.NoError(t, err)
+			require.NoError(t, apply(updateOp))
+
+			updateOp, err = NewUpdateOperation(id3, testCodec.Random(), 0, t1)
+			require.NoError(t, err)
+			updateOp.Conflict = tc.policy
+			require.Equal(t, tc.olderLiveUpdateErr, apply(updateOp))
+		})
+	}
+}
+
+// Test saves / loads storage files with different value codecs (including the legacy file format).
+func Test_Storage_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	checkHistory := func(h *DocumentHistory, codec model.ValueCodec, size int) {
+		require.Equal(t, codec.Name(), h.ValueCodec().Name())
+
+		_, list := h.GetOutputSnapshot()
+		require.Len(t, list, size)
+		for i := range list {
+			require.True(t, list.IsOrdered(codec, i), "item[%d] order check", i)
+		}
+	}
+
+	// Current format
+	for _, codecName := range model.GetValueCodecNames() {
+		codec := model.MustGetValueCodec(codecName)
+		filePath := filepath.Join(dir, codecName+".dat")
+
+		require.NoError(t, GenAndSaveInitialStorage(filePath, 100, codec))
+		h, err := NewDocHistoryFromFile(filePath, "", "")
+		require.NoError(t, err)
+		checkHistory(h, codec, 100)
+	}
+
+	// Legacy format: int32 values without a header sorted by value only
+	{
+		objs := make([]legacyStorageItem, 0)
+		for i := 0; i < 100; i++ {
+			objs = append(objs, legacyStorageItem{Id: uuid.New(), Value: int32(rand.Intn(10) - 5)})
+		}
+		sort.Slice(objs, func(i, j int) bool {
+			return objs[i].Value < objs[j].Value
+		})
+
+		filePath := filepath.Join(dir, "legacy.dat")
+		objsRaw := new(bytes.Buffer)
+		require.NoError(t, gob.NewEncoder(objsRaw).Encode(objs))
+		require.NoError(t, ioutil.WriteFile(filePath, objsRaw.Bytes(), 0644))
+
+		h, err := NewDocHistoryFromFile(filePath, "", "")
+		require.NoError(t, err)
+		checkHistory(h, testCodec, 100)
+	}
+}
+
 func Benchmark_Storage_Insert(b *testing.B) {
 	now := time.Now()
-	s := newStorageFromObjs(newStorageMockObjs(BenchStorageSize, now))
+	s := newStorageFromObjs(testCodec, newStorageMockObjs(testCodec, BenchStorageSize, now))
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
-		obj := newStorageMockObj(now)
-		s.set(obj.Id, obj.Value, obj.UpdatedBy, obj.UpdatedAt)
+		obj := newStorageMockObj(testCodec, now)
+		s.set(obj.Id, obj.Value, SetModeInsert, DeleteWinsConflictPolicy, obj.UpdatedBy, obj.UpdatedAt)
 	}
 }
 
 func Benchmark_Storage_Update(b *testing.B) {
 	now := time.Now()
-	s := newStorageFromObjs(newStorageMockObjs(BenchStorageSize, now))
+	s := newStorageFromObjs(testCodec, newStorageMockObjs(testCodec, BenchStorageSize, now))
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
-		obj := s.list[rand.Intn(BenchStorageSize)]
-		s.set(obj.Id, model.StorageValue(rand.Int31()), obj.UpdatedBy, obj.UpdatedAt)
+		obj := s.index.At(rand.Intn(BenchStorageSize))
+		s.set(obj.Id, testCodec.Random(), SetModeUpdate, DeleteWinsConflictPolicy, obj.UpdatedBy, obj.UpdatedAt)
 	}
 }
 
 func Benchmark_Storage_Delete(b *testing.B) {
 	now := time.Now()
-	s := newStorageFromObjs(newStorageMockObjs(BenchStorageSize, now))
+	s := newStorageFromObjs(testCodec, newStorageMockObjs(testCodec, BenchStorageSize, now))
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
-		if len(s.list) == 0 {
+		if s.index.Len() == 0 {
 			return
 		}
-		obj := s.list[rand.Intn(len(s.list))]
-		s.delete(obj.Id, obj.UpdatedBy, obj.UpdatedAt)
+		obj := s.index.At(rand.Intn(s.index.Len()))
+		s.delete(obj.Id, true, DeleteWinsConflictPolicy, obj.UpdatedBy, obj.UpdatedAt)
 	}
 }
+
+// storageItems returns the Storage sorted list items.
+func storageItems(s *Storage) []*Item {
+	items := make([]*Item, 0, s.index.Len())
+	s.index.Ascend(func(item *Item) bool {
+		items = append(items, item)
+		return true
+	})
+
+	return items
+}
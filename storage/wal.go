@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itiky/collaborate-storage/internal/fileutil"
+	"github.com/itiky/collaborate-storage/model"
+)
+
+const (
+	walRecordTypeHeader  walRecordType = "header"
+	walRecordTypeAdd     walRecordType = "add"
+	walRecordTypeRemove  walRecordType = "remove"
+	walRecordTypeReplace walRecordType = "replace"
+	walRecordTypeSquash  walRecordType = "squash"
+	// Client sequence numbers of requests without operations
+	walRecordTypeSequences walRecordType = "sequences"
+)
+
+type (
+	walRecordType string
+
+	// walFile is a segment file (*os.File, replaced in tests to inject failures).
+	walFile interface {
+		io.Writer
+		io.Seeker
+		Sync() error
+		Truncate(size int64) error
+		Close() error
+	}
+
+	// WAL is an append-only write-ahead log of DocumentHistory changes.
+	// Log is split into segment files (<path>.<N>): a new segment is started at every checkpoint,
+	// so segments older than the checkpoints kept can be removed.
+	// Records are framed using fileutil.EncodeRecord.
+	WAL struct {
+		// Segment files base path
+		path string
+		// The current (last) segment file
+		file walFile
+		// The current segment file size (end of the last valid record)
+		offset int64
+		// The current segment number
+		segment int
+		// Number of records within the current segment
+		records int
+		// Non-nil if a failed append couldn't be rolled back (the segment tail is unknown)
+		broken error
+	}
+
+	// walRecord is a DocumentHistory change.
+	walRecord struct {
+		Type walRecordType
+		// Header: base state checksum and value codec
+		BaseChecksum uint32
+		ValueCodec   string
+		// Add: a new version; Remove / Replace: the target version; Squash: the first version
+		Version int
+		// Squash: the last version
+		ToVersion int
+		// Add / Replace: version commit time
+		CreatedAt time.Time
+		// Add / Replace: version input operations
+		Operations []StorageOperation
+		// Add / Sequences: the highest client sequence numbers applied
+		ClientSequences map[model.ClientId]uint64
+	}
+)
+
+// Append writes and syncs a new record.
+// A partially written record is truncated on failure, WAL rejects all the following appends if that fails too.
+func (w *WAL) Append(rec walRecord) error {
+	if w.broken != nil {
+		return fmt.Errorf("broken by the previous append: %w", w.broken)
+	}
+
+	frame, err := fileutil.EncodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	if w.file == nil {
+		return errors.New("segment is not opened")
+	}
+	if _, err := w.file.Write(frame); err != nil {
+		return w.rollback(fmt.Errorf("write: %w", err))
+	}
+	if err := w.file.Sync(); err != nil {
+		return w.rollback(fmt.Errorf("sync: %w", err))
+	}
+	w.offset += int64(len(frame))
+	w.records++
+
+	return nil
+}
+
+// rollback truncates the current segment to the end of the last valid record after a failed append.
+// WAL is marked as broken if that fails.
+func (w *WAL) rollback(appendErr error) error {
+	err := w.file.Truncate(w.offset)
+	if err == nil {
+		_, err = w.file.Seek(w.offset, io.SeekStart)
+	}
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		w.broken = fmt.Errorf("segment %d: rollback to offset %d: %v (%v)", w.segment, w.offset, err, appendErr)
+		log.Printf("WAL: %v", w.broken)
+		return fmt.Errorf("%w (rollback failed: %v)", appendErr, err)
+	}
+
+	return appendErr
+}
+
+// Records returns the number of records within the current segment.
+func (w *WAL) Records() int {
+	return w.records
+}
+
+// Segment returns the current segment number.
+func (w *WAL) Segment() int {
+	return w.segment
+}
+
+// Close closes the current segment file.
+func (w *WAL) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+// rotate starts a new segment with the header record (the previous one is closed).
+func (w *WAL) rotate(header walRecord) error {
+	nextSegment := w.segment + 1
+	filePath := w.getSegmentPath(nextSegment)
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("creating segment (%s): %w", filePath, err)
+	}
+	if err := fileutil.SyncDir(filepath.Dir(w.path)); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		log.Printf("WAL: closing segment %d: %v", w.segment, err)
+	}
+	w.file, w.offset, w.segment, w.records = file, 0, nextSegment, 0
+
+	return w.Append(header)
+}
+
+// removeSegmentsBefore removes segment files older than the segment (the current one is kept).
+func (w *WAL) removeSegmentsBefore(segment int) error {
+	segments, err := w.listSegments()
+	if err != nil {
+		return err
+	}
+
+	for _, curSegment := range segments {
+		if curSegment >= segment || curSegment >= w.segment {
+			break
+		}
+		if err := os.Remove(w.getSegmentPath(curSegment)); err != nil {
+			return fmt.Errorf("removing segment (%s): %w", w.getSegmentPath(curSegment), err)
+		}
+	}
+
+	return nil
+}
+
+// replay reads all the records starting from the segment calling handler for each one (segment and record index within it are passed).
+// The last segment is opened for new records, its torn or corrupted tail (crash during append) is truncated.
+func (w *WAL) replay(fromSegment int, handler func(segment, recIdx int, rec walRecord) error) error {
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	segments, err := w.listSegments()
+	if err != nil {
+		return err
+	}
+	for len(segments) > 0 && segments[0] < fromSegment {
+		segments = segments[1:]
+	}
+	if len(segments) == 0 {
+		if fromSegment > 0 {
+			return fmt.Errorf("segment %d: not found", fromSegment)
+		}
+		segments = []int{fromSegment}
+	}
+	if segments[0] != fromSegment {
+		return fmt.Errorf("segment %d: not found (removed)", fromSegment)
+	}
+
+	for i, segment := range segments {
+		if segment != fromSegment+i {
+			return fmt.Errorf("segment %d: not found", fromSegment+i)
+		}
+
+		isLast := i == len(segments)-1
+		file, offset, records, err := replayWALSegment(w.getSegmentPath(segment), isLast, func(recIdx int, rec walRecord) error {
+			return handler(segment, recIdx, rec)
+		})
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", segment, err)
+		}
+		if !isLast {
+			file.Close()
+			continue
+		}
+		w.file, w.offset, w.segment, w.records = file, offset, segment, records
+	}
+
+	return nil
+}
+
+// listSegments returns the existing segment numbers (sorted).
+func (w *WAL) listSegments() ([]int, error) {
+	fileInfos, err := ioutil.ReadDir(filepath.Dir(w.path))
+	if err != nil {
+		return nil, fmt.Errorf("listing segments: %w", err)
+	}
+
+	prefix := filepath.Base(w.path) + "."
+	segments := make([]int, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		segment, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if err != nil || segment < 0 {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+// getSegmentPath returns the segment file path.
+func (w *WAL) getSegmentPath(segment int) string {
+	return fmt.Sprintf("%s.%06d", w.path, segment)
+}
+
+// replayWALSegment reads all the segment file records calling handler for each one.
+// A torn or corrupted tail is truncated if allowed (the last segment), error is returned otherwise.
+// Returns the file opened at the end of the valid records, the end offset and the number of records.
+func replayWALSegment(filePath string, truncateTail bool, handler func(recIdx int, rec walRecord) error) (*os.File, int64, int, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("open file (%s): %w", filePath, err)
+	}
+
+	reader := bufio.NewReader(file)
+	validOffset := int64(0)
+	records := 0
+	for {
+		rec := walRecord{}
+		frameLen, err := fileutil.ReadRecord(reader, &rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !truncateTail {
+				file.Close()
+				return nil, 0, 0, fmt.Errorf("record %d at offset %d is corrupted: %w", records, validOffset, err)
+			}
+			log.Printf("WAL: record %d at offset %d is corrupted (truncating): %v", records, validOffset, err)
+			if err := file.Truncate(validOffset); err != nil {
+				file.Close()
+				return nil, 0, 0, fmt.Errorf("truncate: %w", err)
+			}
+			break
+		}
+
+		if err := handler(records, rec); err != nil {
+			file.Close()
+			return nil, 0, 0, fmt.Errorf("record %d (%s): %w", records, rec.Type, err)
+		}
+		validOffset += frameLen
+		records++
+	}
+
+	if _, err := file.Seek(validOffset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, 0, fmt.Errorf("seek: %w", err)
+	}
+
+	return file, validOffset, records, nil
+}
+
+// OpenWAL opens the write-ahead log (segments are opened on replay).
+func OpenWAL(filePath string) (*WAL, error) {
+	dirInfo, err := os.Stat(filepath.Dir(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("stat dir (%s): %w", filepath.Dir(filePath), err)
+	}
+	if !dirInfo.IsDir() {
+		return nil, fmt.Errorf("%s: is not a directory", filepath.Dir(filePath))
+	}
+
+	return &WAL{
+		path: filePath,
+	}, nil
+}
+
+func init() {
+	gob.Register(SetOperation{})
+	gob.Register(DeleteOperation{})
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/itiky/collaborate-storage/model"
+)
+
+// Test writes versions / rewrites / squashes to WAL and restores the history after restart.
+func Test_WAL_Restore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath, walPath := filepath.Join(dir, "base.dat"), filepath.Join(dir, "history.wal")
+	require.NoError(t, GenAndSaveInitialStorage(filePath, 100, testCodec))
+
+	h, err := NewDocHistoryFromFile(filePath, walPath, "")
+	require.NoError(t, err)
+
+	ids := make([]string, 0)
+	for _, item := range h.storage.Export() {
+		ids = append(ids, item.Id)
+	}
+	for i := 0; i < 6; i++ {
+		_, _, err := h.CommitVersion(newTestStorageOps(t, &ids, 20), map[model.ClientId]uint64{1: uint64(i + 1)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, h.RemoveVersion(6))
+	require.NoError(t, h.ReplaceVersion(5, newTestStorageOps(t, &[]string{}, 10)...))
+	require.NoError(t, h.Squash(1, 3))
+	require.NoError(t, h.AddVersion(newTestStorageOps(t, &[]string{}, 10)...))
+	_, _, err = h.CommitVersion(nil, map[model.ClientId]uint64{2: 3})
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	checkRestored := func(h, restored *DocumentHistory) {
+		require.Equal(t, h.latestVersion, restored.latestVersion)
+		require.Equal(t, h.nextVersion, restored.nextVersion)
+		require.Equal(t, getTestVersions(h), getTestVersions(restored))
+		require.Equal(t, h.storage.Export(), restored.storage.Export())
+		require.Equal(t, h.clientSequences, restored.clientSequences)
+
+		_, baseList := restored.GetOutputSnapshot()
+		for _, version := range getTestVersions(restored) {
+			_, expectedOps, err := h.GetOutputDiffWithLatest(version)
+			require.NoError(t, err)
+			_, listOps, err := restored.GetOutputDiffWithLatest(version)
+			require.NoError(t, err)
+			require.Equal(t, expectedOps, listOps, "v%d", version)
+		}
+		require.Equal(t, h.storage.Export(), baseList)
+	}
+
+	// Restore
+	restored, err := NewDocHistoryFromFile(filePath, walPath, "")
+	require.NoError(t, err)
+	checkRestored(h, restored)
+
+	// Changes after restore are appended
+	require.NoError(t, restored.AddVersion(newTestStorageOps(t, &[]string{}, 10)...))
+	require.NoError(t, restored.Close())
+	expected := restored
+
+	restored, err = NewDocHistoryFromFile(filePath, walPath, "")
+	require.NoError(t, err)
+	checkRestored(expected, restored)
+	require.NoError(t, restored.Close())
+
+	// Torn tail is truncated (no checkpoints: a single segment)
+	segments, err := (&WAL{path: dir + "/./history.wal"}).listSegments()
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, segments)
+	segmentPath := (&WAL{path: walPath}).getSegmentPath(0)
+	walInfo, err := os.Stat(segmentPath)
+	require.NoError(t, err)
+	segmentFile, err := os.OpenFile(segmentPath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = segmentFile.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, segmentFile.Close())
+
+	restored, err = NewDocHistoryFromFile(filePath, walPath, "")
+	require.NoError(t, err)
+	checkRestored(expected, restored)
+	require.NoError(t, restored.Close())
+
+	walInfoTruncated, err := os.Stat(segmentPath)
+	require.NoError(t, err)
+	require.Equal(t, walInfo.Size(), walInfoTruncated.Size())
+
+	// WAL doesn't match the base file
+	require.NoError(t, GenAndSaveInitialStorage(filePath, 100, testCodec))
+	_, err = NewDocHistoryFromFile(filePath, walPath, "")
+	require.Error(t, err)
+
+	// Codec mismatch
+	require.NoError(t, GenAndSaveInitialStorage(filePath, 100, model.MustGetValueCodec(model.BytesValueCodecName)))
+	_, err = NewDocHistoryFromFile(filePath, walPath, "")
+	require.Error(t, err)
+}
+
+// faultyWALFile is a segment file failing writes (after writing a part of the frame) and truncates.
+type faultyWALFile struct {
+	*os.File
+	writeErr, truncateErr error
+}
+
+func (f *faultyWALFile) Write(p []byte) (int, error) {
+	if f.writeErr == nil {
+		return f.File.Write(p)
+	}
+	n, _ := f.File.Write(p[:len(p)/2])
+
+	return n, f.writeErr
+}
+
+func (f *faultyWALFile) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+
+	return f.File.Truncate(size)
+}
+
+// Test rolls back a partially written record and rejects appends if the rollback fails.
+func Test_WAL_AppendFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath, walPath := filepath.Join(dir, "base.dat"), filepath.Join(dir, "history.wal")
+	require.NoError(t, GenAndSaveInitialStorage(filePath, 100, testCodec))
+
+	h, err := NewDocHistoryFromFile(filePath, walPath, "")
+	require.NoError(t, err)
+
+	ids := make([]string, 0)
+	for _, item := range h.storage.Export() {
+		ids = append(ids, item.Id)
+	}
+	_, _, err = h.CommitVersion(newTestStorageOps(t, &ids, 20), nil)
+	require.NoError(t, err)
+
+	segmentPath := (&WAL{path: walPath}).getSegmentPath(0)
+	walInfo, err := os.Stat(segmentPath)
+	require.NoError(t, err)
+
+	// Write failure: the partial frame is truncated, the next append succeeds
+	file := &faultyWALFile{File: h.wal.file.(*os.File), writeErr: errors.New("disk is full")}
+	h.wal.file = file
+	_, _, err = h.CommitVersion(newTestStorageOps(t, &ids, 20), nil)
+	require.Error(t, err)
+	require.Equal(t, []int{0, 1}, getTestVersions(h))
+
+	walInfoRolledBack, err := os.Stat(segmentPath)
+	require.NoError(t, err)
+	require.Equal(t, walInfo.Size(), walInfoRolledBack.Size())
+
+	file.writeErr = nil
+	_, _, err = h.CommitVersion(newTestStorageOps(t, &ids, 20), nil)
+	require.NoError(t, err)
+
+	// Rollback failure: WAL is broken
+	file.writeErr, file.truncateErr = errors.New("disk is full"), errors.New("io error")
+	_, _, err = h.CommitVersion(newTestStorageOps(t, &ids, 20), nil)
+	require.Error(t, err)
+
+	file.writeErr, file.truncateErr = nil, nil
+	_, _, err = h.CommitVersion(newTestStorageOps(t, &ids, 20), nil)
+	require.Error(t, err)
+	require.Equal(t, []int{0, 1, 2}, getTestVersions(h))
+	require.NoError(t, h.Close())
+
+	// Restore: the torn tail of the broken append is dropped
+	restored, err := NewDocHistoryFromFile(filePath, walPath, "")
+	require.NoError(t, err)
+	require.Equal(t, getTestVersions(h), getTestVersions(restored))
+	require.Equal(t, h.storage.Export(), restored.storage.Export())
+	require.NoError(t, restored.Close())
+}